@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func WriteJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "    ")
+
+	err := enc.Encode(data)
+	if err != nil {
+		fmt.Printf("i/o error: %v", err)
+	}
+}
+
+func (server *Server) GetCommit(w http.ResponseWriter, r *http.Request) {
+	commit := chi.URLParam(r, "commit")
+
+	rec, err := server.imports.ByCommit(commit)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Commit was not imported", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, rec)
+}
+
+func (server *Server) GetManifestImport(w http.ResponseWriter, r *http.Request) {
+	d := MustHaveDigest(w, r)
+	if d == "" {
+		return
+	}
+
+	rec, err := server.imports.ByManifest(d)
+	if err != nil {
+		if p, perr := server.imports.Pending(d); perr == nil {
+			WriteJSON(w, http.StatusAccepted, p)
+			return
+		}
+
+		if os.IsNotExist(err) {
+			http.Error(w, "Manifest was not imported", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, rec)
+}
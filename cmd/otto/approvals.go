@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	digest "github.com/opencontainers/go-digest"
+)
+
+type ApprovalState string
+
+const (
+	ApprovalPending    ApprovalState = "pending"
+	ApprovalApproved   ApprovalState = "approved"
+	ApprovalRejected   ApprovalState = "rejected"
+	ApprovalSuperseded ApprovalState = "superseded"
+)
+
+type Signoff struct {
+	Identity string    `json:"identity"`
+	Time     time.Time `json:"time"`
+	Comment  string    `json:"comment,omitempty"`
+}
+
+// Approval tracks a staged commit until it is promoted to its ref
+type Approval struct {
+	ID       string        `json:"id"`
+	Ref      string        `json:"ref"`
+	Commit   string        `json:"commit"`
+	Manifest digest.Digest `json:"manifest"`
+	State    ApprovalState `json:"state"`
+	// head of the ref the checks ran against; the commit is only
+	// published if the ref still points to it
+	Head string `json:"head,omitempty"`
+
+	// why approval is needed
+	Reason string `json:"reason,omitempty"`
+
+	Required  int       `json:"required"`
+	Approvers []string  `json:"approvers,omitempty"`
+	Signoffs  []Signoff `json:"signoffs"`
+	Rejection *Signoff  `json:"rejection,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+var errNotPending = errors.New("approval is not pending")
+var errNotApprover = errors.New("not an approver")
+var errRefMoved = errors.New("ref was updated since the commit was staged")
+
+func StagingRef(ref string) string {
+	return "staging/" + ref
+}
+
+func (a *Approval) mayApprove(identity string) bool {
+	return len(a.Approvers) == 0 || matchAny(a.Approvers, identity)
+}
+
+// Approve adds the sign-off of identity and returns true once
+// enough approvals have been collected
+func (a *Approval) Approve(identity string, comment string, now time.Time) (bool, error) {
+	if a.State != ApprovalPending {
+		return false, errNotPending
+	}
+
+	if !a.mayApprove(identity) {
+		return false, errNotApprover
+	}
+
+	seen := false
+	for _, s := range a.Signoffs {
+		seen = seen || s.Identity == identity
+	}
+
+	if !seen {
+		a.Signoffs = append(a.Signoffs, Signoff{identity, now, comment})
+	}
+
+	a.Updated = now
+
+	if len(a.Signoffs) < a.Required {
+		return false, nil
+	}
+
+	a.State = ApprovalApproved
+	return true, nil
+}
+
+func (a *Approval) Reject(identity string, comment string, now time.Time) error {
+	if a.State != ApprovalPending {
+		return errNotPending
+	}
+
+	if !a.mayApprove(identity) {
+		return errNotApprover
+	}
+
+	a.State = ApprovalRejected
+	a.Rejection = &Signoff{identity, now, comment}
+	a.Updated = now
+
+	return nil
+}
+
+type ApprovalStore struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+func NewApprovalStore(path string) *ApprovalStore {
+	return &ApprovalStore{
+		Path: path,
+	}
+}
+
+func (store *ApprovalStore) Init() error {
+	return os.MkdirAll(store.Path, 0700)
+}
+
+func (store *ApprovalStore) Get(id string) (*Approval, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	var a Approval
+	err := readJSON(filepath.Join(store.Path, id), &a)
+	if err != nil {
+		return nil, err
+	}
+
+	return &a, nil
+}
+
+func (store *ApprovalStore) Put(a *Approval) error {
+	return writeJSON(filepath.Join(store.Path, a.ID), a)
+}
+
+// List returns all approvals in the given state, or all of them if
+// state is empty, oldest first
+func (store *ApprovalStore) List(state ApprovalState) ([]*Approval, error) {
+	entries, err := ioutil.ReadDir(store.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*Approval{}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		a, err := store.Get(e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		if state == "" || a.State == state {
+			res = append(res, a)
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+
+	return res, nil
+}
+
+// Create adds a pending approval for commit on ref; pending approvals
+// of older commits for the same ref are superseded
+func (store *ApprovalStore) Create(ref string, commit string, head string, manifest digest.Digest, rc ApprovalConfig, reason string) (*Approval, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	pending, err := store.List(ApprovalPending)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	for _, a := range pending {
+		if a.Ref != ref {
+			continue
+		}
+
+		// staged again, after checks against the current head
+		if a.Commit == commit {
+			a.Head = head
+			a.Updated = now
+			return a, store.Put(a)
+		}
+
+		a.State = ApprovalSuperseded
+		a.Updated = now
+
+		err = store.Put(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	required := rc.Required
+	if required < 1 {
+		required = 1
+	}
+
+	a := &Approval{
+		ID:        uuid.New().String(),
+		Ref:       ref,
+		Commit:    commit,
+		Manifest:  manifest,
+		State:     ApprovalPending,
+		Head:      head,
+		Reason:    reason,
+		Required:  required,
+		Approvers: rc.Approvers,
+		Signoffs:  []Signoff{},
+		Created:   now,
+		Updated:   now,
+	}
+
+	err = store.Put(a)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// needsApproval returns whether commits of rc may have to be approved,
+// either always or when a guardrail asks for it
+func (rc RefConfig) needsApproval() bool {
+	return rc.Approval.Required > 0 || rc.Limits.Action == "approve"
+}
+
+// checkApprovals makes sure approvals can only be given by
+// authenticated clients; without authentication nobody could approve,
+// or, worse, anybody could, and approvals would not guard anything
+func (server *Server) checkApprovals() error {
+	authenticated := server.htpasswd != nil
+	switch server.cfg.TLS.ClientAuth.Registry {
+	case ClientCertRequest, ClientCertRequire:
+		authenticated = true
+	}
+
+	if authenticated {
+		return nil
+	}
+
+	for pattern, rc := range server.cfg.Refs {
+		if rc.needsApproval() {
+			return fmt.Errorf("refs '%s' need approvals, which need authentication", pattern)
+		}
+	}
+
+	return nil
+}
+
+// StageCommit pulls commit from source into the staging repo, where
+// it waits for approval; the staging repo is never served, so the
+// commit is not visible before it is approved. The caller must hold
+// server.mu
+func (server *Server) StageCommit(source string, ref string, commit string, head string, manifest digest.Digest, reason string, origin audit.Event) (*Approval, error) {
+	rc := server.cfg.ConfigForRef(ref)
+
+	err := server.staging.PullLocal(source, commit, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not pull commit into staging repo: %w", err)
+	}
+
+	previous, err := server.staging.RevParse(StagingRef(ref))
+	if err != nil {
+		previous = ""
+	}
+
+	err = server.setLoggedRef(server.staging, StagingRef(ref), previous, commit, manifest.String())
+
+	event := origin
+	event.Action = "ref-update"
+	event.Ref = StagingRef(ref)
+	event.Commit = commit
+	event.Previous = previous
+	event.Digest = manifest.String()
+	event.Outcome = outcome(err)
+	if err != nil {
+		event.Message = err.Error()
+	}
+	server.Audit(event)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if previous != "" && previous != commit {
+		server.pruneStaged(previous)
+	}
+
+	return server.approvals.Create(ref, commit, head, manifest, rc.Approval, reason)
+}
+
+// publishApproved pulls the approved commit from the staging repo into
+// the repo and publishes it; the caller must hold server.mu
+func (server *Server) publishApproved(a *Approval, origin audit.Event) error {
+	// the checks, e.g. for a fast-forward or a newer version, ran
+	// against the head at the time the commit was staged
+	head, err := server.repo.RevParse(a.Ref)
+	if err != nil {
+		head = ""
+	}
+
+	if head != a.Head {
+		return errRefMoved
+	}
+
+	err = server.repo.PullLocal(server.staging.Path(), a.Commit, false)
+	if err != nil {
+		return fmt.Errorf("could not pull approved commit: %w", err)
+	}
+
+	return server.PublishCommit(a.Ref, a.Commit, origin)
+}
+
+// dropStaged removes the staging ref of a decided approval, if it
+// still points to its commit; the caller must hold server.mu
+func (server *Server) dropStaged(a *Approval, origin audit.Event) {
+	staged, err := server.staging.RevParse(StagingRef(a.Ref))
+	if err != nil || staged != a.Commit {
+		return
+	}
+
+	err = server.setLoggedRef(server.staging, StagingRef(a.Ref), staged, "", a.Manifest.String())
+	if err != nil {
+		fmt.Printf("Failed to remove staging ref: %v\n", err)
+	}
+
+	deleted := origin
+	deleted.Action = "ref-delete"
+	deleted.Ref = StagingRef(a.Ref)
+	deleted.Previous = staged
+	deleted.Outcome = outcome(err)
+	server.Audit(deleted)
+
+	if err == nil {
+		server.pruneStaged(staged)
+	}
+}
+
+// pruneStaged deletes commit from the staging repo, unless another
+// staging ref still points to it
+func (server *Server) pruneStaged(commit string) {
+	refs, err := server.staging.ListRefs()
+	if err != nil {
+		fmt.Printf("Failed to list staging refs: %v\n", err)
+		return
+	}
+
+	for _, ref := range refs {
+		if c, err := server.staging.RevParse(ref); err == nil && c == commit {
+			return
+		}
+	}
+
+	err = server.staging.Prune([]string{commit})
+	if err != nil {
+		fmt.Printf("Failed to prune staged commit: %v\n", err)
+	}
+}
+
+type approvalRequest struct {
+	Comment string `json:"comment"`
+}
+
+func (server *Server) ListApprovals(w http.ResponseWriter, r *http.Request) {
+	state := ApprovalState(r.URL.Query().Get("state"))
+
+	approvals, err := server.approvals.List(state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, approvals)
+}
+
+func (server *Server) GetApproval(w http.ResponseWriter, r *http.Request) {
+	a, err := server.approvals.Get(chi.URLParam(r, "id"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Approval does not exist", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, a)
+}
+
+func (server *Server) DecideApproval(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	decision := chi.URLParam(r, "decision")
+
+	var req approvalRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// decisions are only ever taken on behalf of an authenticated
+	// identity, never one the client merely claims
+	identity := IdentityFromRequest(r)
+	if identity == "" {
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	a, err := server.approvals.Get(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Approval does not exist", http.StatusNotFound)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !server.Allowed(w, r, auth.ActionPromote, auth.KindRef, a.Ref) {
+		return
+	}
+
+	now := time.Now().UTC()
+	promote := false
+
+	origin := requestOrigin(r)
+	origin.Digest = a.Manifest.String()
+
+	event := origin
+	event.Action = decision
+	event.Ref = a.Ref
+	event.Commit = a.Commit
+	event.Message = "approval " + a.ID
+
+	switch decision {
+	case "approve":
+		promote, err = a.Approve(identity, req.Comment, now)
+	case "reject":
+		err = a.Reject(identity, req.Comment, now)
+	default:
+		http.Error(w, "Unknown decision", http.StatusNotFound)
+		return
+	}
+
+	if err == errNotApprover {
+		event.Outcome = audit.OutcomeDenied
+		server.Audit(event)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	} else if err != nil {
+		event.Outcome, event.Message = audit.OutcomeFailure, fmt.Sprintf("%s: %v", event.Message, err)
+		server.Audit(event)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if promote {
+		fmt.Printf("Promoting approved %s to %s\n", a.Commit, a.Ref)
+
+		err = server.publishApproved(a, origin)
+		if err == errRefMoved {
+			// it has to be pushed or promoted again, to be checked
+			// against the new head
+			a.State = ApprovalSuperseded
+			event.Outcome, event.Message = audit.OutcomeFailure, fmt.Sprintf("%s: %v", event.Message, err)
+
+			if err := server.approvals.Put(a); err != nil {
+				fmt.Printf("Failed to record superseded approval: %v\n", err)
+			}
+			server.Audit(event)
+			server.dropStaged(a, origin)
+
+			http.Error(w, fmt.Sprintf("ref '%s' was updated since %s was staged, push or promote it again", a.Ref, a.Commit), http.StatusConflict)
+			return
+		} else if err != nil {
+			event.Outcome, event.Message = audit.OutcomeFailure, fmt.Sprintf("%s: %v", event.Message, err)
+			server.Audit(event)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = server.approvals.Put(a)
+	if err != nil {
+		event.Outcome, event.Message = audit.OutcomeFailure, fmt.Sprintf("%s: %v", event.Message, err)
+		server.Audit(event)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	server.Audit(event)
+
+	// the staged commit is only dropped once the decision is recorded
+	if a.State != ApprovalPending {
+		server.dropStaged(a, origin)
+	}
+
+	WriteJSON(w, http.StatusOK, a)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/ostree"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestApprove(t *testing.T) {
+	now := time.Now()
+
+	a := Approval{
+		State:     ApprovalPending,
+		Required:  2,
+		Approvers: []string{"alice", "bob"},
+	}
+
+	_, err := a.Approve("mallory", "", now)
+	if err != errNotApprover {
+		t.Fatalf("Only approvers may approve: %v", err)
+	}
+
+	done, err := a.Approve("alice", "lgtm", now)
+	if err != nil || done {
+		t.Fatalf("One approval should not be enough: %v %v", done, err)
+	}
+
+	// approving twice does not count
+	done, err = a.Approve("alice", "", now)
+	if err != nil || done {
+		t.Fatalf("Approvals of the same identity must count once: %v %v", done, err)
+	}
+
+	done, err = a.Approve("bob", "", now)
+	if err != nil || !done || a.State != ApprovalApproved {
+		t.Fatalf("Two approvals should be enough: %v %v %s", done, err, a.State)
+	}
+
+	err = a.Reject("bob", "", now)
+	if err != errNotPending {
+		t.Fatalf("Approved approvals cannot be rejected: %v", err)
+	}
+}
+
+func TestApprovalStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	store := NewApprovalStore(tmp)
+	err = store.Init()
+	if err != nil {
+		t.Fatalf("Failed to init store: %v", err)
+	}
+
+	rc := ApprovalConfig{Required: 1}
+	m := digest.FromString("manifest")
+
+	first, err := store.Create("fedora/x86_64/iot", "aaaa", "", m, rc, "")
+	if err != nil {
+		t.Fatalf("Failed to create approval: %v", err)
+	}
+
+	again, err := store.Create("fedora/x86_64/iot", "aaaa", "0000", m, rc, "")
+	if err != nil || again.ID != first.ID {
+		t.Fatalf("Same commit should reuse the approval: %v", err)
+	}
+
+	// it was checked against the new head
+	stored, err := store.Get(first.ID)
+	if err != nil || stored.Head != "0000" {
+		t.Fatalf("Head of the reused approval should be updated: %+v (%v)", stored, err)
+	}
+
+	second, err := store.Create("fedora/x86_64/iot", "bbbb", "0000", m, rc, "")
+	if err != nil {
+		t.Fatalf("Failed to create approval: %v", err)
+	}
+
+	pending, err := store.List(ApprovalPending)
+	if err != nil || len(pending) != 1 || pending[0].ID != second.ID {
+		t.Fatalf("Expected only the second approval to be pending: %v", err)
+	}
+
+	old, err := store.Get(first.ID)
+	if err != nil || old.State != ApprovalSuperseded {
+		t.Fatalf("First approval should be superseded: %v", err)
+	}
+
+	all, err := store.List("")
+	if err != nil || len(all) != 2 {
+		t.Fatalf("Expected two approvals: %v", err)
+	}
+
+	_, err = store.Get("../imports")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Invalid ids should not exist: %v", err)
+	}
+}
+
+func TestPublishApprovedMovedRef(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg := OttoConfig{}
+	server := &Server{
+		cfg:     &cfg,
+		root:    tmp,
+		repo:    ostree.NewRepo(filepath.Join(tmp, "repo")),
+		staging: ostree.NewRepo(filepath.Join(tmp, "staging")),
+	}
+
+	// the ref was deleted since the commit was staged
+	a := &Approval{Ref: "fedora/x86_64/iot", Commit: "bbbb", Head: "aaaa"}
+
+	err = server.publishApproved(a, audit.Event{})
+	if err != errRefMoved {
+		t.Fatalf("Commits must not be published over a moved ref: %v", err)
+	}
+}
+
+func TestCheckApprovals(t *testing.T) {
+	cfg := OttoConfig{
+		Refs: map[string]RefConfig{
+			"otto/*": {Limits: LimitsConfig{MaxFiles: 10, Action: "approve"}},
+		},
+	}
+
+	server := &Server{cfg: &cfg}
+
+	err := server.checkApprovals()
+	if err == nil {
+		t.Fatalf("Approvals without authentication must be refused")
+	}
+
+	cfg.TLS.ClientAuth.Registry = ClientCertRequire
+	err = server.checkApprovals()
+	if err != nil {
+		t.Fatalf("Client certificates should be enough: %v", err)
+	}
+
+	cfg.TLS.ClientAuth.Registry = ""
+	cfg.Refs = map[string]RefConfig{"otto/*": {FastForwardOnly: true}}
+	err = server.checkApprovals()
+	if err != nil {
+		t.Fatalf("Refs without approvals do not need authentication: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gicmo/otto/internal/container"
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// architecture names used by OCI images, keyed by the names used in
+// ostree refs and by rpm
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"aarch64": "arm64",
+	"armhfp":  "arm",
+	"armv7hl": "arm",
+	"i686":    "386",
+	"ppc64le": "ppc64le",
+	"s390x":   "s390x",
+	"riscv64": "riscv64",
+}
+
+// normalizeArch returns the OCI name of arch or an empty string if
+// it is not a known architecture
+func normalizeArch(arch string) string {
+	if oci, ok := archAliases[arch]; ok {
+		return oci
+	}
+
+	for _, oci := range archAliases {
+		if arch == oci {
+			return oci
+		}
+	}
+
+	return ""
+}
+
+// archFromRef returns the architecture of a ref like
+// "fedora/36/x86_64/iot", or an empty string if it has none
+func archFromRef(ref string) string {
+	for _, part := range strings.Split(ref, "/") {
+		if arch := normalizeArch(part); arch != "" {
+			return arch
+		}
+	}
+	return ""
+}
+
+// imageArch reads the architecture from the image configuration
+func imageArch(reg *container.Registry, config digest.Digest) (string, error) {
+	f, err := os.Open(reg.PathForBlob(config))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var image v1.Image
+	err = json.NewDecoder(f).Decode(&image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image config: %w", err)
+	}
+
+	return image.Architecture, nil
+}
+
+func checkArch(server *Server, ic *importContext) error {
+	// there is nothing to compare with for commits that were imported
+	// before their architecture was recorded and whose source ref has
+	// none
+	if ic.ci.arch == "" && ic.promotion {
+		return nil
+	} else if ic.ci.arch == "" {
+		return fmt.Errorf("image does not specify an architecture")
+	}
+
+	want := normalizeArch(ic.ci.arch)
+	if want == "" {
+		return fmt.Errorf("unknown image architecture '%s'", ic.ci.arch)
+	}
+
+	have := archFromRef(ic.ci.target)
+	source := "ref"
+
+	if have == "" && ic.rc.Arch.MetadataKey != "" {
+		value, err := ic.repo.MetadataString(ic.commit, ic.rc.Arch.MetadataKey)
+		if err != nil {
+			return fmt.Errorf("could not read metadata: %w", err)
+		}
+		have = normalizeArch(value)
+		source = "commit metadata"
+	}
+
+	if have == "" {
+		return fmt.Errorf("could not determine the architecture of the commit")
+	}
+
+	if have != want {
+		return fmt.Errorf("%s is for %s, but the image is for %s", source, have, want)
+	}
+
+	return nil
+}
+
+func checkVersion(server *Server, ic *importContext) error {
+	if ic.head == "" {
+		return nil
+	}
+
+	commit, err := ic.repo.ShowCommit(ic.commit)
+	if err != nil {
+		return fmt.Errorf("could not read commit: %w", err)
+	}
+
+	if commit.Version == "" {
+		return fmt.Errorf("commit has no version")
+	}
+
+	head, err := server.repo.ShowCommit(ic.head)
+	if err != nil {
+		return fmt.Errorf("could not read head: %w", err)
+	}
+
+	// nothing to compare with
+	if head.Version == "" {
+		return nil
+	}
+
+	res, err := CompareVersions(ic.rc.Versions.Scheme, commit.Version, head.Version)
+	if err != nil {
+		return err
+	}
+
+	if res <= 0 {
+		return fmt.Errorf("version %s is not newer than %s of the current head", commit.Version, head.Version)
+	}
+
+	return nil
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestArchFromRef(t *testing.T) {
+	tests := map[string]string{
+		"fedora/36/x86_64/iot":  "amd64",
+		"fedora/aarch64/iot":    "arm64",
+		"fedora/36/armhfp/iot":  "arm",
+		"custom/arm64/stable":   "arm64",
+		"fedora/devel/iot":      "",
+		"fedora/x86_64_foo/iot": "",
+	}
+
+	for ref, want := range tests {
+		if have := archFromRef(ref); have != want {
+			t.Errorf("archFromRef(%s): want '%s', have '%s'", ref, want, have)
+		}
+	}
+}
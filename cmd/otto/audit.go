@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+)
+
+type AuditConfig struct {
+	// defaults to <root>/audit/audit.jsonl
+	File string `toml:"file"`
+	// include the hash of the previous event in each event
+	Chain bool `toml:"chain"`
+}
+
+func (server *Server) initAudit() error {
+	path := server.cfg.Audit.File
+	if path == "" {
+		path = filepath.Join(server.root, "audit", "audit.jsonl")
+	}
+
+	log, err := audit.Open(path, server.cfg.Audit.Chain)
+	if err != nil {
+		return err
+	}
+
+	server.audit = log
+	return nil
+}
+
+// remoteAddr returns the address of the client without the port
+func remoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestOrigin returns an event with the identity and the address
+// of the client of the request
+func requestOrigin(r *http.Request) audit.Event {
+	return audit.Event{
+		Identity: IdentityFromRequest(r),
+		Source:   remoteAddr(r),
+	}
+}
+
+func outcome(err error) audit.Outcome {
+	if err != nil {
+		return audit.OutcomeFailure
+	}
+	return audit.OutcomeSuccess
+}
+
+// Audit records the event; failures are logged, but do not fail the
+// operation, which has already happened
+func (server *Server) Audit(e audit.Event) {
+	if server.audit == nil {
+		return
+	}
+
+	if e.Outcome == "" {
+		e.Outcome = audit.OutcomeSuccess
+	}
+
+	_, err := server.audit.Append(e)
+	if err != nil {
+		fmt.Printf("Could not write audit event %s: %v\n", e.Action, err)
+	}
+}
+
+// AuditRequest records the event of the request
+func (server *Server) AuditRequest(r *http.Request, e audit.Event) {
+	origin := requestOrigin(r)
+
+	if e.Identity == "" {
+		e.Identity = origin.Identity
+	}
+
+	if e.Source == "" {
+		e.Source = origin.Source
+	}
+
+	server.Audit(e)
+}
+
+// ListAudit returns the audit events, filtered by the "since" and
+// "until" times (RFC 3339), "ref" (a pattern), "action", "identity"
+// and "limit" query parameters
+func (server *Server) ListAudit(w http.ResponseWriter, r *http.Request) {
+	if server.audit == nil {
+		http.Error(w, "audit log not enabled", http.StatusNotFound)
+		return
+	}
+
+	q := r.URL.Query()
+
+	f := audit.Filter{
+		Ref:      q.Get("ref"),
+		Action:   q.Get("action"),
+		Identity: q.Get("identity"),
+	}
+
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &f.Since}, {"until", &f.Until}} {
+		value := q.Get(p.name)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid time for %s: '%s'", p.name, value), http.StatusBadRequest)
+			return
+		}
+		*p.t = t
+	}
+
+	if value := q.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit: '%s'", value), http.StatusBadRequest)
+			return
+		}
+		f.Limit = limit
+	}
+
+	events, err := server.audit.Query(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, events)
+}
+
+func cmdAudit(server *Server, args []string) int {
+	if len(args) != 1 || args[0] != "verify" {
+		fmt.Fprintf(os.Stderr, "usage: otto audit verify\n")
+		return 2
+	}
+
+	n, err := server.audit.Verify()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Audit log %s is invalid: %v\n", server.audit.Path(), err)
+		return 1
+	}
+
+	fmt.Printf("Verified %d events\n", n)
+	return 0
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gicmo/otto/internal/audit"
+)
+
+func TestAudit(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg := OttoConfig{}
+	cfg.Audit.Chain = true
+	server := &Server{cfg: &cfg, root: tmp}
+
+	err = server.initAudit()
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+
+	if server.audit.Path() != filepath.Join(tmp, "audit", "audit.jsonl") {
+		t.Fatalf("Unexpected audit log path: %s", server.audit.Path())
+	}
+
+	req := httptest.NewRequest("PUT", "/v2/iot/manifests/latest", nil)
+	req.RemoteAddr = "192.0.2.1:4711"
+	req = WithIdentity(req, "builder")
+
+	server.AuditRequest(req, audit.Event{Action: "manifest-push", Repository: "iot"})
+	server.Audit(audit.Event{Action: "ref-update", Identity: "builder", Ref: "fedora/x86_64/iot", Commit: "abc"})
+	server.Audit(audit.Event{Action: "ref-update", Ref: "fedora/x86_64/coreos", Outcome: audit.OutcomeFailure})
+
+	list := func(query string) (int, []audit.Event) {
+		w := httptest.NewRecorder()
+		server.ListAudit(w, httptest.NewRequest("GET", "/api/v1/audit?"+query, nil))
+
+		var events []audit.Event
+		_ = json.Unmarshal(w.Body.Bytes(), &events)
+		return w.Code, events
+	}
+
+	code, events := list("")
+	if code != http.StatusOK || len(events) != 3 {
+		t.Fatalf("Unexpected events: %d %v", code, events)
+	}
+
+	push := events[0]
+	if push.Identity != "builder" || push.Source != "192.0.2.1" || push.Outcome != audit.OutcomeSuccess {
+		t.Fatalf("Unexpected push event: %+v", push)
+	}
+
+	_, events = list("ref=fedora/x86_64/iot")
+	if len(events) != 1 || events[0].Commit != "abc" {
+		t.Fatalf("Unexpected events for ref: %v", events)
+	}
+
+	_, events = list("action=ref-update&limit=1")
+	if len(events) != 1 || events[0].Outcome != audit.OutcomeFailure {
+		t.Fatalf("Unexpected limited events: %v", events)
+	}
+
+	for _, query := range []string{"since=yesterday", "limit=-1"} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %d", query, code)
+		}
+	}
+
+	n, err := server.audit.Verify()
+	if err != nil || n != 3 {
+		t.Fatalf("Audit log should verify: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+type TokenConfig struct {
+	// file with the secret key tokens are signed with; token
+	// authentication is disabled if not set
+	KeyFile string `toml:"key-file"`
+	Issuer  string `toml:"issuer"`
+	Service string `toml:"service"`
+	// URL of the token endpoint, derived from the request if empty
+	Realm  string   `toml:"realm"`
+	Expiry Duration `toml:"expiry"`
+
+	// which scopes each user may get, in addition to the policy
+	Grants []TokenGrant `toml:"grants"`
+}
+
+// TokenGrant allows the users matching Users to get tokens for the
+// actions, "pull" or "push", on the registry repositories matching
+// Repos; all values are patterns as understood by path.Match
+type TokenGrant struct {
+	Users   []string `toml:"users"`
+	Repos   []string `toml:"repos"`
+	Actions []string `toml:"actions"`
+}
+
+func (g TokenGrant) Allows(user string, repo string, action string) bool {
+	return matchAny(g.Users, user) && matchAny(g.Repos, repo) && matchAny(g.Actions, action)
+}
+
+// tokenGranted checks if the grants allow user a token for action on
+// the repository; without grants, only the policy decides
+func (tc TokenConfig) tokenGranted(user string, repo string, action string) bool {
+	if len(tc.Grants) == 0 {
+		return true
+	}
+
+	for _, g := range tc.Grants {
+		if g.Allows(user, repo, action) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type AuthConfig struct {
+	// htpasswd file with bcrypt hashes; authentication is disabled
+	// if not set
+	Htpasswd string `toml:"htpasswd"`
+	Realm    string `toml:"realm"`
+
+	// also require authentication for the ostree repo
+	ProtectRepo bool `toml:"protect-repo"`
+
+	Token TokenConfig `toml:"token"`
+
+	// role based access control policy; everything is allowed
+	// if not set
+	Policy string `toml:"policy"`
+
+	Presign PresignConfig `toml:"presign"`
+
+	Devices DevicesConfig `toml:"devices"`
+}
+
+func (server *Server) realm() string {
+	if server.cfg.Auth.Realm != "" {
+		return server.cfg.Auth.Realm
+	}
+	return "otto"
+}
+
+// requiredAccess returns the repository and the action a registry
+// request needs; the repository is empty for other routes
+func requiredAccess(r *http.Request) (string, string) {
+	action := "push"
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		action = "pull"
+	}
+
+	return chi.URLParam(r, "repo"), action
+}
+
+// authError responds with a challenge, in the format of the
+// distribution spec for registry clients
+func (server *Server) authError(w http.ResponseWriter, r *http.Request, code string, msg string) {
+	challenge := fmt.Sprintf("Basic realm=%q", server.realm())
+
+	if server.tokens != nil && strings.HasPrefix(r.URL.Path, "/v2/") {
+		tc := server.cfg.Auth.Token
+
+		realm := tc.Realm
+		if realm == "" {
+			realm = fmt.Sprintf("https://%s/auth/token", r.Host)
+		}
+
+		challenge = fmt.Sprintf("Bearer realm=%q,service=%q", realm, server.tokens.Service)
+
+		if repo, action := requiredAccess(r); repo != "" {
+			actions := action
+			if action == "push" {
+				actions = "pull,push"
+			}
+			challenge += fmt.Sprintf(",scope=\"repository:%s:%s\"", repo, actions)
+		}
+
+		if code == "DENIED" {
+			challenge += `,error="insufficient_scope"`
+		}
+	}
+
+	w.Header().Set("WWW-Authenticate", challenge)
+
+	WriteJSON(w, http.StatusUnauthorized, map[string]interface{}{
+		"errors": []map[string]string{{
+			"code":    code,
+			"message": msg,
+		}},
+	})
+}
+
+// tokenAllows checks if the token grants access to the route; tokens
+// are only valid for the registry
+func tokenAllows(claims *auth.Claims, r *http.Request) bool {
+	repo, action := requiredAccess(r)
+	if repo == "" {
+		return r.URL.Path == "/v2/"
+	}
+
+	return claims.Allows("repository", repo, action)
+}
+
+// Authenticate is the middleware that requires valid credentials and
+// adds the identity of the client to the request
+func (server *Server) Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.htpasswd == nil {
+			if subject := ClientSubject(r); subject != "" {
+				r = WithIdentity(r, subject)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get("Authorization")
+
+		if server.tokens != nil && strings.HasPrefix(header, "Bearer ") {
+			claims, err := server.tokens.Verify(strings.TrimPrefix(header, "Bearer "), time.Now())
+			if err != nil {
+				server.authError(w, r, "UNAUTHORIZED", err.Error())
+				return
+			}
+
+			if !tokenAllows(claims, r) {
+				server.authError(w, r, "DENIED", "insufficient scope")
+				return
+			}
+
+			next.ServeHTTP(w, WithIdentity(r, claims.Subject))
+			return
+		}
+
+		// a verified client certificate is enough
+		if subject := ClientSubject(r); subject != "" && header == "" {
+			next.ServeHTTP(w, WithIdentity(r, subject))
+			return
+		}
+
+		user, password, ok := r.BasicAuth()
+		if !ok || !server.htpasswd.Verify(user, password) {
+			server.authError(w, r, "UNAUTHORIZED", "authentication required")
+			return
+		}
+
+		next.ServeHTTP(w, WithIdentity(r, user))
+	})
+}
+
+// grantAccess returns the subset of the requested access the identity
+// is granted
+func (server *Server) grantAccess(identity string, requested []auth.Access) []auth.Access {
+	var granted []auth.Access
+	principal := auth.Principal{Identity: identity}
+
+	for _, a := range requested {
+		if a.Type != "repository" {
+			continue
+		}
+
+		var actions []string
+		for _, action := range a.Actions {
+			if action != "pull" && action != "push" {
+				continue
+			}
+
+			if !server.cfg.Auth.Token.tokenGranted(identity, a.Name, action) {
+				fmt.Printf("Not granting %s on %s to %s: no grant\n", action, a.Name, identity)
+				continue
+			}
+
+			err := server.Authorize(principal, auth.Action(action), auth.KindRepository, a.Name)
+			if err != nil {
+				fmt.Printf("Not granting %s: %v\n", action, err)
+				continue
+			}
+
+			actions = append(actions, action)
+		}
+
+		if len(actions) > 0 {
+			granted = append(granted, auth.Access{Type: a.Type, Name: a.Name, Actions: actions})
+		}
+	}
+
+	return granted
+}
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+	IssuedAt    string `json:"issued_at"`
+}
+
+// IssueToken is the token endpoint: it checks the credentials of the
+// client and issues a token for the requested scopes
+func (server *Server) IssueToken(w http.ResponseWriter, r *http.Request) {
+	if server.tokens == nil {
+		http.Error(w, "Token authentication is disabled", http.StatusNotFound)
+		return
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok || !server.htpasswd.Verify(user, password) {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", server.realm()))
+		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		return
+	}
+
+	if service := r.URL.Query().Get("service"); service != "" && service != server.tokens.Service {
+		http.Error(w, "Unknown service", http.StatusBadRequest)
+		return
+	}
+
+	var requested []auth.Access
+	for _, param := range r.URL.Query()["scope"] {
+		for _, scope := range strings.Fields(param) {
+			a, err := auth.ParseScope(scope)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			requested = append(requested, a)
+		}
+	}
+
+	now := time.Now().UTC()
+
+	token, claims, err := server.tokens.Issue(user, server.grantAccess(user, requested), now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, tokenResponse{
+		Token:       token,
+		AccessToken: token,
+		ExpiresIn:   int(claims.ExpiresAt - claims.IssuedAt),
+		IssuedAt:    now.Format(time.RFC3339),
+	})
+}
+
+func (server *Server) initAuth() error {
+	ac := server.cfg.Auth
+
+	if ac.Htpasswd == "" {
+		if ac.Token.KeyFile != "" {
+			return fmt.Errorf("token authentication needs an htpasswd file")
+		}
+		return nil
+	}
+
+	h, err := auth.NewHtpasswd(ac.Htpasswd)
+	if err != nil {
+		return err
+	}
+
+	server.htpasswd = h
+
+	if ac.Token.KeyFile == "" {
+		return nil
+	}
+
+	// otherwise every user would get every scope they ask for
+	if len(ac.Token.Grants) == 0 && ac.Policy == "" {
+		return fmt.Errorf("token authentication needs grants or a policy")
+	}
+
+	key, err := ioutil.ReadFile(ac.Token.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	issuer, service, expiry := ac.Token.Issuer, ac.Token.Service, ac.Token.Expiry.Duration
+	if issuer == "" {
+		issuer = "otto"
+	}
+	if service == "" {
+		service = "otto"
+	}
+	if expiry == 0 {
+		expiry = 5 * time.Minute
+	}
+
+	server.tokens, err = auth.NewTokenIssuer(key, issuer, service, expiry)
+	return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTestHtpasswd(t *testing.T, dir string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	path := filepath.Join(dir, "htpasswd")
+	err = ioutil.WriteFile(path, []byte(fmt.Sprintf("builder:%s\n", hash)), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write htpasswd: %v", err)
+	}
+
+	return path
+}
+
+func TestAuthenticate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := writeTestHtpasswd(t, tmp)
+
+	cfg := OttoConfig{}
+	server := &Server{cfg: &cfg}
+
+	handler := server.Authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(IdentityFromRequest(r)))
+	}))
+
+	// disabled
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "" {
+		t.Fatalf("Unexpected response without authentication: %d %s", w.Code, w.Body.String())
+	}
+
+	cfg.Auth.Htpasswd = path
+	cfg.Auth.Realm = "iot"
+	err = server.initAuth()
+	if err != nil {
+		t.Fatalf("Failed to setup authentication: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v2/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d", w.Code)
+	}
+
+	if challenge := w.Header().Get("WWW-Authenticate"); challenge != `Basic realm="iot"` {
+		t.Fatalf("Unexpected challenge: %s", challenge)
+	}
+
+	r := httptest.NewRequest("GET", "/v2/", nil)
+	r.SetBasicAuth("builder", "wrong")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 for wrong password, got %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/v2/", nil)
+	r.SetBasicAuth("builder", "s3cret")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "builder" {
+		t.Fatalf("Unexpected response: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestTokenAuth(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	keyFile := filepath.Join(tmp, "token.key")
+	err = ioutil.WriteFile(keyFile, []byte(strings.Repeat("k", 32)), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	cfg.Auth.Token.KeyFile = keyFile
+	server := &Server{cfg: &cfg}
+
+	err = server.initAuth()
+	if err == nil {
+		t.Fatalf("Tokens without htpasswd should be rejected")
+	}
+
+	cfg.Auth.Htpasswd = writeTestHtpasswd(t, tmp)
+	err = server.initAuth()
+	if err == nil {
+		t.Fatalf("Tokens without grants or a policy should be rejected")
+	}
+
+	cfg.Auth.Token.Grants = []TokenGrant{
+		{Users: []string{"builder"}, Repos: []string{"iot"}, Actions: []string{"pull"}},
+	}
+	err = server.initAuth()
+	if err != nil {
+		t.Fatalf("Failed to setup authentication: %v", err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(IdentityFromRequest(r)))
+	}
+
+	router := chi.NewRouter()
+	router.Get("/auth/token", server.IssueToken)
+	router.Group(func(r chi.Router) {
+		r.Use(server.Authenticate)
+		r.Get("/v2/{repo}/manifests/{reference}", ok)
+		r.Put("/v2/{repo}/manifests/{reference}", ok)
+		r.Get("/api/v1/approvals", ok)
+	})
+
+	do := func(method string, url string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, url, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := do("PUT", "/v2/iot/manifests/latest", "")
+	challenge := w.Header().Get("WWW-Authenticate")
+	if w.Code != http.StatusUnauthorized || !strings.HasPrefix(challenge, "Bearer realm=") ||
+		!strings.Contains(challenge, `scope="repository:iot:pull,push"`) {
+		t.Fatalf("Unexpected challenge: %d %s", w.Code, challenge)
+	}
+
+	r := httptest.NewRequest("GET", "/auth/token?service=otto&scope=repository:iot:pull", nil)
+	r.SetBasicAuth("builder", "wrong")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Token for wrong credentials: %d", w.Code)
+	}
+
+	r = httptest.NewRequest("GET", "/auth/token?service=otto&scope=repository:iot:pull", nil)
+	r.SetBasicAuth("builder", "s3cret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to get token: %d %s", w.Code, w.Body.String())
+	}
+
+	var res tokenResponse
+	err = json.NewDecoder(w.Body).Decode(&res)
+	if err != nil || res.Token == "" || res.ExpiresIn != 300 {
+		t.Fatalf("Unexpected token response: %+v (%v)", res, err)
+	}
+
+	w = do("GET", "/v2/iot/manifests/latest", res.Token)
+	if w.Code != http.StatusOK || w.Body.String() != "builder" {
+		t.Fatalf("Pull with token failed: %d %s", w.Code, w.Body.String())
+	}
+
+	w = do("PUT", "/v2/iot/manifests/latest", res.Token)
+	if w.Code != http.StatusUnauthorized || !strings.Contains(w.Header().Get("WWW-Authenticate"), "insufficient_scope") {
+		t.Fatalf("Push with pull token should be denied: %d", w.Code)
+	}
+
+	w = do("GET", "/v2/other/manifests/latest", res.Token)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Token should be limited to its repository: %d", w.Code)
+	}
+
+	w = do("GET", "/api/v1/approvals", res.Token)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Token should not be valid for the API: %d", w.Code)
+	}
+
+	// push is requested, but not granted
+	r = httptest.NewRequest("GET", "/auth/token?service=otto&scope=repository:iot:pull,push", nil)
+	r.SetBasicAuth("builder", "s3cret")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	err = json.NewDecoder(w.Body).Decode(&res)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("Failed to get token: %d (%v)", w.Code, err)
+	}
+
+	w = do("PUT", "/v2/iot/manifests/latest", res.Token)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Push without a grant should be denied: %d", w.Code)
+	}
+
+	w = do("GET", "/v2/iot/manifests/latest", res.Token+"x")
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Invalid token should be rejected: %d", w.Code)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+func principalFromRequest(r *http.Request) auth.Principal {
+	return auth.Principal{
+		Identity: IdentityFromRequest(r),
+		Subject:  ClientSubject(r),
+	}
+}
+
+// Authorize checks if the policy allows the principal action on the
+// resource; everything is allowed if there is no policy
+func (server *Server) Authorize(principal auth.Principal, action auth.Action, kind string, name string) error {
+	if server.policy == nil {
+		return nil
+	}
+
+	policy, err := server.policy.Policy()
+	if err != nil {
+		fmt.Printf("Could not reload policy: %v\n", err)
+	}
+
+	if policy == nil {
+		return fmt.Errorf("no valid policy")
+	}
+
+	return policy.Check(principal, action, kind, name)
+}
+
+// Allowed authorizes the request; if it is denied, the reason is
+// logged and the client gets an error
+func (server *Server) Allowed(w http.ResponseWriter, r *http.Request, action auth.Action, kind string, name string) bool {
+	principal := principalFromRequest(r)
+
+	err := server.Authorize(principal, action, kind, name)
+	if err == nil {
+		return true
+	}
+
+	fmt.Printf("Denied %s %s: %v\n", r.Method, r.URL.Path, err)
+
+	// denied changes are audited, denied reads are not
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		event := audit.Event{
+			Action:  string(action),
+			Outcome: audit.OutcomeDenied,
+			Message: fmt.Sprintf("%s %s: %v", r.Method, r.URL.Path, err),
+		}
+
+		switch kind {
+		case auth.KindRepository:
+			event.Repository = name
+		case auth.KindRef:
+			event.Ref = name
+		}
+
+		server.AuditRequest(r, event)
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/v2/") {
+		WriteJSON(w, http.StatusForbidden, map[string]interface{}{
+			"errors": []map[string]string{{
+				"code":    "DENIED",
+				"message": err.Error(),
+			}},
+		})
+	} else {
+		http.Error(w, err.Error(), http.StatusForbidden)
+	}
+
+	return false
+}
+
+// RegistryAccess is the middleware that authorizes pulls and pushes
+// of registry repositories
+func (server *Server) RegistryAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo, action := requiredAccess(r)
+
+		if repo != "" && !server.Allowed(w, r, auth.Action(action), auth.KindRepository, repo) {
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAction returns a middleware that authorizes action, which
+// does not apply to a specific resource
+func (server *Server) RequireAction(action auth.Action) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !server.Allowed(w, r, action, "", "") {
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (server *Server) initPolicy() error {
+	if server.cfg.Auth.Policy == "" {
+		return nil
+	}
+
+	pf, err := auth.NewPolicyFile(server.cfg.Auth.Policy)
+	if err != nil {
+		return err
+	}
+
+	server.policy = pf
+	return nil
+}
+
+// registryRoutes adds the routes of the registry, which are authorized
+// per repository
+func (server *Server) registryRoutes(r chi.Router) {
+	r.Use(server.RegistryAccess)
+
+	r.Head("/v2/{repo}/blobs/{digest}", server.HeadBlob)
+	r.Get("/v2/{repo}/blobs/{digest}", server.GetBlob)
+
+	r.Post("/v2/{repo}/blobs/uploads/", server.BeginUpload)
+	r.Patch("/v2/{repo}/blobs/uploads/{uuid}", server.UploadChunked)
+	r.Put("/v2/{repo}/blobs/uploads/{uuid}", server.UploadFinish)
+	r.Put("/v2/{repo}/manifests/{reference}", server.UploadManifest)
+	r.Get("/v2/{repo}/manifests/{reference}", server.GetManifest)
+}
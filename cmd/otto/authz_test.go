@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAuthorization(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "policy.toml")
+	err = ioutil.WriteFile(path, []byte(`
+[[bindings]]
+role = "reader"
+anonymous = true
+repos = ["public"]
+
+[[bindings]]
+role = "pusher"
+users = ["builder"]
+repos = ["iot"]
+
+[[bindings]]
+role = "admin"
+users = ["root"]
+`), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	cfg.Auth.Policy = path
+	server := &Server{cfg: &cfg}
+
+	err = server.initPolicy()
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	router := chi.NewRouter()
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, WithIdentity(r, r.Header.Get("X-Test-User")))
+		})
+	})
+	router.Group(func(r chi.Router) {
+		r.Use(server.RegistryAccess)
+		r.Get("/v2/{repo}/manifests/{reference}", ok)
+		r.Put("/v2/{repo}/manifests/{reference}", ok)
+	})
+	router.With(server.RequireAction(auth.ActionAdmin)).Post("/api/v1/prune", ok)
+
+	tests := []struct {
+		user   string
+		method string
+		path   string
+		code   int
+	}{
+		{"", "GET", "/v2/public/manifests/latest", http.StatusOK},
+		{"", "GET", "/v2/iot/manifests/latest", http.StatusForbidden},
+		{"", "PUT", "/v2/public/manifests/latest", http.StatusForbidden},
+		{"builder", "PUT", "/v2/iot/manifests/latest", http.StatusOK},
+		{"builder", "GET", "/v2/iot/manifests/latest", http.StatusOK},
+		{"builder", "PUT", "/v2/other/manifests/latest", http.StatusForbidden},
+		{"builder", "POST", "/api/v1/prune", http.StatusForbidden},
+		{"root", "POST", "/api/v1/prune", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("X-Test-User", tt.user)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		if w.Code != tt.code {
+			t.Errorf("%s %s as '%s': expected %d, got %d: %s", tt.method, tt.path, tt.user, tt.code, w.Code, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/go-chi/chi/v5"
+)
+
+type ChannelConfig struct {
+	Name string `toml:"name" json:"name"`
+	Ref  string `toml:"ref" json:"ref"`
+}
+
+// ProductConfig lists the channels of a product in promotion order,
+// e.g. dev, beta, stable
+type ProductConfig struct {
+	Channels []ChannelConfig `toml:"channels"`
+}
+
+// NextChannel returns the channel called name and the one its commits
+// are promoted to
+func (pc ProductConfig) NextChannel(name string) (*ChannelConfig, *ChannelConfig, error) {
+	for i := range pc.Channels {
+		if pc.Channels[i].Name != name {
+			continue
+		}
+
+		if i+1 == len(pc.Channels) {
+			return nil, nil, fmt.Errorf("channel '%s' is the last channel", name)
+		}
+
+		return &pc.Channels[i], &pc.Channels[i+1], nil
+	}
+
+	return nil, nil, fmt.Errorf("channel '%s' does not exist", name)
+}
+
+// Product returns the product called name; if only one product is
+// configured, the name may be omitted
+func (cfg *OttoConfig) Product(name string) (string, *ProductConfig, error) {
+	if name == "" && len(cfg.Products) == 1 {
+		for n := range cfg.Products {
+			name = n
+		}
+	}
+
+	pc, ok := cfg.Products[name]
+	if !ok {
+		return "", nil, fmt.Errorf("product '%s' does not exist", name)
+	}
+
+	return name, &pc, nil
+}
+
+// IsAncestor checks if ancestor is part of the history of commit, as
+// far as it is present in the repo
+func (server *Server) IsAncestor(ancestor string, commit string) (bool, error) {
+	history, err := server.repo.Log(commit)
+	if err != nil {
+		return false, err
+	}
+
+	for _, c := range history {
+		if c.Checksum == ancestor {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+type promoteRequest struct {
+	Product string `json:"product"`
+	// defaults to the head of the channel
+	Commit string `json:"commit"`
+}
+
+type PromoteResult struct {
+	Product string `json:"product"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Ref     string `json:"ref"`
+	Commit  string `json:"commit"`
+	// previous head of the ref
+	Previous string `json:"previous,omitempty"`
+
+	// the checks the promotion passed through, like an import
+	Report *ImportReport `json:"report,omitempty"`
+}
+
+type channelInfo struct {
+	ChannelConfig
+	Commit string `json:"commit,omitempty"`
+}
+
+func (server *Server) ListChannels(w http.ResponseWriter, r *http.Request) {
+	res := make(map[string][]channelInfo)
+
+	names := make([]string, 0, len(server.cfg.Products))
+	for name := range server.cfg.Products {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		channels := []channelInfo{}
+		for _, ch := range server.cfg.Products[name].Channels {
+			head, _ := server.repo.RevParse(ch.Ref)
+			channels = append(channels, channelInfo{ch, head})
+		}
+		res[name] = channels
+	}
+
+	WriteJSON(w, http.StatusOK, res)
+}
+
+// promotionContext returns the context to check the promotion of
+// commit from the channel from to the channel to, whose head is head,
+// on behalf of origin; the image is the one the commit was imported
+// from, if it is known
+func (server *Server) promotionContext(from *ChannelConfig, to *ChannelConfig, commit string, head string, origin audit.Event) importContext {
+	ic := importContext{
+		ci: CommitInfo{
+			target:   to.Ref,
+			identity: origin.Identity,
+			source:   origin.Source,
+		},
+		rc:        server.cfg.ConfigForRef(to.Ref),
+		repo:      server.repo,
+		commit:    commit,
+		head:      head,
+		promotion: true,
+	}
+
+	if rec, err := server.imports.ByCommit(commit); err == nil {
+		ic.ci.manifest = rec.Manifest
+		ic.ci.repository = rec.Repository
+		ic.ci.tag = rec.Tag
+		ic.ci.arch = rec.Arch
+	}
+
+	// the commit was accepted for the source ref
+	if ic.ci.arch == "" {
+		ic.ci.arch = archFromRef(from.Ref)
+	}
+
+	if key := server.cfg.ConfigForRef(from.Ref).Arch.MetadataKey; ic.ci.arch == "" && key != "" {
+		ic.ci.arch, _ = server.repo.MetadataString(commit, key)
+	}
+
+	return ic
+}
+
+// PromoteChannel moves a commit of a channel to the next channel of
+// the product, without importing it again
+func (server *Server) PromoteChannel(w http.ResponseWriter, r *http.Request) {
+	channel := chi.URLParam(r, "channel")
+
+	var req promoteRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	product, pc, err := server.cfg.Product(req.Product)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	from, to, err := pc.NextChannel(channel)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !server.Allowed(w, r, auth.ActionPromote, auth.KindRef, to.Ref) {
+		return
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	head, err := server.repo.RevParse(from.Ref)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("channel '%s' has no commit", from.Name), http.StatusConflict)
+		return
+	}
+
+	commit := req.Commit
+	if commit == "" {
+		commit = head
+	}
+
+	if !server.repo.HasCommit(commit) {
+		http.Error(w, fmt.Sprintf("commit '%s' does not exist", commit), http.StatusNotFound)
+		return
+	}
+
+	ok, err := server.IsAncestor(commit, head)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else if !ok {
+		msg := fmt.Sprintf("commit %s is not part of channel '%s'", commit, from.Name)
+		http.Error(w, msg, http.StatusConflict)
+		return
+	}
+
+	res := PromoteResult{
+		Product: product,
+		From:    from.Name,
+		To:      to.Name,
+		Ref:     to.Ref,
+		Commit:  commit,
+	}
+
+	previous, err := server.repo.RevParse(to.Ref)
+	if err == nil {
+		res.Previous = previous
+
+		ok, err := server.IsAncestor(previous, commit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			msg := fmt.Sprintf("promoting %s to '%s' is not a fast-forward", commit, to.Name)
+			http.Error(w, msg, http.StatusConflict)
+			return
+		}
+	}
+
+	if previous == commit {
+		WriteJSON(w, http.StatusOK, res)
+		return
+	}
+
+	event := requestOrigin(r)
+	event.Action = "promote"
+	event.Ref = to.Ref
+	event.Commit = commit
+	event.Previous = previous
+	event.Message = fmt.Sprintf("%s: %s to %s", product, from.Name, to.Name)
+
+	// promotions pass through the same checks, hooks and approvals
+	// as imports to the target ref
+	ic := server.promotionContext(from, to, commit, previous, event)
+
+	res.Report = &ImportReport{
+		Ref:    to.Ref,
+		Commit: commit,
+	}
+
+	// the commit is not imported again, so the signatures the target
+	// ref requires are checked here, not only those of the source ref
+	server.runChecks(checkPre, &ic, res.Report)
+	server.runChecks(checkSource, &ic, res.Report)
+
+	if !server.gateCommit(&ic, res.Report) {
+		event.Outcome = audit.OutcomeDenied
+		event.Message += ": rejected: " + strings.Join(res.Report.Failures(), "; ")
+		server.Audit(event)
+		WriteJSON(w, http.StatusForbidden, res)
+		return
+	}
+
+	err = server.checkHead(&ic)
+	if err == nil && !server.repo.HasCommit(commit) {
+		err = fmt.Errorf("commit '%s' was deleted concurrently", commit)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if reason, ok := ic.approvalReason(); ok {
+		approval, err := server.StageCommit(server.repo.Path(), to.Ref, commit, ic.head, ic.ci.manifest, reason, requestOrigin(r))
+		if err != nil {
+			event.Outcome = audit.OutcomeFailure
+			event.Message += ": " + err.Error()
+			server.Audit(event)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Printf("Staged promotion of %s to %s, approval %s\n", commit, to.Ref, approval.ID)
+		res.Report.Approval = approval.ID
+
+		event.Message += ": staged for approval " + approval.ID
+		server.Audit(event)
+		WriteJSON(w, http.StatusAccepted, res)
+		return
+	}
+
+	fmt.Printf("Promoting %s from %s to %s\n", commit, from.Ref, to.Ref)
+
+	err = server.PublishCommit(to.Ref, commit, requestOrigin(r))
+	if err != nil {
+		event.Outcome = audit.OutcomeFailure
+		event.Message += ": " + err.Error()
+		server.Audit(event)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	server.Audit(event)
+
+	WriteJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/ostree"
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestChannels(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "channels.toml")
+
+	data := `
+[products.iot]
+channels = [
+  { name = "dev", ref = "acme/iot/x86_64/dev" },
+  { name = "beta", ref = "acme/iot/x86_64/beta" },
+  { name = "stable", ref = "acme/iot/x86_64/stable" },
+]
+`
+	err = ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	err = cfg.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	name, pc, err := cfg.Product("")
+	if err != nil || name != "iot" {
+		t.Fatalf("The only product should be the default: %v", err)
+	}
+
+	_, _, err = cfg.Product("other")
+	if err == nil {
+		t.Fatalf("Unknown products should not exist")
+	}
+
+	from, to, err := pc.NextChannel("beta")
+	if err != nil {
+		t.Fatalf("Failed to find channel: %v", err)
+	}
+
+	if from.Ref != "acme/iot/x86_64/beta" || to.Name != "stable" {
+		t.Fatalf("Unexpected channels: %v -> %v", from, to)
+	}
+
+	_, _, err = pc.NextChannel("stable")
+	if err == nil {
+		t.Fatalf("The last channel cannot be promoted")
+	}
+
+	_, _, err = pc.NextChannel("nightly")
+	if err == nil {
+		t.Fatalf("Unknown channels should not exist")
+	}
+}
+
+func TestPromotionArch(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	cfg := OttoConfig{
+		Refs: map[string]RefConfig{
+			"acme/iot/*/stable": {Arch: ArchConfig{Match: true}},
+		},
+	}
+
+	server := &Server{
+		cfg:     &cfg,
+		root:    tmp,
+		repo:    ostree.NewRepo(filepath.Join(tmp, "repo")),
+		imports: NewImportStore(filepath.Join(tmp, "imports")),
+	}
+
+	err = server.imports.Init()
+	if err != nil {
+		t.Fatalf("Failed to init import store: %v", err)
+	}
+
+	x86 := strings.Repeat("a", 64)
+	arm := strings.Repeat("b", 64)
+
+	err = server.imports.Put(&ImportRecord{Manifest: digest.FromString("arm"), Commit: arm, Ref: "acme/iot/x86_64/beta", Arch: "arm64"})
+	if err != nil {
+		t.Fatalf("Failed to record import: %v", err)
+	}
+
+	tests := []struct {
+		from   string
+		to     string
+		commit string
+		passed bool
+	}{
+		// without a record, the architecture is that of the source ref
+		{"acme/iot/x86_64/beta", "acme/iot/x86_64/stable", x86, true},
+		{"acme/iot/x86_64/beta", "acme/iot/aarch64/stable", x86, false},
+		// the record knows better
+		{"acme/iot/x86_64/beta", "acme/iot/x86_64/stable", arm, false},
+		{"acme/iot/x86_64/beta", "acme/iot/aarch64/stable", arm, true},
+		// nothing to compare with
+		{"acme/iot/beta", "acme/iot/x86_64/stable", x86, true},
+	}
+
+	for _, tt := range tests {
+		from := &ChannelConfig{Name: "beta", Ref: tt.from}
+		to := &ChannelConfig{Name: "stable", Ref: tt.to}
+
+		ic := server.promotionContext(from, to, tt.commit, "", audit.Event{Identity: "alice"})
+		report := &ImportReport{Ref: tt.to, Commit: tt.commit}
+
+		if passed := server.runChecks(checkCommit, &ic, report); passed != tt.passed {
+			t.Errorf("%s (%.8s) -> %s: expected passed=%v, got: %+v", tt.from, tt.commit, tt.to, tt.passed, report.Checks)
+		}
+	}
+}
+
+func TestPromotionSignatures(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	// the source channel has no requirements, the target channel has
+	strict := RefConfig{
+		Verify:          VerifyConfig{Ed25519Keys: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}},
+		ImageSignatures: ImageSignaturesConfig{PublicKeys: []string{filepath.Join(tmp, "cosign.pub")}},
+	}
+
+	cfg := OttoConfig{
+		Refs: map[string]RefConfig{"acme/iot/*/stable": strict},
+	}
+
+	server := &Server{
+		cfg:     &cfg,
+		root:    tmp,
+		repo:    ostree.NewRepo(filepath.Join(tmp, "repo")),
+		imports: NewImportStore(filepath.Join(tmp, "imports")),
+	}
+
+	from := &ChannelConfig{Name: "beta", Ref: "acme/iot/x86_64/beta"}
+	to := &ChannelConfig{Name: "stable", Ref: "acme/iot/x86_64/stable"}
+
+	ic := server.promotionContext(from, to, strings.Repeat("a", 64), "", audit.Event{Identity: "alice"})
+	report := &ImportReport{Ref: to.Ref, Commit: ic.commit}
+
+	server.runChecks(checkPre, &ic, report)
+	server.runChecks(checkSource, &ic, report)
+
+	failed := make(map[string]bool)
+	for _, c := range report.Checks {
+		failed[c.Name] = !c.Passed
+	}
+
+	if !failed["image-signature"] || !failed["signature"] || len(failed) != 2 {
+		t.Fatalf("Promotions must meet the signature requirements of the target: %+v", report.Checks)
+	}
+}
@@ -3,10 +3,162 @@ package main
 import (
 	"io"
 	"os"
+	"path"
+	"reflect"
+	"sort"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
 
+// Duration is a time.Duration that is (un-)marshalled from and to
+// strings like "24h"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+type DeltaConfig struct {
+	// number of previous commits of the ref to generate deltas from
+	Depth       int  `toml:"depth"`
+	FromScratch bool `toml:"from-scratch"`
+}
+
+type RetentionConfig struct {
+	KeepLast    int      `toml:"keep-last"`
+	KeepYounger Duration `toml:"keep-younger"`
+	Pinned      []string `toml:"pinned"`
+}
+
+func (rc RetentionConfig) Enabled() bool {
+	return rc.KeepLast > 0 || rc.KeepYounger.Duration > 0
+}
+
+type ApprovalConfig struct {
+	// number of approvals before a commit is published, disabled if 0
+	Required int `toml:"required"`
+	// identities that may approve, as patterns; empty means anyone
+	Approvers []string `toml:"approvers"`
+}
+
+type VersionConfig struct {
+	// only accept commits with a newer ostree.version than the head
+	Monotonic bool `toml:"monotonic"`
+	// "rpm" (the default) or "semver"
+	Scheme string `toml:"scheme"`
+}
+
+type ArchConfig struct {
+	// only accept commits for the architecture of the image
+	Match bool `toml:"match"`
+	// metadata key of the architecture, for refs without one
+	MetadataKey string `toml:"metadata-key"`
+}
+
+type LimitsConfig struct {
+	// total size of all files of a commit, in bytes
+	MaxSize int64 `toml:"max-size"`
+	// size of the files that are new compared to the head, in bytes
+	MaxGrowth int64 `toml:"max-growth"`
+	MaxFiles  int   `toml:"max-files"`
+
+	// "reject" (the default) or "approve", i.e. require an approval
+	Action string `toml:"action"`
+}
+
+func (lc LimitsConfig) Enabled() bool {
+	return lc.MaxSize > 0 || lc.MaxGrowth > 0 || lc.MaxFiles > 0
+}
+
+// VerifyConfig is the trust store for signatures of commits in images
+type VerifyConfig struct {
+	GPGKeyrings []string `toml:"gpg-keyrings"`
+	// base64 encoded public keys
+	Ed25519Keys []string `toml:"ed25519-keys"`
+	// file with public keys, one per line
+	Ed25519KeysFile string `toml:"ed25519-keys-file"`
+}
+
+func (vc VerifyConfig) Enabled() bool {
+	return len(vc.GPGKeyrings) > 0 || len(vc.Ed25519Keys) > 0 || vc.Ed25519KeysFile != ""
+}
+
+type ImageSignaturesConfig struct {
+	// files with PEM encoded public keys
+	PublicKeys []string `toml:"public-keys"`
+}
+
+func (sc ImageSignaturesConfig) Enabled() bool {
+	return len(sc.PublicKeys) > 0
+}
+
+type RefConfig struct {
+	Deltas    DeltaConfig     `toml:"deltas"`
+	Retention RetentionConfig `toml:"retention"`
+
+	// only accept commits that are descendants of the current head
+	FastForwardOnly bool `toml:"fast-forward-only"`
+
+	Approval ApprovalConfig `toml:"approval"`
+
+	Versions VersionConfig `toml:"versions"`
+	Arch     ArchConfig    `toml:"arch"`
+
+	Limits LimitsConfig `toml:"limits"`
+
+	// only accept commits signed by a trusted key
+	Verify VerifyConfig `toml:"verify"`
+
+	// only accept images signed by a trusted key, e.g. via cosign
+	ImageSignatures ImageSignaturesConfig `toml:"image-signatures"`
+
+	// checks of the content of new commits
+	Content ContentConfig `toml:"content"`
+}
+
+type SigningConfig struct {
+	GPG struct {
+		Homedir string `toml:"homedir"`
+		KeyID   string `toml:"key-id"`
+	} `toml:"gpg"`
+
+	Ed25519 struct {
+		SecretKeyFile string `toml:"secret-key-file"`
+		// additional valid public keys, e.g. for key rotation
+		PublicKeys []string `toml:"public-keys"`
+	} `toml:"ed25519"`
+}
+
+type ProvenanceConfig struct {
+	// manifest annotations to record, as patterns (see path.Match)
+	Annotations []string `toml:"annotations"`
+
+	// also store the provenance in the detached commit metadata
+	DetachedMetadata bool `toml:"detached-metadata"`
+}
+
+// Select returns the annotations that should be recorded
+func (pc ProvenanceConfig) Select(annotations map[string]string) map[string]string {
+	res := make(map[string]string)
+
+	for k, v := range annotations {
+		if matchAny(pc.Annotations, k) {
+			res[k] = v
+		}
+	}
+
+	return res
+}
+
 type OttoConfig struct {
 	Root string `toml:"root"`
 
@@ -14,7 +166,46 @@ type OttoConfig struct {
 	TLS  struct {
 		Cert string `toml:"cert"`
 		Key  string `toml:"key"`
+
+		// CA that client certificates must be signed by
+		ClientCA string `toml:"client-ca"`
+		// "none", "request" or "require" client certificates
+		ClientAuth struct {
+			Registry string `toml:"registry"`
+			Repo     string `toml:"repo"`
+
+			// CAs per group of routes, instead of the client CA
+			RegistryCA string `toml:"registry-ca"`
+			RepoCA     string `toml:"repo-ca"`
+		} `toml:"client-auth"`
 	} `toml:"tls"`
+
+	Signing SigningConfig `toml:"signing"`
+
+	Auth AuthConfig `toml:"auth"`
+
+	Prune struct {
+		// run pruning periodically, disabled if zero
+		Interval Duration `toml:"interval"`
+	} `toml:"prune"`
+
+	Provenance ProvenanceConfig `toml:"provenance"`
+
+	// which registry repositories may write which refs
+	Policy []RefPolicy `toml:"policy"`
+
+	// per-ref settings, keys are ref names or patterns (see path.Match)
+	Refs map[string]RefConfig `toml:"refs"`
+
+	// update channels of products
+	Products map[string]ProductConfig `toml:"products"`
+
+	// programs run at the stages of an import
+	Hooks []HookConfig `toml:"hooks"`
+
+	Audit AuditConfig `toml:"audit"`
+
+	Transparency TransparencyConfig `toml:"transparency"`
 }
 
 func (cfg *OttoConfig) LoadConfig(path string) error {
@@ -43,9 +234,106 @@ func (cfg *OttoConfig) LoadConfig(path string) error {
 		cfg.TLS.Key = new_cfg.TLS.Key
 	}
 
+	if new_cfg.TLS.ClientCA != "" {
+		cfg.TLS.ClientCA = new_cfg.TLS.ClientCA
+	}
+
+	if new_cfg.TLS.ClientAuth.Registry != "" {
+		cfg.TLS.ClientAuth.Registry = new_cfg.TLS.ClientAuth.Registry
+	}
+
+	if new_cfg.TLS.ClientAuth.Repo != "" {
+		cfg.TLS.ClientAuth.Repo = new_cfg.TLS.ClientAuth.Repo
+	}
+
+	if new_cfg.TLS.ClientAuth.RegistryCA != "" {
+		cfg.TLS.ClientAuth.RegistryCA = new_cfg.TLS.ClientAuth.RegistryCA
+	}
+
+	if new_cfg.TLS.ClientAuth.RepoCA != "" {
+		cfg.TLS.ClientAuth.RepoCA = new_cfg.TLS.ClientAuth.RepoCA
+	}
+
+	if new_cfg.Signing.GPG.KeyID != "" {
+		cfg.Signing.GPG = new_cfg.Signing.GPG
+	}
+
+	if new_cfg.Signing.Ed25519.SecretKeyFile != "" {
+		cfg.Signing.Ed25519 = new_cfg.Signing.Ed25519
+	}
+
+	// the section is taken as a whole, if it sets anything at all
+	if !reflect.DeepEqual(new_cfg.Auth, AuthConfig{}) {
+		cfg.Auth = new_cfg.Auth
+	}
+
+	if new_cfg.Prune.Interval.Duration != 0 {
+		cfg.Prune.Interval = new_cfg.Prune.Interval
+	}
+
+	if new_cfg.Provenance.Annotations != nil {
+		cfg.Provenance.Annotations = new_cfg.Provenance.Annotations
+	}
+
+	if new_cfg.Provenance.DetachedMetadata {
+		cfg.Provenance.DetachedMetadata = true
+	}
+
+	if new_cfg.Policy != nil {
+		cfg.Policy = new_cfg.Policy
+	}
+
+	if new_cfg.Refs != nil {
+		cfg.Refs = new_cfg.Refs
+	}
+
+	if new_cfg.Products != nil {
+		cfg.Products = new_cfg.Products
+	}
+
+	if new_cfg.Hooks != nil {
+		cfg.Hooks = new_cfg.Hooks
+	}
+
+	if new_cfg.Audit.File != "" || new_cfg.Audit.Chain {
+		cfg.Audit = new_cfg.Audit
+	}
+
+	if new_cfg.Transparency.KeyFile != "" {
+		cfg.Transparency = new_cfg.Transparency
+	}
+
 	return nil
 }
 
 func (c *OttoConfig) DumpConfig(w io.Writer) error {
 	return toml.NewEncoder(w).Encode(c)
 }
+
+// ConfigForRef returns the settings for ref. An exact match wins,
+// otherwise the longest matching pattern is used.
+func (c *OttoConfig) ConfigForRef(ref string) RefConfig {
+	if rc, ok := c.Refs[ref]; ok {
+		return rc
+	}
+
+	patterns := make([]string, 0, len(c.Refs))
+	for p := range c.Refs {
+		patterns = append(patterns, p)
+	}
+
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) > len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ref); ok {
+			return c.Refs[p]
+		}
+	}
+
+	return RefConfig{}
+}
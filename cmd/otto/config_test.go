@@ -61,3 +61,159 @@ func TestPartial(t *testing.T) {
 		log.Fatalf("Addr should have not be touched, is: %s", new_cfg.Addr)
 	}
 }
+
+func TestAuthConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	tests := map[string]func(AuthConfig) bool{
+		"[auth]\nrealm = \"acme\"": func(ac AuthConfig) bool {
+			return ac.Realm == "acme"
+		},
+		"[auth]\nprotect-repo = true": func(ac AuthConfig) bool {
+			return ac.ProtectRepo
+		},
+		"[[auth.devices.groups]]\nname = \"acme\"\nrefs = [\"acme/*\"]": func(ac AuthConfig) bool {
+			return len(ac.Devices.Groups) == 1
+		},
+	}
+
+	for section, check := range tests {
+		path := filepath.Join(tmp, "auth.toml")
+
+		err = ioutil.WriteFile(path, []byte(section+"\n"), 0600)
+		if err != nil {
+			t.Fatalf("Failed to write config: %v", err)
+		}
+
+		cfg := OttoConfig{}
+		err = cfg.LoadConfig(path)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+
+		if !check(cfg.Auth) {
+			t.Errorf("%s: auth section was not taken: %+v", section, cfg.Auth)
+		}
+	}
+
+	// an empty section does not replace the current one
+	path := filepath.Join(tmp, "empty.toml")
+	err = ioutil.WriteFile(path, []byte("[auth]\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg := OttoConfig{Auth: AuthConfig{Realm: "otto"}}
+	err = cfg.LoadConfig(path)
+	if err != nil || cfg.Auth.Realm != "otto" {
+		t.Fatalf("Empty auth section should be ignored: %+v (%v)", cfg.Auth, err)
+	}
+}
+
+func TestRefConfig(t *testing.T) {
+
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "refs.toml")
+
+	data := `
+[refs."fedora/*/iot".deltas]
+depth = 2
+
+[refs."fedora/x86_64/iot".deltas]
+depth = 3
+from-scratch = true
+
+[refs."fedora/x86_64/iot".retention]
+keep-last = 5
+keep-younger = "720h"
+`
+	err = ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write config: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	err = cfg.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	rc := cfg.ConfigForRef("fedora/x86_64/iot")
+	if rc.Deltas.Depth != 3 || !rc.Deltas.FromScratch {
+		t.Fatalf("Exact match should win, got: %+v", rc)
+	}
+
+	if rc.Retention.KeepLast != 5 || rc.Retention.KeepYounger.Hours() != 720 {
+		t.Fatalf("Retention not parsed correctly, got: %+v", rc.Retention)
+	}
+
+	rc = cfg.ConfigForRef("fedora/aarch64/iot")
+	if rc.Deltas.Depth != 2 || rc.Deltas.FromScratch {
+		t.Fatalf("Pattern should match, got: %+v", rc)
+	}
+
+	rc = cfg.ConfigForRef("fedora/aarch64/iot/devel")
+	if rc.Deltas.Depth != 0 {
+		t.Fatalf("Unmatched ref should have defaults, got: %+v", rc)
+	}
+}
+
+func TestRefPolicy(t *testing.T) {
+	cfg := OttoConfig{}
+
+	if !cfg.RefAllowed("test", "", "fedora/iot/x86_64/stable") {
+		t.Fatalf("Without policy, everything should be allowed")
+	}
+
+	cfg.Policy = []RefPolicy{
+		{
+			Repos: []string{"iot"},
+			Refs:  []string{"fedora/iot/*/stable"},
+		},
+		{
+			Identities: []string{"builder"},
+			Refs:       []string{"fedora/iot/*/devel"},
+		},
+	}
+
+	if !cfg.RefAllowed("iot", "", "fedora/iot/x86_64/stable") {
+		t.Fatalf("Repo 'iot' should be allowed to write stable refs")
+	}
+
+	if cfg.RefAllowed("test", "", "fedora/iot/x86_64/stable") {
+		t.Fatalf("Repo 'test' should not be allowed to write stable refs")
+	}
+
+	if cfg.RefAllowed("iot", "", "fedora/iot/x86_64/devel") {
+		t.Fatalf("Anonymous pushes to devel refs should be rejected")
+	}
+
+	if !cfg.RefAllowed("test", "builder", "fedora/iot/x86_64/devel") {
+		t.Fatalf("Identity 'builder' should be allowed to write devel refs")
+	}
+}
+
+func TestProvenanceSelect(t *testing.T) {
+	pc := ProvenanceConfig{
+		Annotations: []string{"org.opencontainers.image.*"},
+	}
+
+	annotations := map[string]string{
+		"org.opencontainers.image.version": "34",
+		"org.osbuild.ostree.ref":           "fedora/x86_64/iot",
+	}
+
+	selected := pc.Select(annotations)
+	if len(selected) != 1 || selected["org.opencontainers.image.version"] != "34" {
+		t.Fatalf("Unexpected selection: %v", selected)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/gicmo/otto/internal/ostree"
+)
+
+type ContentConfig struct {
+	// paths that must not exist, including everything below them,
+	// as patterns (see path.Match)
+	ForbiddenPaths []string `toml:"forbidden-paths"`
+
+	DenySetuid bool `toml:"deny-setuid"`
+	// setuid or setgid files that are fine nevertheless
+	AllowSetuid []string `toml:"allow-setuid"`
+
+	// sticky directories, like /var/tmp, are always allowed
+	DenyWorldWritable bool `toml:"deny-world-writable"`
+
+	// in bytes, disabled if zero
+	MaxTreeSize int64 `toml:"max-tree-size"`
+
+	RequiredFiles []string `toml:"required-files"`
+
+	// pattern the VERSION_ID of /usr/lib/os-release must match
+	OSReleaseVersionID string `toml:"os-release-version-id"`
+}
+
+// matchPath checks if p, or any of its parent directories, matches
+// one of the patterns
+func matchPath(patterns []string, p string) bool {
+	for d := p; ; d = path.Dir(d) {
+		if matchAny(patterns, d) {
+			return true
+		}
+
+		if d == "/" || d == "." {
+			return false
+		}
+	}
+}
+
+// offenders formats a list of offending paths for a report
+func offenders(what string, paths []string) error {
+	const limit = 10
+
+	if len(paths) == 0 {
+		return nil
+	}
+
+	msg := strings.Join(paths, ", ")
+	if len(paths) > limit {
+		msg = fmt.Sprintf("%s and %d more", strings.Join(paths[:limit], ", "), len(paths)-limit)
+	}
+
+	return fmt.Errorf("%s: %s", what, msg)
+}
+
+func (ic *importContext) Files() ([]ostree.FileInfo, error) {
+	if ic.files != nil {
+		return ic.files, nil
+	}
+
+	files, err := ic.repo.ListFiles(ic.commit)
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %w", err)
+	}
+
+	ic.files = files
+	return files, nil
+}
+
+func checkForbiddenPaths(server *Server, ic *importContext) error {
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	var found []string
+	for _, f := range files {
+		if matchPath(ic.rc.Content.ForbiddenPaths, f.Path) {
+			found = append(found, f.Path)
+		}
+	}
+
+	return offenders("forbidden paths present", found)
+}
+
+func checkSetuid(server *Server, ic *importContext) error {
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	var found []string
+	for _, f := range files {
+		if f.Type != '-' || f.Mode&06000 == 0 {
+			continue
+		}
+
+		if !matchAny(ic.rc.Content.AllowSetuid, f.Path) {
+			found = append(found, fmt.Sprintf("%s (%04o)", f.Path, f.Mode))
+		}
+	}
+
+	return offenders("unexpected setuid/setgid files", found)
+}
+
+func checkWorldWritable(server *Server, ic *importContext) error {
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	var found []string
+	for _, f := range files {
+		if f.Type == 'l' || f.Mode&0002 == 0 {
+			continue
+		}
+
+		if f.Type == 'd' && f.Mode&01000 != 0 {
+			continue
+		}
+
+		found = append(found, fmt.Sprintf("%s (%04o)", f.Path, f.Mode))
+	}
+
+	return offenders("world-writable files", found)
+}
+
+func treeSize(files []ostree.FileInfo) int64 {
+	var size int64
+	for _, f := range files {
+		if f.Type == '-' {
+			size += f.Size
+		}
+	}
+	return size
+}
+
+func checkTreeSize(server *Server, ic *importContext) error {
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	size := treeSize(files)
+	if size > ic.rc.Content.MaxTreeSize {
+		return fmt.Errorf("tree size of %d bytes exceeds the limit of %d", size, ic.rc.Content.MaxTreeSize)
+	}
+
+	return nil
+}
+
+func checkRequiredFiles(server *Server, ic *importContext) error {
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool, len(files))
+	for _, f := range files {
+		present[f.Path] = true
+	}
+
+	var missing []string
+	for _, p := range ic.rc.Content.RequiredFiles {
+		if !present[p] {
+			missing = append(missing, p)
+		}
+	}
+
+	return offenders("required files missing", missing)
+}
+
+func parseOSRelease(data []byte) map[string]string {
+	res := make(map[string]string)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i < 1 {
+			continue
+		}
+
+		res[line[:i]] = strings.Trim(line[i+1:], `"'`)
+	}
+
+	return res
+}
+
+// maximum number of symlinks resolvePath follows, like the kernel
+const maxSymlinks = 40
+
+// resolvePath follows the symlinks in all components of p, an
+// absolute path, within files and returns the resulting path
+func resolvePath(files []ostree.FileInfo, p string) (string, error) {
+	byPath := make(map[string]ostree.FileInfo, len(files))
+	for _, f := range files {
+		byPath[f.Path] = f
+	}
+
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	links := 0
+
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		next := path.Join(resolved, name)
+
+		f, ok := byPath[next]
+		if !ok {
+			return "", fmt.Errorf("%s does not exist", next)
+		}
+
+		if f.Type != 'l' {
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symlinks in %s", p)
+		}
+
+		// relative targets are resolved from the directory of the link
+		if path.IsAbs(f.Target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(f.Target, "/"), rest...)
+	}
+
+	return resolved, nil
+}
+
+func checkOSRelease(server *Server, ic *importContext) error {
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	// e.g. a symlink into /usr/lib/os-release.d
+	p, err := resolvePath(files, "/usr/lib/os-release")
+	if err != nil {
+		return fmt.Errorf("could not resolve /usr/lib/os-release: %w", err)
+	}
+
+	data, err := ic.repo.Cat(ic.commit, p)
+	if err != nil {
+		return fmt.Errorf("could not read %s", p)
+	}
+
+	want := ic.rc.Content.OSReleaseVersionID
+	have := parseOSRelease(data)["VERSION_ID"]
+
+	if ok, _ := path.Match(want, have); !ok {
+		return fmt.Errorf("VERSION_ID '%s' does not match '%s'", have, want)
+	}
+
+	return nil
+}
+
+// growth returns the size of the regular files that are not part of
+// the previous commit
+func growth(files []ostree.FileInfo, previous []ostree.FileInfo) int64 {
+	known := make(map[string]bool, len(previous))
+	for _, f := range previous {
+		if f.Type == '-' {
+			known[f.Checksum] = true
+		}
+	}
+
+	var size int64
+	for _, f := range files {
+		if f.Type == '-' && !known[f.Checksum] {
+			size += f.Size
+			// count each object only once
+			known[f.Checksum] = true
+		}
+	}
+
+	return size
+}
+
+func checkLimits(server *Server, ic *importContext) error {
+	lc := ic.rc.Limits
+
+	files, err := ic.Files()
+	if err != nil {
+		return err
+	}
+
+	var exceeded []string
+
+	if lc.MaxFiles > 0 && len(files) > lc.MaxFiles {
+		exceeded = append(exceeded, fmt.Sprintf("%d files exceed the limit of %d", len(files), lc.MaxFiles))
+	}
+
+	if size := treeSize(files); lc.MaxSize > 0 && size > lc.MaxSize {
+		exceeded = append(exceeded, fmt.Sprintf("size of %d bytes exceeds the limit of %d", size, lc.MaxSize))
+	}
+
+	if lc.MaxGrowth > 0 && ic.head != "" {
+		previous, err := server.repo.ListFiles(ic.head)
+		if err != nil {
+			return fmt.Errorf("could not list files of head: %w", err)
+		}
+
+		if size := growth(files, previous); size > lc.MaxGrowth {
+			exceeded = append(exceeded, fmt.Sprintf("%d new bytes exceed the limit of %d", size, lc.MaxGrowth))
+		}
+	}
+
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	msg := strings.Join(exceeded, ", ")
+
+	switch lc.Action {
+	case "", "reject":
+		return fmt.Errorf("%s", msg)
+	case "approve":
+		return &approvalRequired{msg}
+	}
+
+	return fmt.Errorf("%s (unknown action '%s')", msg, lc.Action)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gicmo/otto/internal/ostree"
+)
+
+func TestMatchPath(t *testing.T) {
+	patterns := []string{"/etc/shadow", "/root", "/usr/share/doc/*"}
+
+	tests := map[string]bool{
+		"/etc/shadow":         true,
+		"/etc/shadow-":        false,
+		"/root":               true,
+		"/root/.ssh/id_rsa":   true,
+		"/rootfs":             false,
+		"/usr/share/doc/x/y":  true,
+		"/usr/share/doc":      false,
+		"/usr/lib/os-release": false,
+	}
+
+	for p, want := range tests {
+		if have := matchPath(patterns, p); have != want {
+			t.Errorf("matchPath(%s): want %v, have %v", p, want, have)
+		}
+	}
+}
+
+func TestOffenders(t *testing.T) {
+	if err := offenders("x", nil); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var paths []string
+	for i := 0; i < 12; i++ {
+		paths = append(paths, "/p")
+	}
+
+	err := offenders("x", paths)
+	if err == nil || !strings.HasSuffix(err.Error(), "and 2 more") {
+		t.Fatalf("Expected capped list, got: %v", err)
+	}
+}
+
+func TestTreeSize(t *testing.T) {
+	files := []ostree.FileInfo{
+		{Type: 'd', Size: 0, Path: "/usr"},
+		{Type: '-', Size: 10, Path: "/usr/a"},
+		{Type: 'l', Size: 5, Path: "/usr/b", Target: "a"},
+		{Type: '-', Size: 32, Path: "/usr/c"},
+	}
+
+	if size := treeSize(files); size != 42 {
+		t.Fatalf("Expected 42, got %d", size)
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	data := `# comment
+NAME="Fedora Linux"
+VERSION_ID=36
+VARIANT_ID='iot'
+
+BROKEN
+`
+	info := parseOSRelease([]byte(data))
+
+	if info["NAME"] != "Fedora Linux" || info["VERSION_ID"] != "36" || info["VARIANT_ID"] != "iot" {
+		t.Fatalf("Unexpected result: %v", info)
+	}
+
+	if _, ok := info["BROKEN"]; ok {
+		t.Fatalf("Invalid line should be ignored")
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	files := []ostree.FileInfo{
+		{Type: 'd', Path: "/"},
+		{Type: 'd', Path: "/etc"},
+		{Type: 'l', Path: "/etc/os-release", Target: "../usr/lib/os-release"},
+		{Type: 'd', Path: "/usr"},
+		{Type: 'd', Path: "/usr/lib"},
+		{Type: 'l', Path: "/usr/lib/os-release", Target: "os-release.d/os-release-iot"},
+		{Type: 'd', Path: "/usr/lib/os-release.d"},
+		{Type: '-', Path: "/usr/lib/os-release.d/os-release-iot"},
+		{Type: 'l', Path: "/lib", Target: "/usr/lib"},
+		{Type: 'l', Path: "/loop", Target: "loop"},
+		{Type: 'l', Path: "/dangling", Target: "nowhere"},
+	}
+
+	tests := map[string]string{
+		"/usr/lib/os-release.d/os-release-iot": "/usr/lib/os-release.d/os-release-iot",
+		"/usr/lib/os-release":                  "/usr/lib/os-release.d/os-release-iot",
+		"/etc/os-release":                      "/usr/lib/os-release.d/os-release-iot",
+		"/lib/os-release":                      "/usr/lib/os-release.d/os-release-iot",
+		"/usr/lib":                             "/usr/lib",
+	}
+
+	for p, want := range tests {
+		have, err := resolvePath(files, p)
+		if err != nil || have != want {
+			t.Errorf("resolvePath(%s): want %s, have %s (%v)", p, want, have, err)
+		}
+	}
+
+	for _, p := range []string{"/loop", "/dangling", "/usr/lib/missing"} {
+		if _, err := resolvePath(files, p); err == nil {
+			t.Errorf("resolvePath(%s): expected error", p)
+		}
+	}
+}
+
+func TestGrowth(t *testing.T) {
+	previous := []ostree.FileInfo{
+		{Type: '-', Size: 10, Checksum: "aa", Path: "/a"},
+		{Type: '-', Size: 20, Checksum: "bb", Path: "/b"},
+	}
+
+	files := []ostree.FileInfo{
+		{Type: 'd', Checksum: "dd", Path: "/"},
+		{Type: '-', Size: 10, Checksum: "aa", Path: "/a"},
+		{Type: '-', Size: 10, Checksum: "aa", Path: "/copy-of-a"},
+		{Type: '-', Size: 30, Checksum: "cc", Path: "/c"},
+		{Type: '-', Size: 30, Checksum: "cc", Path: "/copy-of-c"},
+	}
+
+	if size := growth(files, previous); size != 30 {
+		t.Fatalf("Expected 30 new bytes, got %d", size)
+	}
+
+	if size := growth(files, nil); size != 40 {
+		t.Fatalf("Expected 40 new bytes, got %d", size)
+	}
+}
+
+func TestRunChecksApproval(t *testing.T) {
+	saved := importChecks
+	defer func() { importChecks = saved }()
+
+	importChecks = []importCheck{
+		{
+			name:    "big",
+			stage:   checkCommit,
+			enabled: func(*Server, *importContext) bool { return true },
+			run: func(*Server, *importContext) error {
+				return &approvalRequired{"too big"}
+			},
+		},
+	}
+
+	var ic importContext
+	var report ImportReport
+
+	server := &Server{}
+	if !server.runChecks(checkCommit, &ic, &report) {
+		t.Fatalf("Check requiring approval should not fail: %+v", report)
+	}
+
+	if len(ic.approvals) != 1 || ic.approvals[0] != "too big" {
+		t.Fatalf("Approval reason not recorded: %v", ic.approvals)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+type deltaJob struct {
+	ref    string
+	commit string
+	cfg    DeltaConfig
+}
+
+// deltaQueue holds at most one pending job per ref; a newer commit
+// of the ref replaces the pending one, whose deltas would be outdated
+// by the time they are generated anyway
+type deltaQueue struct {
+	mu   sync.Mutex
+	jobs map[string]deltaJob
+	// order in which the refs were queued
+	refs []string
+	// commits whose deltas are being generated, which must not be
+	// pruned meanwhile
+	held map[string]int
+
+	wake chan struct{}
+}
+
+func newDeltaQueue() *deltaQueue {
+	return &deltaQueue{
+		jobs: make(map[string]deltaJob),
+		held: make(map[string]int),
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Push queues the job without blocking
+func (q *deltaQueue) Push(job deltaJob) {
+	q.mu.Lock()
+	if _, ok := q.jobs[job.ref]; !ok {
+		q.refs = append(q.refs, job.ref)
+	}
+	q.jobs[job.ref] = job
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Take removes and returns all pending jobs, oldest ref first
+func (q *deltaQueue) Take() []deltaJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]deltaJob, 0, len(q.refs))
+	for _, ref := range q.refs {
+		jobs = append(jobs, q.jobs[ref])
+	}
+
+	q.jobs = make(map[string]deltaJob)
+	q.refs = nil
+
+	return jobs
+}
+
+// Hold marks the commits as in use by a delta generation
+func (q *deltaQueue) Hold(commits []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range commits {
+		q.held[c]++
+	}
+}
+
+// Release undoes Hold
+func (q *deltaQueue) Release(commits []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, c := range commits {
+		if q.held[c]--; q.held[c] <= 0 {
+			delete(q.held, c)
+		}
+	}
+}
+
+// Held checks if the commit is in use by a delta generation
+func (q *deltaQueue) Held(commit string) bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.held[commit] > 0
+}
+
+// ScheduleDeltas queues the generation of the deltas of commit; it
+// never blocks, since it is called with server.mu held
+func (server *Server) ScheduleDeltas(ref string, commit string) {
+	cfg := server.cfg.ConfigForRef(ref).Deltas
+
+	if cfg.Depth < 1 && !cfg.FromScratch {
+		return
+	}
+
+	server.deltas.Push(deltaJob{ref, commit, cfg})
+}
+
+func (server *Server) processDeltas() {
+	for range server.deltas.wake {
+		for _, job := range server.deltas.Take() {
+			server.runDeltaJob(job)
+		}
+	}
+}
+
+func (server *Server) runDeltaJob(job deltaJob) {
+	n, err := server.generateDeltas(job)
+	if err != nil {
+		fmt.Printf("Delta generation for %s (%s) failed: %v\n", job.ref, job.commit, err)
+	}
+
+	if n == 0 {
+		return
+	}
+
+	// clients discover static deltas via the summary
+	err = server.UpdateSummary()
+	if err != nil {
+		fmt.Printf("Failed to update summary: %v\n", err)
+	}
+}
+
+// planDeltas returns the commits to generate deltas from to the
+// commit of the job, "" for a delta from scratch; the caller must
+// hold server.mu
+func (server *Server) planDeltas(job deltaJob) []string {
+	var from []string
+
+	// it might have been pruned since it was queued
+	if !server.repo.HasCommit(job.commit) {
+		return nil
+	}
+
+	if job.cfg.FromScratch {
+		from = append(from, "")
+	}
+
+	// walk the history as far as it is present in the repo
+	commit := job.commit
+	for i := 0; i < job.cfg.Depth; i++ {
+		parent, err := server.repo.GetParentCommit(commit)
+		if err != nil || !server.repo.HasCommit(parent) {
+			break
+		}
+
+		from = append(from, parent)
+		commit = parent
+	}
+
+	return from
+}
+
+func (server *Server) generateDeltas(job deltaJob) (int, error) {
+	// the commits are resolved under the lock and held, so that they
+	// are not pruned while the deltas are generated without it
+	server.mu.Lock()
+	from := server.planDeltas(job)
+	held := append([]string{job.commit}, from...)
+	server.deltas.Hold(held)
+	server.mu.Unlock()
+
+	defer server.deltas.Release(held)
+
+	n := 0
+	for _, parent := range from {
+		if parent == "" {
+			fmt.Printf("Generating delta for %s from scratch\n", job.commit)
+		} else {
+			fmt.Printf("Generating delta %s-%s\n", parent, job.commit)
+		}
+
+		err := server.repo.GenerateDelta(parent, job.commit)
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+
+	return n, nil
+}
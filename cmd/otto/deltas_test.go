@@ -0,0 +1,64 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeltaQueue(t *testing.T) {
+	q := newDeltaQueue()
+
+	// pushing never blocks, no matter how many jobs are queued
+	for i := 0; i < 100; i++ {
+		q.Push(deltaJob{ref: "a", commit: "1"})
+	}
+
+	q.Push(deltaJob{ref: "b", commit: "1"})
+	q.Push(deltaJob{ref: "a", commit: "2"})
+
+	if len(q.wake) != 1 {
+		t.Fatalf("Expected a single wake-up, got %d", len(q.wake))
+	}
+
+	var commits []string
+	for _, job := range q.Take() {
+		commits = append(commits, job.ref+"@"+job.commit)
+	}
+
+	// the newer commit of a replaces the pending one
+	if want := []string{"a@2", "b@1"}; !reflect.DeepEqual(commits, want) {
+		t.Fatalf("Expected %v, got %v", want, commits)
+	}
+
+	if jobs := q.Take(); len(jobs) != 0 {
+		t.Fatalf("Queue should be empty: %v", jobs)
+	}
+}
+
+func TestDeltaQueueHold(t *testing.T) {
+	q := newDeltaQueue()
+
+	q.Hold([]string{"1", "2"})
+	q.Hold([]string{"2"})
+
+	if !q.Held("1") || !q.Held("2") || q.Held("3") {
+		t.Fatalf("Unexpected held commits: %v", q.held)
+	}
+
+	q.Release([]string{"1", "2"})
+
+	if q.Held("1") || !q.Held("2") {
+		t.Fatalf("Commits should stay held until released by all: %v", q.held)
+	}
+
+	q.Release([]string{"2"})
+
+	if q.Held("2") || len(q.held) != 0 {
+		t.Fatalf("Nothing should be held: %v", q.held)
+	}
+
+	var none *deltaQueue
+	if none.Held("1") {
+		t.Fatalf("Nothing is held without a queue")
+	}
+}
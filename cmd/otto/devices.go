@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/gicmo/otto/internal/ostree"
+	"github.com/go-chi/chi/v5"
+)
+
+// Device groups limit which refs devices can see: every group has a
+// view repo, whose parent is the repo, that only contains the refs of
+// the group and thus has a summary listing only those. Objects and
+// static deltas are shared and served from the repo.
+
+const deviceGroupAccess = "device-group"
+
+var groupNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+type DeviceGroupConfig struct {
+	Name string `toml:"name"`
+	// patterns of the refs the devices of the group can see
+	Refs []string `toml:"refs"`
+}
+
+type DevicesConfig struct {
+	// file with the secret key device tokens are signed with; device
+	// tokens are disabled if not set
+	KeyFile string   `toml:"key-file"`
+	Expiry  Duration `toml:"expiry"`
+
+	Groups []DeviceGroupConfig `toml:"groups"`
+}
+
+// Group returns the configuration of the device group name
+func (dc *DevicesConfig) Group(name string) (*DeviceGroupConfig, bool) {
+	for i := range dc.Groups {
+		if dc.Groups[i].Name == name {
+			return &dc.Groups[i], true
+		}
+	}
+
+	return nil, false
+}
+
+func (dc *DevicesConfig) Validate() error {
+	seen := make(map[string]bool)
+
+	for _, g := range dc.Groups {
+		if !groupNameRegexp.MatchString(g.Name) {
+			return fmt.Errorf("invalid device group name: '%s'", g.Name)
+		}
+
+		if seen[g.Name] {
+			return fmt.Errorf("duplicate device group: '%s'", g.Name)
+		}
+		seen[g.Name] = true
+
+		if len(g.Refs) == 0 {
+			return fmt.Errorf("device group '%s' has no refs", g.Name)
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) initDevices() error {
+	dc := &server.cfg.Auth.Devices
+
+	err := dc.Validate()
+	if err != nil {
+		return err
+	}
+
+	if dc.KeyFile == "" {
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(dc.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	expiry := dc.Expiry.Duration
+	if expiry == 0 {
+		expiry = 365 * 24 * time.Hour
+	}
+
+	// a different service, so registry tokens are not device tokens
+	server.deviceTokens, err = auth.NewTokenIssuer(key, "otto", "otto-devices", expiry)
+	return err
+}
+
+func (server *Server) viewPath(group string) string {
+	return filepath.Join(server.root, "views", group)
+}
+
+// updateViews syncs the refs of the view repos with the repo and
+// updates their summaries; the caller must hold the lock
+func (server *Server) updateViews() error {
+	groups := server.cfg.Auth.Devices.Groups
+	if len(groups) == 0 {
+		return nil
+	}
+
+	refs, err := server.repo.ListRefs()
+	if err != nil {
+		return fmt.Errorf("could not list refs: %w", err)
+	}
+
+	for _, g := range groups {
+		err = server.updateView(g, refs)
+		if err != nil {
+			return fmt.Errorf("could not update view of '%s': %w", g.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (server *Server) updateView(g DeviceGroupConfig, refs []string) error {
+	path := server.viewPath(g.Name)
+	view := ostree.NewRepo(path)
+
+	for _, signer := range server.repo.Signers() {
+		view.AddSigner(signer)
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "config")); os.IsNotExist(err) {
+		err = view.Init(ostree.ARCHIVE)
+		if err != nil {
+			return err
+		}
+
+		err = view.SetConfig("core.parent", server.repo.Path())
+		if err != nil {
+			return err
+		}
+	}
+
+	err := server.mirrorDeltas(path)
+	if err != nil {
+		return fmt.Errorf("could not mirror static deltas: %w", err)
+	}
+
+	have, err := view.ListRefs()
+	if err != nil {
+		return err
+	}
+
+	want := make(map[string]bool)
+
+	for _, ref := range refs {
+		if !matchAny(g.Refs, ref) {
+			continue
+		}
+		want[ref] = true
+
+		commit, err := server.repo.RevParse(ref)
+		if err != nil {
+			return err
+		}
+
+		err = view.SetRef(ref, commit)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ref := range have {
+		if want[ref] {
+			continue
+		}
+
+		err = view.DeleteRef(ref)
+		if err != nil {
+			return err
+		}
+	}
+
+	return view.UpdateSummary()
+}
+
+// mirrorDeltas links the static deltas of the repo into the view at
+// path, so that its summary lists them like that of the repo
+func (server *Server) mirrorDeltas(path string) error {
+	deltas := filepath.Join(server.repo.Path(), "deltas")
+	err := os.MkdirAll(deltas, 0755)
+	if err != nil {
+		return err
+	}
+
+	link := filepath.Join(path, "deltas")
+
+	fi, err := os.Lstat(link)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return nil
+	} else if err == nil {
+		// the empty directory of a new view
+		err = os.Remove(link)
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return os.Symlink(deltas, link)
+}
+
+// updateSummaries updates the summary of the repo and those of the
+// views; the caller must hold the lock
+func (server *Server) updateSummaries() error {
+	err := server.repo.UpdateSummary()
+	if err != nil {
+		return err
+	}
+
+	return server.updateViews()
+}
+
+type deviceGroupKey struct{}
+
+// DeviceGroupFromRequest returns the device group of the request,
+// which is empty unless a device authenticated with a token
+func DeviceGroupFromRequest(r *http.Request) string {
+	group, _ := r.Context().Value(deviceGroupKey{}).(string)
+	return group
+}
+
+// deviceGroup returns the device group the claims grant access to
+func deviceGroup(claims *auth.Claims) string {
+	for _, a := range claims.Access {
+		if a.Type == deviceGroupAccess && claims.Allows(deviceGroupAccess, a.Name, "pull") {
+			return a.Name
+		}
+	}
+
+	return ""
+}
+
+// isDeviceToken checks if the request carries a token and device
+// tokens are enabled
+func (server *Server) isDeviceToken(r *http.Request) bool {
+	return server.deviceTokens != nil && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// AuthenticateDevice authenticates a device with its token and sets
+// the identity and the device group of the request
+func (server *Server) AuthenticateDevice(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		claims, err := server.deviceTokens.Verify(token, time.Now())
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", server.realm()))
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		group := deviceGroup(claims)
+		if _, ok := server.cfg.Auth.Devices.Group(group); !ok {
+			http.Error(w, fmt.Sprintf("unknown device group '%s'", group), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), deviceGroupKey{}, group)
+		next.ServeHTTP(w, WithIdentity(r.WithContext(ctx), claims.Subject))
+	})
+}
+
+// DeviceView serves the summary of the view of the device group and
+// denies access to refs outside of it; everything else, i.e. objects,
+// deltas and the config, is served from the repo
+func (server *Server) DeviceView(public string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := DeviceGroupFromRequest(r)
+			group, ok := server.cfg.Auth.Devices.Group(name)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			// listing refs/heads would reveal the refs of all groups
+			p := repoFilePath(r, public)
+
+			switch {
+			case isSummary(p):
+				http.ServeFile(w, r, filepath.Join(server.viewPath(name), p))
+				return
+
+			case isRefPath(p):
+				ref := strings.TrimPrefix(p, "refs/heads/")
+				if ref == p || !matchAny(group.Refs, ref) {
+					http.Error(w, "ref not visible to the device group", http.StatusForbidden)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// repoFilePath returns the path of the request as the file server of
+// the repo at public sees it
+func repoFilePath(r *http.Request, public string) string {
+	p := strings.TrimPrefix(path.Clean(r.URL.Path), strings.TrimSuffix(public, "/"))
+	return strings.TrimPrefix(p, "/")
+}
+
+func isSummary(p string) bool {
+	return p == "summary" || p == "summary.sig"
+}
+
+func isRefPath(p string) bool {
+	return p == "refs" || strings.HasPrefix(p, "refs/")
+}
+
+// HideRefs denies clients that are not authenticated the summary and
+// the refs of the repo if there are device groups, as these would
+// reveal the refs of all groups
+func (server *Server) HideRefs(public string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(server.cfg.Auth.Devices.Groups) == 0 || IdentityFromRequest(r) != "" || ClientSubject(r) != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			p := repoFilePath(r, public)
+			if isSummary(p) || isRefPath(p) {
+				http.Error(w, "refs are only visible to authenticated clients and devices", http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RepoAccess authenticates requests to the repo: devices with their
+// token, pre-signed requests with their signature, everyone else with
+// RepoAuthenticate
+func (server *Server) RepoAccess(next http.Handler) http.Handler {
+	devices := server.AuthenticateDevice(server.DeviceView(ostreeRepoPrefix)(next))
+	others := server.RepoAuthenticate(server.HideRefs(ostreeRepoPrefix)(next))
+
+	var signed http.Handler
+	if server.urlSigner != nil {
+		signed = server.VerifySignature(next)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.isDeviceToken(r) {
+			devices.ServeHTTP(w, r)
+			return
+		}
+
+		if signed != nil && auth.IsSigned(r.URL.Query()) {
+			signed.ServeHTTP(w, r)
+			return
+		}
+
+		others.ServeHTTP(w, r)
+	})
+}
+
+type deviceTokenRequest struct {
+	Device string `json:"device"`
+}
+
+// IssueDeviceToken issues a token for a device of the group
+func (server *Server) IssueDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if server.deviceTokens == nil {
+		http.Error(w, "device tokens are not enabled", http.StatusNotFound)
+		return
+	}
+
+	name := chi.URLParam(r, "group")
+	if _, ok := server.cfg.Auth.Devices.Group(name); !ok {
+		http.Error(w, fmt.Sprintf("unknown device group '%s'", name), http.StatusNotFound)
+		return
+	}
+
+	var req deviceTokenRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Device == "" {
+		http.Error(w, "device is missing", http.StatusBadRequest)
+		return
+	}
+
+	access := []auth.Access{{Type: deviceGroupAccess, Name: name, Actions: []string{"pull"}}}
+
+	token, claims, err := server.deviceTokens.Issue(req.Device, access, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Printf("Issued token for device '%s' of group '%s' to '%s'\n", req.Device, name, IdentityFromRequest(r))
+
+	server.AuditRequest(r, audit.Event{
+		Action:  "device-token",
+		Message: fmt.Sprintf("device '%s' of group '%s'", req.Device, name),
+	})
+
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"token":      token,
+		"device":     req.Device,
+		"group":      name,
+		"expires_at": time.Unix(claims.ExpiresAt, 0).UTC(),
+	})
+}
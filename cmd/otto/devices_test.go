@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gicmo/otto/internal/auth"
+	"github.com/gicmo/otto/internal/ostree"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestDevicesConfig(t *testing.T) {
+	tests := []struct {
+		groups []DeviceGroupConfig
+		valid  bool
+	}{
+		{[]DeviceGroupConfig{{Name: "acme", Refs: []string{"acme/*/*"}}}, true},
+		{[]DeviceGroupConfig{{Name: "../acme", Refs: []string{"acme/*/*"}}}, false},
+		{[]DeviceGroupConfig{{Name: "acme"}}, false},
+		{[]DeviceGroupConfig{
+			{Name: "acme", Refs: []string{"acme/*/*"}},
+			{Name: "acme", Refs: []string{"other/*/*"}},
+		}, false},
+	}
+
+	for i, tt := range tests {
+		dc := DevicesConfig{Groups: tt.groups}
+		err := dc.Validate()
+		if (err == nil) != tt.valid {
+			t.Errorf("%d: expected valid=%v, got: %v", i, tt.valid, err)
+		}
+	}
+}
+
+func TestDeviceGroups(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	write := func(name string, data string) {
+		err := os.MkdirAll(filepath.Dir(name), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(name, []byte(data), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	repo := filepath.Join(tmp, "ostree", "repo")
+	write(filepath.Join(repo, "summary"), "all refs")
+	write(filepath.Join(repo, "config"), "config")
+	write(filepath.Join(repo, "refs", "heads", "acme", "x86_64", "iot"), "acme")
+	write(filepath.Join(repo, "refs", "heads", "other", "x86_64", "iot"), "other")
+	write(filepath.Join(repo, "objects", "ab", "cdef.commit"), "object")
+
+	keyFile := filepath.Join(tmp, "devices.key")
+	write(keyFile, strings.Repeat("k", 32))
+
+	cfg := OttoConfig{}
+	cfg.Auth.Devices.KeyFile = keyFile
+	cfg.Auth.Devices.Groups = []DeviceGroupConfig{{Name: "acme", Refs: []string{"acme/*/*"}}}
+
+	server := &Server{
+		cfg:  &cfg,
+		root: tmp,
+		repo: ostree.NewRepo(repo),
+	}
+
+	err = server.initDevices()
+	if err != nil {
+		t.Fatalf("Failed to setup device groups: %v", err)
+	}
+
+	// the view is normally created by updateViews, which needs ostree
+	write(filepath.Join(server.viewPath("acme"), "summary"), "acme refs")
+
+	router := chi.NewRouter()
+	router.Group(func(r chi.Router) {
+		r.Use(server.RepoAccess)
+		OstreeServer(r, "/ostree/repo", repo)
+	})
+	router.Post("/api/v1/device-groups/{group}/tokens", server.IssueDeviceToken)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/device-groups/unknown/tokens", strings.NewReader(`{"device": "d1"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Tokens for unknown groups should not be issued: %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/device-groups/acme/tokens", strings.NewReader(`{"device": "d1"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Failed to issue token: %d %s", w.Code, w.Body.String())
+	}
+
+	var res struct {
+		Token string `json:"token"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &res)
+	if err != nil || res.Token == "" {
+		t.Fatalf("Invalid token response: %v", err)
+	}
+
+	get := func(path string, token string) (int, string) {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	tests := []struct {
+		path  string
+		token string
+		code  int
+		body  string
+	}{
+		// without a token, the refs of the groups are hidden
+		{"/ostree/repo/summary", "", http.StatusForbidden, ""},
+		{"/ostree/repo/summary.sig", "", http.StatusForbidden, ""},
+		{"/ostree/repo/refs/heads/other/x86_64/iot", "", http.StatusForbidden, ""},
+		{"/ostree/repo/config", "", http.StatusOK, "config"},
+		{"/ostree/repo/objects/ab/cdef.commit", "", http.StatusOK, "object"},
+
+		{"/ostree/repo/summary", res.Token, http.StatusOK, "acme refs"},
+		{"/ostree/repo/config", res.Token, http.StatusOK, "config"},
+		{"/ostree/repo/objects/ab/cdef.commit", res.Token, http.StatusOK, "object"},
+		{"/ostree/repo/refs/heads/acme/x86_64/iot", res.Token, http.StatusOK, "acme"},
+		{"/ostree/repo/refs/heads/other/x86_64/iot", res.Token, http.StatusForbidden, ""},
+		{"/ostree/repo/refs/heads/acme/../other/x86_64/iot", res.Token, http.StatusForbidden, ""},
+		{"/ostree/repo/refs/heads/", res.Token, http.StatusForbidden, ""},
+		{"/ostree/repo/summary", "invalid", http.StatusUnauthorized, ""},
+	}
+
+	for _, tt := range tests {
+		code, body := get(tt.path, tt.token)
+		if code != tt.code || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s: expected %d '%s', got %d '%s'", tt.path, tt.code, tt.body, code, body)
+		}
+	}
+
+	// registry tokens are no device tokens, even with the same key
+	issuer, err := auth.NewTokenIssuer([]byte(strings.Repeat("k", 32)), "otto", "otto", time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to create issuer: %v", err)
+	}
+
+	access := []auth.Access{{Type: deviceGroupAccess, Name: "acme", Actions: []string{"pull"}}}
+	token, _, err := issuer.Issue("d1", access, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	if code, _ := get("/ostree/repo/summary", token); code != http.StatusUnauthorized {
+		t.Fatalf("Registry tokens should be rejected, got: %d", code)
+	}
+}
+
+func TestMirrorDeltas(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	server := &Server{root: tmp, repo: ostree.NewRepo(filepath.Join(tmp, "repo"))}
+
+	// a new view has an empty deltas directory
+	view := server.viewPath("acme")
+	err = os.MkdirAll(filepath.Join(view, "deltas"), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create view: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = server.mirrorDeltas(view)
+		if err != nil {
+			t.Fatalf("Failed to mirror deltas: %v", err)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmp, "repo", "deltas", "superblock"), []byte("delta"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write delta: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(view, "deltas", "superblock"))
+	if err != nil || string(data) != "delta" {
+		t.Fatalf("Deltas of the repo should be visible in the view: %v", err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Hook stages, in the order they run during an import
+const (
+	// the layer was extracted, the commit is not yet pulled
+	HookPostExtract = "post-extract"
+	// the commit was pulled, but it is not yet published
+	HookPostPull = "post-pull"
+	// the commit was published to its ref
+	HookPostPublish = "post-publish"
+)
+
+const defaultHookTimeout = 10 * time.Minute
+
+// limit of the output of a hook that is recorded
+const maxHookOutput = 64 * 1024
+
+type HookConfig struct {
+	Name  string `toml:"name"`
+	Stage string `toml:"stage"`
+	// program and its arguments
+	Command []string `toml:"command"`
+	// refs the hook runs for, as patterns; empty means all
+	Refs    []string `toml:"refs"`
+	Timeout Duration `toml:"timeout"`
+}
+
+func (hc HookConfig) Validate() error {
+	if len(hc.Command) == 0 {
+		return fmt.Errorf("hook '%s': no command", hc.Name)
+	}
+
+	switch hc.Stage {
+	case HookPostExtract, HookPostPull, HookPostPublish:
+		return nil
+	}
+
+	return fmt.Errorf("hook '%s': unknown stage '%s'", hc.Name, hc.Stage)
+}
+
+// HookInput is passed to hooks as JSON on stdin
+type HookInput struct {
+	Stage      string        `json:"stage"`
+	Manifest   digest.Digest `json:"manifest,omitempty"`
+	Repository string        `json:"repository,omitempty"`
+	Tag        string        `json:"tag,omitempty"`
+	Ref        string        `json:"ref"`
+	Commit     string        `json:"commit"`
+	DryRun     bool          `json:"dry-run"`
+
+	Paths struct {
+		// the repo inside the extracted image
+		Source string `json:"source,omitempty"`
+		// the repo that contains the commit
+		Repo string `json:"repo"`
+	} `json:"paths"`
+}
+
+// HookResult is the log entry of a single hook run
+type HookResult struct {
+	Name     string `json:"name"`
+	Stage    string `json:"stage"`
+	ExitCode int    `json:"exit-code"`
+	Output   string `json:"output,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (hr HookResult) Failed() bool {
+	return hr.ExitCode != 0 || hr.Error != ""
+}
+
+type limitedBuffer struct {
+	bytes.Buffer
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := maxHookOutput - b.Len(); n > room {
+		p = p[:room]
+		b.truncated = true
+	}
+
+	b.Buffer.Write(p)
+	return n, nil
+}
+
+func runHook(hc HookConfig, input []byte) HookResult {
+	res := HookResult{Name: hc.Name, Stage: hc.Stage}
+
+	timeout := hc.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultHookTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var output limitedBuffer
+
+	cmd := exec.CommandContext(ctx, hc.Command[0], hc.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+
+	res.Output = output.String()
+	if output.truncated {
+		res.Output += "\n[output truncated]"
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		res.Error = fmt.Sprintf("timed out after %s", timeout)
+	} else if exitErr, ok := err.(*exec.ExitError); ok {
+		res.ExitCode = exitErr.ExitCode()
+	} else if err != nil {
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+// RunHooks runs all hooks of the stage of input that apply to its ref
+func (server *Server) RunHooks(input *HookInput) []HookResult {
+	var results []HookResult
+
+	// a hook that cannot be given its input fails, it is not skipped
+	data, err := json.Marshal(input)
+
+	for _, hc := range server.cfg.Hooks {
+		if hc.Stage != input.Stage {
+			continue
+		}
+
+		if len(hc.Refs) > 0 && !matchAny(hc.Refs, input.Ref) {
+			continue
+		}
+
+		var res HookResult
+		if err != nil {
+			res = HookResult{Name: hc.Name, Stage: hc.Stage, Error: fmt.Sprintf("could not encode input: %v", err)}
+		} else {
+			res = runHook(hc, data)
+		}
+		fmt.Printf("Hook %s (%s) for %s: exit code %d %s\n", hc.Name, hc.Stage, input.Commit, res.ExitCode, res.Error)
+
+		results = append(results, res)
+	}
+
+	return results
+}
+
+// runImportHooks runs the hooks of stage for an import; any failing
+// hook vetoes the import
+func (server *Server) runImportHooks(stage string, ic *importContext, report *ImportReport) bool {
+	input := HookInput{
+		Stage:      stage,
+		Manifest:   ic.ci.manifest,
+		Repository: ic.ci.repository,
+		Tag:        ic.ci.tag,
+		Ref:        ic.ci.target,
+		Commit:     ic.commit,
+		DryRun:     ic.ci.dryRun,
+	}
+
+	// promotions have no image
+	if ic.source != nil {
+		input.Paths.Source = ic.source.Path()
+	}
+	input.Paths.Repo = ic.repo.Path()
+
+	for _, res := range server.RunHooks(&input) {
+		report.Hooks = append(report.Hooks, res)
+
+		check := CheckResult{Name: "hook:" + res.Name, Passed: !res.Failed()}
+		if res.Error != "" {
+			check.Message = res.Error
+		} else if res.ExitCode != 0 {
+			check.Message = fmt.Sprintf("exited with status %d", res.ExitCode)
+		}
+
+		report.Checks = append(report.Checks, check)
+	}
+
+	return !report.Failed()
+}
+
+// publishHooks runs the post-publish hooks in the background, their
+// result does not matter anymore; the image is taken from the event
+// of the ref update
+func (server *Server) publishHooks(ref string, commit string, event audit.Event) {
+	input := HookInput{
+		Stage:      HookPostPublish,
+		Manifest:   digest.Digest(event.Digest),
+		Repository: event.Repository,
+		Tag:        event.Tag,
+		Ref:        ref,
+		Commit:     commit,
+	}
+
+	input.Paths.Repo = server.repo.Path()
+
+	go func() {
+		for _, res := range server.RunHooks(&input) {
+			if res.Failed() {
+				fmt.Printf("Hook %s failed: %s\n", res.Name, res.Output)
+			}
+		}
+	}()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunHook(t *testing.T) {
+	hc := HookConfig{
+		Name:    "cat",
+		Stage:   HookPostPull,
+		Command: []string{"sh", "-c", "cat; echo; echo oops >&2; exit 3"},
+	}
+
+	res := runHook(hc, []byte(`{"ref":"a"}`))
+	if !res.Failed() || res.ExitCode != 3 || res.Error != "" {
+		t.Fatalf("Unexpected result: %+v", res)
+	}
+
+	if res.Output != "{\"ref\":\"a\"}\noops\n" {
+		t.Fatalf("Unexpected output: %q", res.Output)
+	}
+
+	hc.Command = []string{"sh", "-c", "exit 0"}
+	res = runHook(hc, nil)
+	if res.Failed() {
+		t.Fatalf("Hook should have passed: %+v", res)
+	}
+
+	hc.Command = []string{"sleep", "10"}
+	hc.Timeout = Duration{100 * time.Millisecond}
+	res = runHook(hc, nil)
+	if !res.Failed() || !strings.HasPrefix(res.Error, "timed out") {
+		t.Fatalf("Hook should have timed out: %+v", res)
+	}
+
+	hc.Command = []string{"/nonexistent/hook"}
+	res = runHook(hc, nil)
+	if !res.Failed() || res.Error == "" {
+		t.Fatalf("Missing hook should fail: %+v", res)
+	}
+}
+
+func TestHookValidate(t *testing.T) {
+	hc := HookConfig{Name: "x", Stage: HookPostExtract, Command: []string{"true"}}
+	if err := hc.Validate(); err != nil {
+		t.Fatalf("Hook should be valid: %v", err)
+	}
+
+	hc.Stage = "pre-everything"
+	if err := hc.Validate(); err == nil {
+		t.Fatalf("Unknown stage should be invalid")
+	}
+
+	hc.Stage = HookPostPublish
+	hc.Command = nil
+	if err := hc.Validate(); err == nil {
+		t.Fatalf("Missing command should be invalid")
+	}
+}
@@ -0,0 +1,633 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/ostree"
+)
+
+type CheckResult struct {
+	Name    string `json:"name"`
+	Passed  bool   `json:"passed"`
+	Message string `json:"message,omitempty"`
+}
+
+// ImportReport is the structured result of an import: the outcome
+// of all checks and whether the commit was, or for a dry-run would
+// have been, accepted.
+type ImportReport struct {
+	Ref      string        `json:"ref"`
+	Commit   string        `json:"commit,omitempty"`
+	DryRun   bool          `json:"dry-run"`
+	Accepted bool          `json:"accepted"`
+	Checks   []CheckResult `json:"checks"`
+
+	// set if the commit was staged and waits for approval
+	Approval string `json:"approval,omitempty"`
+
+	// log of the hooks that ran
+	Hooks []HookResult `json:"hooks,omitempty"`
+}
+
+func (report *ImportReport) Failed() bool {
+	for _, c := range report.Checks {
+		if !c.Passed {
+			return true
+		}
+	}
+	return false
+}
+
+func (report *ImportReport) Failures() []string {
+	var res []string
+	for _, c := range report.Checks {
+		if !c.Passed {
+			res = append(res, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		}
+	}
+	return res
+}
+
+type checkStage int
+
+const (
+	// before the layer is extracted
+	checkPre checkStage = iota
+	// on the repo in the image, before the commit is pulled
+	checkSource
+	// on the pulled commit, before it is published
+	checkCommit
+)
+
+type importContext struct {
+	ci CommitInfo
+	rc RefConfig
+
+	// the repo inside the image, nil for promotions
+	source *ostree.Repo
+	// the scratch repo the commit was pulled into for the checks,
+	// its parent is the repo; the repo itself for promotions
+	repo *ostree.Repo
+
+	commit string
+	// current head of the target ref, empty if it does not exist
+	head string
+	// the commit is promoted from another ref, not imported
+	promotion bool
+
+	// files of the commit, see Files()
+	files []ostree.FileInfo
+
+	// why the commit needs an approval before it is published
+	approvals []string
+}
+
+// approvalRequired is returned by checks that do not reject a
+// commit, but require it to be approved
+type approvalRequired struct {
+	reason string
+}
+
+func (e *approvalRequired) Error() string {
+	return e.reason
+}
+
+type importCheck struct {
+	name  string
+	stage checkStage
+	// whether the check applies to the import
+	enabled func(server *Server, ic *importContext) bool
+	run     func(server *Server, ic *importContext) error
+}
+
+var importChecks = []importCheck{
+	{
+		name:  "policy",
+		stage: checkPre,
+		// promotions are authorized per ref instead
+		enabled: func(server *Server, ic *importContext) bool {
+			return len(server.cfg.Policy) > 0 && !ic.promotion
+		},
+		run: checkPolicy,
+	},
+	{
+		name:  "image-signature",
+		stage: checkPre,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.ImageSignatures.Enabled()
+		},
+		run: checkImageSignature,
+	},
+	{
+		name:  "signature",
+		stage: checkSource,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Verify.Enabled()
+		},
+		run: checkSignature,
+	},
+	{
+		name:  "fast-forward",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.FastForwardOnly
+		},
+		run: checkFastForward,
+	},
+	{
+		name:  "version",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Versions.Monotonic
+		},
+		run: checkVersion,
+	},
+	{
+		name:  "arch",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Arch.Match
+		},
+		run: checkArch,
+	},
+	{
+		name:  "forbidden-paths",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return len(ic.rc.Content.ForbiddenPaths) > 0
+		},
+		run: checkForbiddenPaths,
+	},
+	{
+		name:  "setuid",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Content.DenySetuid
+		},
+		run: checkSetuid,
+	},
+	{
+		name:  "world-writable",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Content.DenyWorldWritable
+		},
+		run: checkWorldWritable,
+	},
+	{
+		name:  "tree-size",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Content.MaxTreeSize > 0
+		},
+		run: checkTreeSize,
+	},
+	{
+		name:  "required-files",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return len(ic.rc.Content.RequiredFiles) > 0
+		},
+		run: checkRequiredFiles,
+	},
+	{
+		name:  "os-release",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Content.OSReleaseVersionID != ""
+		},
+		run: checkOSRelease,
+	},
+	{
+		name:  "limits",
+		stage: checkCommit,
+		enabled: func(server *Server, ic *importContext) bool {
+			return ic.rc.Limits.Enabled()
+		},
+		run: checkLimits,
+	},
+}
+
+func checkPolicy(server *Server, ic *importContext) error {
+	return server.checkRefPolicy(&ic.ci)
+}
+
+// checkRefPolicy checks if the repository the image was pushed to may
+// write the target ref
+func (server *Server) checkRefPolicy(ci *CommitInfo) error {
+	if !server.cfg.RefAllowed(ci.repository, ci.identity, ci.target) {
+		return fmt.Errorf("repository '%s' may not write ref '%s'", ci.repository, ci.target)
+	}
+	return nil
+}
+
+func checkFastForward(server *Server, ic *importContext) error {
+	if ic.head == "" || ic.head == ic.commit {
+		return nil
+	}
+
+	// the history of the new commit continues in the main repo
+	parent, err := ic.repo.GetParentCommit(ic.commit)
+	for err == nil {
+		if parent == ic.head {
+			return nil
+		}
+
+		if !server.repo.HasCommit(parent) {
+			break
+		}
+
+		parent, err = server.repo.GetParentCommit(parent)
+	}
+
+	return fmt.Errorf("%s is not a descendant of the current head %s", ic.commit, ic.head)
+}
+
+func (server *Server) runChecks(stage checkStage, ic *importContext, report *ImportReport) bool {
+	for _, check := range importChecks {
+		if check.stage != stage || !check.enabled(server, ic) {
+			continue
+		}
+
+		res := CheckResult{Name: check.name, Passed: true}
+
+		err := check.run(server, ic)
+		if flag, ok := err.(*approvalRequired); ok {
+			res.Message = "approval required: " + flag.reason
+			ic.approvals = append(ic.approvals, flag.reason)
+		} else if err != nil {
+			res.Passed = false
+			res.Message = err.Error()
+		}
+
+		report.Checks = append(report.Checks, res)
+	}
+
+	return !report.Failed()
+}
+
+// gateCommit runs the commit checks and the post-pull hooks on the
+// commit in ic.repo and returns whether it was accepted; imports and
+// promotions pass through the same gate before they are published.
+// It is called with server.mu held and returns with it held, but the
+// hooks, which may take long, run without it, so the caller has to
+// check that the target ref has not moved, see checkHead.
+func (server *Server) gateCommit(ic *importContext, report *ImportReport) bool {
+	if server.runChecks(checkCommit, ic, report) || ic.ci.dryRun {
+		server.mu.Unlock()
+		server.runImportHooks(HookPostPull, ic, report)
+		server.mu.Lock()
+	}
+
+	report.Accepted = !report.Failed()
+	return report.Accepted
+}
+
+// checkHead makes sure the target ref still points to the head the
+// checks ran against; the caller must hold server.mu
+func (server *Server) checkHead(ic *importContext) error {
+	head, err := server.repo.RevParse(ic.ci.target)
+	if err != nil {
+		head = ""
+	}
+
+	if head != ic.head {
+		return fmt.Errorf("ref '%s' was updated concurrently, try again", ic.ci.target)
+	}
+
+	return nil
+}
+
+// approvalReason returns why the commit must be approved before it is
+// published, if it must be
+func (ic *importContext) approvalReason() (string, bool) {
+	if len(ic.approvals) > 0 {
+		return strings.Join(ic.approvals, "; "), true
+	}
+
+	if ic.rc.Approval.Required > 0 {
+		return "approval required", true
+	}
+
+	return "", false
+}
+
+// scratchRepo creates a throwaway repo at path, whose parent is the
+// repo, so that only the objects the repo lacks are pulled into it
+func (server *Server) scratchRepo(path string) (*ostree.Repo, error) {
+	repo := ostree.NewRepo(path)
+
+	err := repo.Init(ostree.ARCHIVE)
+	if err != nil {
+		return nil, err
+	}
+
+	err = repo.SetConfig("core.parent", server.repo.Path())
+	if err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// ImportCommitFromImage extracts the commit from the image, pulls it
+// into a scratch repo and runs all the checks there. Unless it is a
+// dry-run, the commit is then pulled into the repo and published to
+// the target ref. Commits that fail any check are rejected and never
+// reach the repo; for a dry-run all checks are run regardless.
+func (server *Server) ImportCommitFromImage(ci CommitInfo) (*ImportReport, error) {
+	ic := importContext{
+		ci: ci,
+		rc: server.cfg.ConfigForRef(ci.target),
+	}
+
+	report := &ImportReport{
+		Ref:    ci.target,
+		DryRun: ci.dryRun,
+	}
+
+	if !server.runChecks(checkPre, &ic, report) && !ci.dryRun {
+		return report, nil
+	}
+
+	blob := server.oci.PathForBlob(ci.layer)
+
+	tmp, err := ioutil.TempDir(server.root, ".import-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	layer := filepath.Join(tmp, "layer")
+	err = os.Mkdir(layer, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Extracting tarball\n")
+	cmd := exec.Command("tar", "-x", "--auto-compress", "-f", blob, "-C", layer)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	err = cmd.Run()
+
+	if err != nil {
+		return nil, fmt.Errorf("could not extract layer: %v", err)
+	}
+
+	source := filepath.Join(layer, strings.TrimLeft(ci.repo, "/"))
+	ic.source = ostree.NewRepo(source)
+
+	cid, err := ic.source.RevParse(ci.ref)
+	if err != nil {
+		return nil, fmt.Errorf("could not find ref '%s' in image", ci.ref)
+	}
+
+	ic.commit = cid
+	report.Commit = cid
+
+	if !server.runChecks(checkSource, &ic, report) && !ci.dryRun {
+		return report, nil
+	}
+
+	if !server.runImportHooks(HookPostExtract, &ic, report) && !ci.dryRun {
+		return report, nil
+	}
+
+	ic.repo, err = server.scratchRepo(filepath.Join(tmp, "scratch"))
+	if err != nil {
+		return nil, fmt.Errorf("could not create scratch repo: %w", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	ic.head, err = server.repo.RevParse(ci.target)
+	if err != nil {
+		ic.head = ""
+	}
+
+	// pull the commit itself, so that it can land on a different ref
+	fmt.Printf("Pulling commit %s (%s) into scratch repo\n", cid, ci.ref)
+	// the objects of a verified commit must match their checksums,
+	// otherwise the signature would not cover them
+	err = ic.repo.PullLocal(source, cid, ic.rc.Verify.Enabled())
+	if err != nil {
+		return nil, fmt.Errorf("could not pull commit: %w", err)
+	}
+
+	// the checks and hooks see the commit on the staging ref of the
+	// scratch repo, never on a ref of the repo
+	err = ic.repo.SetRef(StagingRef(ci.target), cid)
+	if err != nil {
+		return nil, fmt.Errorf("could not update staging ref: %w", err)
+	}
+
+	if !server.gateCommit(&ic, report) || ci.dryRun {
+		return report, nil
+	}
+
+	err = server.checkHead(&ic)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := ImportRecord{
+		Manifest:    ci.manifest,
+		Commit:      cid,
+		Ref:         ci.target,
+		Layer:       ci.layer,
+		Repository:  ci.repository,
+		Tag:         ci.tag,
+		Arch:        ci.arch,
+		Time:        time.Now().UTC(),
+		Identity:    ci.identity,
+		Annotations: server.cfg.Provenance.Select(ci.annotations),
+		Hooks:       report.Hooks,
+	}
+
+	if reason, ok := ic.approvalReason(); ok {
+		// staged commits only get into the repo once approved
+		approval, err := server.StageCommit(ic.repo.Path(), ci.target, cid, ic.head, ci.manifest, reason, ci.origin())
+		if err != nil {
+			return nil, err
+		}
+
+		if server.cfg.Provenance.DetachedMetadata {
+			err = server.WriteProvenance(server.staging, &rec)
+			if err != nil {
+				return nil, fmt.Errorf("could not write provenance: %w", err)
+			}
+		}
+
+		// the ref does not point to the commit until it is approved,
+		// so a re-push does not take the fast-path before that
+		err = server.imports.Put(&rec)
+		if err != nil {
+			return nil, fmt.Errorf("could not record import: %w", err)
+		}
+
+		fmt.Printf("Staged %s for %s, approval %s\n", cid, ci.target, approval.ID)
+		report.Approval = approval.ID
+		return report, nil
+	}
+
+	// only commits that passed all checks get into the repo
+	fmt.Printf("Pulling commit %s into repo\n", cid)
+	err = server.repo.PullLocal(ic.repo.Path(), cid, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not pull commit: %w", err)
+	}
+
+	if server.cfg.Provenance.DetachedMetadata {
+		err = server.WriteProvenance(server.repo, &rec)
+		if err != nil {
+			return nil, fmt.Errorf("could not write provenance: %w", err)
+		}
+	}
+
+	err = server.PublishCommit(ci.target, cid, ci.origin())
+	if err != nil {
+		return nil, err
+	}
+
+	// recorded only once published, otherwise a re-push would take the
+	// fast-path and the commit would never be signed or published
+	err = server.imports.Put(&rec)
+	if err != nil {
+		return nil, fmt.Errorf("could not record import: %w", err)
+	}
+
+	fmt.Printf("Pulled %s to %s\n", cid, ci.target)
+
+	return report, nil
+}
+
+// PublishCommit points ref to commit, signs it and updates the
+// summary; the update is audited and added to the transparency log
+// on behalf of origin. The caller must hold server.mu
+func (server *Server) PublishCommit(ref string, commit string, origin audit.Event) error {
+	previous, err := server.repo.RevParse(ref)
+	if err != nil {
+		previous = ""
+	}
+
+	event := origin
+	event.Action = "ref-update"
+	event.Ref = ref
+	event.Commit = commit
+	event.Previous = previous
+
+	// promotions and approvals only know the commit
+	if event.Repository == "" {
+		if rec, err := server.imports.ByCommit(commit); err == nil {
+			event.Digest = rec.Manifest.String()
+			event.Repository = rec.Repository
+			event.Tag = rec.Tag
+		}
+	}
+
+	// an update must not be published without being logged
+	err = server.setLoggedRef(server.repo, ref, previous, commit, event.Digest)
+	if err != nil {
+		event.Outcome, event.Message = audit.OutcomeFailure, err.Error()
+		server.Audit(event)
+		return err
+	}
+
+	server.Audit(event)
+
+	err = server.repo.SignCommit(commit)
+	if err != nil {
+		return fmt.Errorf("could not sign commit: %w", err)
+	}
+
+	err = server.updateSummaries()
+	if err != nil {
+		return err
+	}
+
+	server.ScheduleDeltas(ref, commit)
+	server.publishHooks(ref, commit, event)
+
+	return nil
+}
+
+// Import imports the commit described by ci into the repo; a dry-run
+// only runs the checks and leaves the repo untouched
+func (server *Server) Import(ci CommitInfo) (*ImportReport, error) {
+	report, err := server.ImportCommitFromImage(ci)
+	if ci.dryRun {
+		return report, err
+	}
+
+	if err == nil && report.Accepted {
+		err = server.tagImport(ci)
+
+		// a failed import of a signed image may be retried by pushing
+		// the image again
+		if perr := server.imports.DeletePending(ci.manifest); perr != nil && !os.IsNotExist(perr) {
+			fmt.Printf("Could not remove pending import: %v\n", perr)
+		}
+	}
+
+	server.auditImport(ci, report, err)
+	return report, err
+}
+
+// tagImport points the tag the image was pushed with to its manifest,
+// once it has been imported
+func (server *Server) tagImport(ci CommitInfo) error {
+	if ci.tag == "" {
+		return nil
+	}
+
+	err := server.oci.TagManifest(ci.repository, ci.tag, ci.manifest)
+	if err != nil {
+		return fmt.Errorf("could not tag manifest: %w", err)
+	}
+
+	return nil
+}
+
+// origin returns an event with who pushed the image, from where
+func (ci *CommitInfo) origin() audit.Event {
+	return audit.Event{
+		Identity:   ci.identity,
+		Source:     ci.source,
+		Repository: ci.repository,
+		Tag:        ci.tag,
+		Digest:     ci.manifest.String(),
+	}
+}
+
+// auditImport records the result of the import
+func (server *Server) auditImport(ci CommitInfo, report *ImportReport, err error) {
+	event := ci.origin()
+	event.Action = "import"
+	event.Repository = ci.repository
+	event.Tag = ci.tag
+	event.Ref = ci.target
+
+	if report != nil {
+		event.Commit = report.Commit
+	}
+
+	switch {
+	case err != nil:
+		event.Outcome, event.Message = audit.OutcomeFailure, err.Error()
+	case !report.Accepted:
+		event.Outcome = audit.OutcomeFailure
+		event.Message = "rejected: " + strings.Join(report.Failures(), "; ")
+	case report.Approval != "":
+		event.Message = "staged for approval " + report.Approval
+	}
+
+	server.Audit(event)
+}
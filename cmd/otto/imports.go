@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/gicmo/otto/internal/ostree"
+	digest "github.com/opencontainers/go-digest"
+)
+
+var commitRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// ImportRecord links a manifest to the commit that was imported from
+// it and the ref the commit was imported to; it also contains the
+// provenance of the commit.
+type ImportRecord struct {
+	Manifest digest.Digest `json:"manifest"`
+	Commit   string        `json:"commit"`
+	Ref      string        `json:"ref"`
+
+	Layer       digest.Digest     `json:"layer"`
+	Repository  string            `json:"repository"`
+	Tag         string            `json:"tag,omitempty"`
+	Arch        string            `json:"arch,omitempty"`
+	Time        time.Time         `json:"time"`
+	Identity    string            `json:"identity,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// log of the hooks that ran during the import
+	Hooks []HookResult `json:"hooks,omitempty"`
+}
+
+// ImportStore keeps the import records, indexed by manifest digest
+// and by commit checksum
+type ImportStore struct {
+	Path string
+
+	manifests string
+	commits   string
+	pending   string
+}
+
+func NewImportStore(path string) *ImportStore {
+	return &ImportStore{
+		Path:      path,
+		manifests: filepath.Join(path, "manifests"),
+		commits:   filepath.Join(path, "commits"),
+		pending:   filepath.Join(path, "pending"),
+	}
+}
+
+func (store *ImportStore) Init() error {
+	err := os.MkdirAll(store.manifests, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(store.pending, 0700)
+	if err != nil {
+		return err
+	}
+
+	return os.MkdirAll(store.commits, 0700)
+}
+
+func writeJSON(path string, data interface{}) error {
+	raw, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(raw)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fd.Name(), path)
+}
+
+func readJSON(path string, data interface{}) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(raw, data)
+}
+
+func (store *ImportStore) Put(rec *ImportRecord) error {
+	err := writeJSON(filepath.Join(store.manifests, rec.Manifest.String()), rec)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(filepath.Join(store.commits, rec.Commit), rec)
+}
+
+func (store *ImportStore) ByManifest(d digest.Digest) (*ImportRecord, error) {
+	err := d.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var rec ImportRecord
+	err = readJSON(filepath.Join(store.manifests, d.String()), &rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+func (store *ImportStore) ByCommit(commit string) (*ImportRecord, error) {
+	if !commitRegexp.MatchString(commit) {
+		return nil, os.ErrNotExist
+	}
+
+	var rec ImportRecord
+	err := readJSON(filepath.Join(store.commits, commit), &rec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rec, nil
+}
+
+// WriteProvenance adds the provenance of the commit in repo to its detached
+// metadata, as "otto.source.*" entries, so that it is also available
+// to mirrors; existing entries, like signatures, are preserved.
+func (server *Server) WriteProvenance(repo *ostree.Repo, rec *ImportRecord) error {
+	meta, err := repo.DetachedMetadata(rec.Commit)
+	if err != nil {
+		return err
+	}
+
+	annotations, err := json.Marshal(rec.Annotations)
+	if err != nil {
+		return err
+	}
+
+	source := map[string]string{
+		"manifest":    rec.Manifest.String(),
+		"layer":       rec.Layer.String(),
+		"repository":  rec.Repository,
+		"tag":         rec.Tag,
+		"time":        rec.Time.Format(time.RFC3339),
+		"identity":    rec.Identity,
+		"annotations": string(annotations),
+	}
+
+	for k, v := range source {
+		meta["otto.source."+k] = ostree.StringVariant(v)
+	}
+
+	return repo.SetDetachedMetadata(rec.Commit, meta)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+func TestImportStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	store := NewImportStore(tmp)
+	err = store.Init()
+	if err != nil {
+		t.Fatalf("Failed to init store: %v", err)
+	}
+
+	rec := ImportRecord{
+		Manifest:   digest.FromString("manifest"),
+		Commit:     digest.FromString("commit").Encoded(),
+		Ref:        "fedora/x86_64/iot",
+		Layer:      digest.FromString("layer"),
+		Repository: "iot",
+		Tag:        "latest",
+		Time:       time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+		Annotations: map[string]string{
+			"org.opencontainers.image.version": "34",
+		},
+	}
+
+	err = store.Put(&rec)
+	if err != nil {
+		t.Fatalf("Failed to store record: %v", err)
+	}
+
+	have, err := store.ByManifest(rec.Manifest)
+	if err != nil || !reflect.DeepEqual(*have, rec) {
+		t.Fatalf("Lookup by manifest failed: %v, %v", have, err)
+	}
+
+	have, err = store.ByCommit(rec.Commit)
+	if err != nil || !reflect.DeepEqual(*have, rec) {
+		t.Fatalf("Lookup by commit failed: %v, %v", have, err)
+	}
+
+	_, err = store.ByManifest(digest.FromString("other"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Unknown manifests should not exist: %v", err)
+	}
+
+	_, err = store.ByCommit("../manifests")
+	if !os.IsNotExist(err) {
+		t.Fatalf("Invalid commits should not exist: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -8,15 +9,18 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	_ "crypto/sha512"
 
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/auth"
 	"github.com/gicmo/otto/internal/container"
 	"github.com/gicmo/otto/internal/ostree"
+	"github.com/gicmo/otto/internal/tlog"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	digest "github.com/opencontainers/go-digest"
@@ -25,17 +29,53 @@ import (
 
 type Server struct {
 	root string
+	cfg  *OttoConfig
 
-	oci  *container.Registry
-	repo *ostree.Repo
+	oci     *container.Registry
+	repo    *ostree.Repo
+	imports *ImportStore
+	// commits waiting for approval; never served
+	staging   *ostree.Repo
+	approvals *ApprovalStore
+
+	// nil if authentication is disabled
+	htpasswd *auth.Htpasswd
+	// nil if token authentication is disabled
+	tokens *auth.TokenIssuer
+	// nil if authorization is disabled
+	policy *auth.PolicyFile
+
+	urlSigner *auth.URLSigner
+
+	deviceTokens *auth.TokenIssuer
+
+	audit *audit.Log
+
+	tlog *tlog.Log
+
+	// serializes modifications of the ostree repo
+	mu sync.Mutex
+
+	deltas *deltaQueue
+
+	// CAs of client certificates per group of routes, see TLSConfig
+	clientCAs map[string]*x509.CertPool
 }
 
-func NewServer(root string) *Server {
-	return &Server{
-		root: root,
-		oci:  container.NewRegistry(filepath.Join(root, "oci")),
-		repo: ostree.NewRepo(filepath.Join(root, "ostree", "repo")),
+func NewServer(cfg *OttoConfig) *Server {
+	root := cfg.Root
+	server := &Server{
+		root:      root,
+		cfg:       cfg,
+		oci:       container.NewRegistry(filepath.Join(root, "oci")),
+		repo:      ostree.NewRepo(filepath.Join(root, "ostree", "repo")),
+		staging:   ostree.NewRepo(filepath.Join(root, "ostree", "staging")),
+		imports:   NewImportStore(filepath.Join(root, "imports")),
+		approvals: NewApprovalStore(filepath.Join(root, "approvals")),
+		deltas:    newDeltaQueue(),
 	}
+
+	return server
 }
 
 func (server *Server) Init() error {
@@ -49,9 +89,106 @@ func (server *Server) Init() error {
 	if err != nil {
 		return fmt.Errorf("failed to init ostree repo: %w", err)
 	}
+
+	err = server.staging.Init(ostree.ARCHIVE)
+	if err != nil {
+		return fmt.Errorf("failed to init staging repo: %w", err)
+	}
+
+	err = server.imports.Init()
+	if err != nil {
+		return fmt.Errorf("failed to init import store: %w", err)
+	}
+
+	err = server.approvals.Init()
+	if err != nil {
+		return fmt.Errorf("failed to init approval store: %w", err)
+	}
+
+	err = server.initAudit()
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	err = server.initTransparency()
+	if err != nil {
+		return fmt.Errorf("failed to open transparency log: %w", err)
+	}
+
+	err = server.initAuth()
+	if err != nil {
+		return fmt.Errorf("failed to setup authentication: %w", err)
+	}
+
+	err = server.checkApprovals()
+	if err != nil {
+		return err
+	}
+
+	err = server.initPolicy()
+	if err != nil {
+		return fmt.Errorf("failed to load policy: %w", err)
+	}
+
+	err = server.initPresign()
+	if err != nil {
+		return fmt.Errorf("failed to setup pre-signed urls: %w", err)
+	}
+
+	err = server.initDevices()
+	if err != nil {
+		return fmt.Errorf("failed to setup device groups: %w", err)
+	}
+
+	err = server.initSigning()
+	if err != nil {
+		return fmt.Errorf("failed to setup signing: %w", err)
+	}
+
+	for _, hc := range server.cfg.Hooks {
+		if err := hc.Validate(); err != nil {
+			return err
+		}
+	}
+
+	// groups might have been added or changed
+	err = server.updateViews()
+	if err != nil {
+		return fmt.Errorf("failed to update device group views: %w", err)
+	}
+
+	go server.processDeltas()
+
 	return nil
 }
 
+// initSigning adds the configured signers to the repo; it is part of
+// Init, not NewServer, since reading the keys can fail
+func (server *Server) initSigning() error {
+	signing := server.cfg.Signing
+
+	if signing.GPG.KeyID != "" {
+		server.repo.AddSigner(ostree.NewGPGSigner(signing.GPG.Homedir, signing.GPG.KeyID))
+	}
+
+	if signing.Ed25519.SecretKeyFile != "" {
+		signer, err := ostree.NewEd25519Signer(signing.Ed25519.SecretKeyFile, signing.Ed25519.PublicKeys)
+		if err != nil {
+			return fmt.Errorf("ed25519: %w", err)
+		}
+		server.repo.AddSigner(signer)
+	}
+
+	return nil
+}
+
+func (server *Server) UpdateSummary() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.updateSummaries()
+}
+
 func MustParseDigest(raw string, w http.ResponseWriter) digest.Digest {
 
 	d, err := digest.Parse(raw)
@@ -214,12 +351,22 @@ func (server *Server) UploadFinish(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	event := audit.Event{
+		Action:     "blob-upload",
+		Repository: repo,
+		Digest:     checksum.String(),
+	}
+
 	checksum, err := server.oci.FinishBlob(uid, checksum)
 	if err != nil {
+		event.Outcome, event.Message = audit.OutcomeFailure, err.Error()
+		server.AuditRequest(r, event)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	server.AuditRequest(r, event)
+
 	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, checksum.String()))
 	w.WriteHeader(http.StatusCreated)
 }
@@ -228,6 +375,86 @@ type CommitInfo struct {
 	repo  string
 	ref   string
 	layer digest.Digest
+
+	// ref the commit is imported to
+	target string
+
+	manifest digest.Digest
+	dryRun   bool
+
+	// architecture of the image
+	arch string
+
+	// provenance of the image
+	repository  string
+	tag         string
+	identity    string
+	source      string
+	annotations map[string]string
+}
+
+// isDryRun checks if only validation, but no import, was requested
+// via the annotation or the query parameter
+func isDryRun(r *http.Request, annotations map[string]string) bool {
+	for _, value := range []string{
+		annotations["org.osbuild.ostree.dry-run"],
+		r.URL.Query().Get("dry-run"),
+	} {
+		if dry, err := strconv.ParseBool(value); err == nil && dry {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseRefs splits the ref annotation, which can be given as
+// "source:target", into the source and the target ref; an explicit
+// target ref annotation takes precedence.
+func parseRefs(annotations map[string]string) (string, string) {
+	ref := annotations["org.osbuild.ostree.ref"]
+	target := annotations["org.osbuild.ostree.target-ref"]
+
+	if i := strings.Index(ref, ":"); i != -1 {
+		if target == "" {
+			target = ref[i+1:]
+		}
+		ref = ref[:i]
+	}
+
+	if target == "" {
+		target = ref
+	}
+
+	return ref, target
+}
+
+// parseCommitInfo reads where the commit is in the image and where
+// it should go from the manifest annotations
+func parseCommitInfo(m *v1.Manifest) (CommitInfo, error) {
+	var commit CommitInfo
+	commit.repo = m.Annotations["org.osbuild.ostree.repo"]
+	commit.ref, commit.target = parseRefs(m.Annotations)
+	layer_str := m.Annotations["org.osbuild.ostree.layer"]
+
+	layer_nr, err := strconv.Atoi(layer_str)
+	if err != nil {
+		return commit, err
+	}
+
+	if layer_nr < 0 || layer_nr >= len(m.Layers) {
+		return commit, fmt.Errorf("Invalid OSTree layer id")
+	}
+
+	commit.layer = m.Layers[layer_nr].Digest
+
+	if commit.repo == "" || commit.ref == "" || commit.target == "" {
+		return commit, fmt.Errorf("Manifest does not contain ostree commit")
+	}
+
+	commit.annotations = m.Annotations
+
+	return commit, nil
 }
 
 func (server *Server) UploadManifest(w http.ResponseWriter, r *http.Request) {
@@ -243,52 +470,169 @@ func (server *Server) UploadManifest(w http.ResponseWriter, r *http.Request) {
 
 	fmt.Printf("repo: '%s', reference '%s' '%s'\n", repo, reference, ct)
 
-	var m v1.Manifest
-
-	err := json.NewDecoder(r.Body).Decode(&m)
+	raw, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var commit CommitInfo
-	commit.repo = m.Annotations["org.osbuild.ostree.repo"]
-	commit.ref = m.Annotations["org.osbuild.ostree.ref"]
-	layer_str := m.Annotations["org.osbuild.ostree.layer"]
+	var m v1.Manifest
 
-	layer_nr, err := strconv.Atoi(layer_str)
+	err = json.Unmarshal(raw, &m)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if layer_nr > len(m.Layers) {
-		http.Error(w, "Invalid OSTree layer id", http.StatusBadRequest)
+	tag := ""
+	if _, err := digest.Parse(reference); err != nil {
+		tag = reference
+	}
+
+	// images are only tagged after the import, too late to reject it
+	if tag != "" && !container.ValidTag(tag) {
+		http.Error(w, fmt.Sprintf("Invalid tag: '%s'", tag), http.StatusBadRequest)
 		return
 	}
 
-	commit.layer = m.Layers[layer_nr].Digest
+	// signatures of other manifests are just stored
+	signed, isSignature := container.SignedManifest(tag)
 
-	if commit.repo == "" || commit.ref == "" {
-		http.Error(w, "Manifest does not contain ostree commit", http.StatusBadRequest)
-		return
+	var commit CommitInfo
+	if !isSignature {
+		commit, err = parseCommitInfo(&m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		commit.repository = repo
+		commit.tag = tag
+		commit.identity = IdentityFromRequest(r)
+		commit.source = remoteAddr(r)
+		commit.dryRun = isDryRun(r, m.Annotations)
+
+		commit.arch, err = imageArch(server.oci, m.Config.Digest)
+		if err != nil {
+			fmt.Printf("Could not read architecture of image: %v\n", err)
+		}
+
+		// pushing to the repository is not enough, the client must
+		// also be allowed to write the ref the image is imported to
+		if !server.Allowed(w, r, auth.ActionPush, auth.KindRef, commit.target) {
+			return
+		}
 	}
 
-	d, err := server.oci.PutManifest(m)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	event := audit.Event{
+		Action:     "manifest-push",
+		Repository: repo,
+		Tag:        tag,
+	}
+
+	// rejected before anything is stored, and before the fast-path
+	// for imported manifests; for a dry-run it is part of the report
+	if !isSignature && !commit.dryRun {
+		err = server.checkRefPolicy(&commit)
+		if err != nil {
+			event.Outcome, event.Message = audit.OutcomeDenied, err.Error()
+			server.AuditRequest(r, event)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	var d digest.Digest
+
+	if commit.dryRun {
+		// a dry-run leaves no trace in the registry either
+		d = digest.FromBytes(raw)
+
+		if !server.oci.HasBlob(commit.layer) {
+			http.Error(w, fmt.Sprintf("layer missing: %v", commit.layer), http.StatusBadRequest)
+			return
+		}
+	} else {
+		d, err = server.oci.PutManifestRaw(raw)
+		if err != nil {
+			event.Outcome, event.Message = audit.OutcomeFailure, err.Error()
+			server.AuditRequest(r, event)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		event.Digest = d.String()
+
+		// signatures are found via their tag; images are only tagged
+		// once they have been imported
+		if isSignature {
+			err = server.oci.TagManifest(repo, tag, d)
+			if err != nil {
+				event.Outcome, event.Message = audit.OutcomeFailure, err.Error()
+				server.AuditRequest(r, event)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if isSignature {
+			event.Message = fmt.Sprintf("signature of %s", signed)
+		}
+		server.AuditRequest(r, event)
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, d.String()))
+	w.Header().Set("Docker-Content-Digest", d.String())
+
+	if isSignature {
+		fmt.Printf("Signature %s for %s\n", d.String(), signed.String())
+		server.ResumeImport(signed)
+		w.WriteHeader(http.StatusCreated)
 		return
 	}
 
-	cid, err := server.ImportCommitFromImage(commit)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	commit.manifest = d
+
+	cid, imported := server.ImportedCommit(d, commit.target)
+	if imported && !commit.dryRun {
+		fmt.Printf("Manifest %s already imported as %s\n", d.String(), cid)
+
+		err = server.tagImport(commit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if server.AwaitSignature(commit) {
+		fmt.Printf("Import of %s waits for its signature\n", d.String())
+		w.Header().Set("OSTree-Import", "pending")
+		w.WriteHeader(http.StatusCreated)
 		return
+	} else {
+		report, err := server.Import(commit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !report.Accepted {
+			fmt.Printf("Import rejected: %s\n", strings.Join(report.Failures(), "; "))
+			WriteJSON(w, http.StatusForbidden, report)
+			return
+		} else if commit.dryRun {
+			WriteJSON(w, http.StatusOK, report)
+			return
+		} else if report.Approval != "" {
+			// staged, the commit is not published before it is approved
+			w.Header().Set("OSTree-Commit-id", report.Commit)
+			w.Header().Set("OSTree-Approval", report.Approval)
+			WriteJSON(w, http.StatusAccepted, report)
+			return
+		}
+
+		cid = report.Commit
 	}
 
-	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", repo, d.String()))
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Docker-Content-Digest", d.String())
 	w.Header().Set("OSTree-Commit-id", cid)
 
 	w.WriteHeader(http.StatusCreated)
@@ -335,48 +679,45 @@ func (server *Server) GetManifest(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func (server *Server) ImportCommitFromImage(ci CommitInfo) (string, error) {
-
-	blob := server.oci.PathForBlob(ci.layer)
-
-	tmp, err := ioutil.TempDir(server.root, ".import-*")
-	if err != nil {
-		return "", err
+// ImportedCommit returns the commit that was imported from manifest,
+// if the ref is still pointing to it
+func (server *Server) ImportedCommit(manifest digest.Digest, ref string) (string, bool) {
+	rec, err := server.imports.ByManifest(manifest)
+	if err != nil || rec.Ref != ref {
+		return "", false
 	}
-	defer os.RemoveAll(tmp)
 
-	fmt.Printf("Extracting tarball\n")
-	cmd := exec.Command("tar", "-x", "--auto-compress", "-f", blob, "-C", tmp)
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-	err = cmd.Run()
-
-	if err != nil {
-		return "", fmt.Errorf("could not extract layer: %v", err)
+	head, err := server.repo.RevParse(ref)
+	if err != nil || head != rec.Commit {
+		return "", false
 	}
 
-	source := filepath.Join(tmp, strings.TrimLeft(ci.repo, "/"))
-
-	fmt.Printf("Pulling commit (%s) into repo\n", ci.ref)
-	err = server.repo.PullLocal(source, ci.ref)
-	if err != nil {
-		return "", fmt.Errorf("could not pull commit: %w", err)
-	}
+	return rec.Commit, true
+}
 
-	cid, err := server.repo.RevParse(ci.ref)
+func (server *Server) GetPublicKey(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
 
-	if err != nil {
-		return "", err
-	}
+	for _, signer := range server.repo.Signers() {
+		if signer.PublicKeyName() != name {
+			continue
+		}
 
-	fmt.Printf("Pulled %s\n", cid)
-	err = server.repo.UpdateSummary()
+		data, err := signer.PublicKeys()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	if err != nil {
-		return "", err
+		w.Header().Set("Content-Type", "application/octet-stream")
+		_, err = w.Write(data)
+		if err != nil {
+			fmt.Printf("i/o error: %v", err)
+		}
+		return
 	}
 
-	return cid, nil
+	http.Error(w, "Key does not exist", http.StatusNotFound)
 }
 
 func OstreeServer(r chi.Router, public string, repo string) {
@@ -404,6 +745,8 @@ func main() {
 		Addr: ":3000",
 	}
 
+	cfg.Provenance.Annotations = []string{"org.opencontainers.image.*"}
+
 	cfg.TLS.Cert = "/etc/otto/server-crt.pem"
 	cfg.TLS.Key = "/etc/otto/server-key.pem"
 
@@ -412,13 +755,25 @@ func main() {
 		log.Fatalf("Failed to read configuration: %v", err)
 	}
 
-	server := NewServer(cfg.Root)
+	server := NewServer(&cfg)
 	err = server.Init()
 
 	if err != nil {
 		log.Fatalf("Failed to initialize server: %v", err)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "prune" {
+		os.Exit(cmdPrune(server, os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(cmdAudit(server, os.Args[2:]))
+	}
+
+	if cfg.Prune.Interval.Duration > 0 {
+		go server.SchedulePrune(cfg.Prune.Interval.Duration)
+	}
+
 	// Setup routes
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
@@ -427,23 +782,68 @@ func main() {
 		fmt.Printf("i/o error: %v", err)
 	})
 
-	OstreeServer(r, "/ostree/repo", server.repo.Path())
+	r.Group(func(r chi.Router) {
+		r.Use(server.ClientCert(ClientGroupRepo))
 
-	r.Head("/v2/{repo}/blobs/{digest}", server.HeadBlob)
-	r.Get("/v2/{repo}/blobs/{digest}", server.GetBlob)
+		// devices verify commits and updates, so they get the keys and
+		// the transparency log with the same access as the repo
+		r.Group(func(r chi.Router) {
+			r.Use(server.RepoAccess)
+			OstreeServer(r, "/ostree/repo", server.repo.Path())
 
-	r.Post("/v2/{repo}/blobs/uploads/", server.BeginUpload)
-	r.Patch("/v2/{repo}/blobs/uploads/{uuid}", server.UploadChunked)
-	r.Put("/v2/{repo}/blobs/uploads/{uuid}", server.UploadFinish)
-	r.Put("/v2/{repo}/manifests/{reference}", server.UploadManifest)
-	r.Get("/v2/{repo}/manifests/{reference}", server.GetManifest)
+			r.Get("/ostree/keys/{name}", server.GetPublicKey)
 
-	r.Get("/v2/", func(w http.ResponseWriter, r *http.Request) {
-		_, err := w.Write([]byte("nothing to see here"))
-		fmt.Printf("i/o error: %v", err)
+			r.Get("/tlog/head", server.GetTreeHead)
+			r.Get("/tlog/key", server.GetLogKey)
+			r.Get("/tlog/entries", server.GetLogEntries)
+			r.Get("/tlog/proof/inclusion", server.GetInclusionProof)
+			r.Get("/tlog/proof/consistency", server.GetConsistencyProof)
+		})
 	})
 
-	err = http.ListenAndServeTLS(cfg.Addr, cfg.TLS.Cert, cfg.TLS.Key, r)
+	r.Get("/auth/token", server.IssueToken)
+
+	r.Group(func(r chi.Router) {
+		r.Use(server.ClientCert(ClientGroupRegistry))
+		r.Use(server.Authenticate)
+
+		r.Group(server.registryRoutes)
+
+		r.With(server.RequireAction(auth.ActionRead)).Group(func(r chi.Router) {
+			r.Get("/api/v1/commits/{commit}", server.GetCommit)
+			r.Get("/api/v1/manifests/{digest}", server.GetManifestImport)
+			r.Get("/api/v1/approvals", server.ListApprovals)
+			r.Get("/api/v1/approvals/{id}", server.GetApproval)
+			r.Get("/api/v1/channels", server.ListChannels)
+		})
+
+		// authorized per ref by the handlers
+		r.Post("/api/v1/approvals/{id}/{decision}", server.DecideApproval)
+		r.Post("/api/v1/channels/{channel}/promote", server.PromoteChannel)
+
+		r.With(server.RequireAction(auth.ActionAdmin)).Post("/api/v1/prune", server.AdminPrune)
+		r.With(server.RequireAction(auth.ActionAdmin)).Post("/api/v1/presign", server.Presign)
+		r.With(server.RequireAction(auth.ActionAdmin)).Post("/api/v1/device-groups/{group}/tokens", server.IssueDeviceToken)
+		r.With(server.RequireAction(auth.ActionAdmin)).Get("/api/v1/audit", server.ListAudit)
+
+		r.Get("/v2/", func(w http.ResponseWriter, r *http.Request) {
+			_, err := w.Write([]byte("nothing to see here"))
+			fmt.Printf("i/o error: %v", err)
+		})
+	})
+
+	tc, err := server.TLSConfig()
+	if err != nil {
+		log.Fatalf("Failed to setup TLS: %v", err)
+	}
+
+	srv := &http.Server{
+		Addr:      cfg.Addr,
+		Handler:   r,
+		TLSConfig: tc,
+	}
+
+	err = srv.ListenAndServeTLS(cfg.TLS.Cert, cfg.TLS.Key)
 	if err != nil {
 		log.Fatalf("Failed to server: %v", err)
 	}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRefs(t *testing.T) {
+	cases := []struct {
+		annotations map[string]string
+		ref         string
+		target      string
+	}{
+		{
+			map[string]string{"org.osbuild.ostree.ref": "fedora/x86_64/iot"},
+			"fedora/x86_64/iot", "fedora/x86_64/iot",
+		},
+		{
+			map[string]string{"org.osbuild.ostree.ref": "fedora/x86_64/iot:acme/prod/x86_64"},
+			"fedora/x86_64/iot", "acme/prod/x86_64",
+		},
+		{
+			map[string]string{
+				"org.osbuild.ostree.ref":        "fedora/x86_64/iot",
+				"org.osbuild.ostree.target-ref": "acme/prod/x86_64",
+			},
+			"fedora/x86_64/iot", "acme/prod/x86_64",
+		},
+		{
+			map[string]string{},
+			"", "",
+		},
+	}
+
+	for _, c := range cases {
+		ref, target := parseRefs(c.annotations)
+		if ref != c.ref || target != c.target {
+			t.Errorf("Unexpected refs for %v: '%s' '%s'", c.annotations, ref, target)
+		}
+	}
+}
+
+func TestIsDryRun(t *testing.T) {
+	cases := []struct {
+		url         string
+		annotations map[string]string
+		dryRun      bool
+	}{
+		{"/v2/iot/manifests/latest", map[string]string{}, false},
+		{"/v2/iot/manifests/latest?dry-run=true", map[string]string{}, true},
+		{"/v2/iot/manifests/latest?dry-run=0", map[string]string{}, false},
+		{"/v2/iot/manifests/latest", map[string]string{"org.osbuild.ostree.dry-run": "true"}, true},
+		{"/v2/iot/manifests/latest", map[string]string{"org.osbuild.ostree.dry-run": "no"}, false},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest("PUT", c.url, nil)
+		if isDryRun(r, c.annotations) != c.dryRun {
+			t.Errorf("Unexpected dry-run for %s %v", c.url, c.annotations)
+		}
+	}
+}
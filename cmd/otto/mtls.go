@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// Client certificate modes, per group of routes
+const (
+	ClientCertNone    = "none"
+	ClientCertRequest = "request"
+	ClientCertRequire = "require"
+)
+
+// Groups of routes with their own client certificate settings
+const (
+	ClientGroupRegistry = "registry"
+	ClientGroupRepo     = "repo"
+)
+
+const clientSubjectKey contextKey = "client-subject"
+
+func validClientCertMode(mode string) bool {
+	switch mode {
+	case "", ClientCertNone, ClientCertRequest, ClientCertRequire:
+		return true
+	}
+	return false
+}
+
+// clientCertConfig returns the mode of the group and the CA its client
+// certificates must be signed by
+func (server *Server) clientCertConfig(group string) (string, string) {
+	cfg := server.cfg.TLS
+
+	mode, ca := cfg.ClientAuth.Registry, cfg.ClientAuth.RegistryCA
+	if group == ClientGroupRepo {
+		mode, ca = cfg.ClientAuth.Repo, cfg.ClientAuth.RepoCA
+	}
+
+	if ca == "" {
+		ca = cfg.ClientCA
+	}
+
+	return mode, ca
+}
+
+// loadCerts reads the PEM encoded certificates of a CA file
+func loadCerts(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates in '%s'", path)
+	}
+
+	return certs, nil
+}
+
+// TLSConfig returns the TLS configuration of the server and loads the
+// CAs of the groups of routes. The handshake accepts certificates of
+// any of them, but a certificate only authenticates the client for
+// the routes of a group whose CA signed it, see ClientCert.
+func (server *Server) TLSConfig() (*tls.Config, error) {
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	pool := x509.NewCertPool()
+	roots := make(map[string]*x509.CertPool)
+
+	for _, group := range []string{ClientGroupRegistry, ClientGroupRepo} {
+		mode, ca := server.clientCertConfig(group)
+		if !validClientCertMode(mode) {
+			return nil, fmt.Errorf("invalid client certificate mode '%s'", mode)
+		}
+
+		if mode == "" || mode == ClientCertNone {
+			continue
+		}
+
+		if ca == "" {
+			return nil, fmt.Errorf("client certificates for the %s need a client CA", group)
+		}
+
+		certs, err := loadCerts(ca)
+		if err != nil {
+			return nil, err
+		}
+
+		roots[group] = x509.NewCertPool()
+		for _, cert := range certs {
+			roots[group].AddCert(cert)
+			pool.AddCert(cert)
+		}
+	}
+
+	server.clientCAs = roots
+
+	if len(roots) == 0 {
+		return tc, nil
+	}
+
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+
+	return tc, nil
+}
+
+// verifyClientCert returns the subject of the client certificate, if
+// it is signed by one of roots
+func verifyClientCert(r *http.Request, roots *x509.CertPool) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+
+	certs := r.TLS.PeerCertificates
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return ""
+	}
+
+	return certs[0].Subject.String()
+}
+
+// ClientSubject returns the subject of the client certificate, if it
+// authenticates the client for the route, or the empty string
+func ClientSubject(r *http.Request) string {
+	subject, _ := r.Context().Value(clientSubjectKey).(string)
+	return subject
+}
+
+// ClientCert returns the middleware of a group of routes: if client
+// certificates are requested or required for the group, a certificate
+// signed by the CA of the group authenticates the client; clients
+// without one are rejected if it is required
+func (server *Server) ClientCert(group string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mode, _ := server.clientCertConfig(group)
+
+			subject := ""
+			if roots := server.clientCAs[group]; roots != nil {
+				subject = verifyClientCert(r, roots)
+			}
+
+			if subject == "" && mode == ClientCertRequire {
+				http.Error(w, "Client certificate required", http.StatusForbidden)
+				return
+			}
+
+			if subject != "" {
+				r = r.WithContext(context.WithValue(r.Context(), clientSubjectKey, subject))
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
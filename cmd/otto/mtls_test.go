@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func makeCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Otto"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	return cert, key
+}
+
+func TestClientCerts(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	ca, caKey := makeCert(t, "Otto CA", nil, nil)
+	device, deviceKey := makeCert(t, "device-1", ca, caKey)
+
+	rogueCA, rogueKey := makeCert(t, "Rogue CA", nil, nil)
+	rogue, rogueDeviceKey := makeCert(t, "device-2", rogueCA, rogueKey)
+
+	writeCA := func(name string, cert *x509.Certificate) string {
+		path := filepath.Join(tmp, name)
+		err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write CA: %v", err)
+		}
+		return path
+	}
+
+	caFile := writeCA("ca.pem", ca)
+
+	cfg := OttoConfig{}
+	server := &Server{cfg: &cfg}
+
+	cfg.TLS.ClientAuth.Registry = "maybe"
+	if _, err := server.TLSConfig(); err == nil {
+		t.Fatalf("Invalid mode should be rejected")
+	}
+
+	cfg.TLS.ClientAuth.Registry = ClientCertRequire
+	if _, err := server.TLSConfig(); err == nil {
+		t.Fatalf("Client certificates without CA should be rejected")
+	}
+
+	cfg.TLS.ClientCA = caFile
+	tc, err := server.TLSConfig()
+	if err != nil {
+		t.Fatalf("Failed to setup TLS: %v", err)
+	}
+
+	identity := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(IdentityFromRequest(r)))
+	})
+
+	mux := http.NewServeMux()
+	mux.Handle("/registry", server.ClientCert(ClientGroupRegistry)(server.Authenticate(identity)))
+	mux.Handle("/repo", server.ClientCert(ClientGroupRepo)(server.Authenticate(identity)))
+
+	ts := httptest.NewUnstartedServer(mux)
+	ts.TLS = tc
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(path string, cert *x509.Certificate, key *ecdsa.PrivateKey) (int, string, error) {
+		transport := ts.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = nil
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{{
+				Certificate: [][]byte{cert.Raw},
+				PrivateKey:  key,
+			}}
+		}
+
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(ts.URL + path)
+		if err != nil {
+			return 0, "", err
+		}
+		defer res.Body.Close()
+
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body), nil
+	}
+
+	code, body, err := get("/registry", device, deviceKey)
+	if err != nil || code != http.StatusOK || body != "CN=device-1,O=Otto" {
+		t.Fatalf("Unexpected response for device: %d %s (%v)", code, body, err)
+	}
+
+	code, _, err = get("/registry", nil, nil)
+	if err != nil || code != http.StatusForbidden {
+		t.Fatalf("Client without certificate should be rejected: %d (%v)", code, err)
+	}
+
+	// depending on the client, the certificate is not sent at all or
+	// the handshake fails
+	code, _, err = get("/registry", rogue, rogueDeviceKey)
+	if err == nil && code != http.StatusForbidden {
+		t.Fatalf("Certificate from unknown CA should be rejected: %d", code)
+	}
+
+	// certificates are not an identity for routes that do not ask
+	// for them
+	code, body, err = get("/repo", device, deviceKey)
+	if err != nil || code != http.StatusOK || body != "" {
+		t.Fatalf("Certificate should not authenticate the repo: %d %s (%v)", code, body, err)
+	}
+
+	// a separate CA for the repo
+	cfg.TLS.ClientAuth.Repo = ClientCertRequest
+	cfg.TLS.ClientAuth.RepoCA = writeCA("rogue-ca.pem", rogueCA)
+
+	tc, err = server.TLSConfig()
+	if err != nil {
+		t.Fatalf("Failed to setup TLS: %v", err)
+	}
+	ts.TLS.ClientCAs = tc.ClientCAs
+
+	code, body, err = get("/repo", rogue, rogueDeviceKey)
+	if err != nil || code != http.StatusOK || body != "CN=device-2,O=Otto" {
+		t.Fatalf("Certificate of the repo CA should authenticate: %d %s (%v)", code, body, err)
+	}
+
+	code, _, err = get("/registry", rogue, rogueDeviceKey)
+	if err != nil || code != http.StatusForbidden {
+		t.Fatalf("Certificate of the repo CA is not valid for the registry: %d (%v)", code, err)
+	}
+
+	code, body, err = get("/repo", device, deviceKey)
+	if err != nil || code != http.StatusOK || body != "" {
+		t.Fatalf("Certificate of the registry CA is not valid for the repo: %d %s (%v)", code, body, err)
+	}
+}
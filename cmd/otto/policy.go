@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path"
+)
+
+// RefPolicy allows the registry repositories matching Repos, pushed
+// by one of Identities, to write the ostree refs matching Refs. Empty
+// Repos or Identities match everything. All values are patterns as
+// understood by path.Match.
+type RefPolicy struct {
+	Repos      []string `toml:"repos"`
+	Identities []string `toml:"identities"`
+	Refs       []string `toml:"refs"`
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p RefPolicy) Allows(repo string, identity string, ref string) bool {
+	if len(p.Repos) > 0 && !matchAny(p.Repos, repo) {
+		return false
+	}
+
+	if len(p.Identities) > 0 && !matchAny(p.Identities, identity) {
+		return false
+	}
+
+	return matchAny(p.Refs, ref)
+}
+
+// RefAllowed checks if the registry repository repo may write to the
+// ostree ref; without any policy everything is allowed
+func (cfg *OttoConfig) RefAllowed(repo string, identity string, ref string) bool {
+	if len(cfg.Policy) == 0 {
+		return true
+	}
+
+	for _, p := range cfg.Policy {
+		if p.Allows(repo, identity, ref) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type contextKey string
+
+const identityKey contextKey = "identity"
+
+func WithIdentity(r *http.Request, identity string) *http.Request {
+	ctx := context.WithValue(r.Context(), identityKey, identity)
+	return r.WithContext(ctx)
+}
+
+// IdentityFromRequest returns the authenticated identity of the
+// client, or the empty string for anonymous clients
+func IdentityFromRequest(r *http.Request) string {
+	identity, _ := r.Context().Value(identityKey).(string)
+	return identity
+}
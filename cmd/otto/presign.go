@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/auth"
+)
+
+type PresignConfig struct {
+	// file with the secret key urls are signed with; pre-signed
+	// urls are disabled if not set
+	KeyFile   string   `toml:"key-file"`
+	MaxExpiry Duration `toml:"max-expiry"`
+}
+
+const ostreeRepoPrefix = "/ostree/repo/"
+
+func (server *Server) initPresign() error {
+	pc := server.cfg.Auth.Presign
+
+	if pc.KeyFile == "" {
+		return nil
+	}
+
+	key, err := ioutil.ReadFile(pc.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	server.urlSigner, err = auth.NewURLSigner(key)
+	return err
+}
+
+func (server *Server) maxPresignExpiry() time.Duration {
+	if d := server.cfg.Auth.Presign.MaxExpiry.Duration; d > 0 {
+		return d
+	}
+	return 7 * 24 * time.Hour
+}
+
+// RepoAuthenticate authenticates requests to the ostree repo if
+// protect-repo is set
+func (server *Server) RepoAuthenticate(next http.Handler) http.Handler {
+	if !server.cfg.Auth.ProtectRepo {
+		return next
+	}
+
+	return server.Authenticate(next)
+}
+
+// VerifySignature only lets pass pre-signed requests whose signature
+// is valid; a url scoped to a device group is limited to the refs of
+// the group like the devices of the group
+func (server *Server) VerifySignature(next http.Handler) http.Handler {
+	view := server.DeviceView(ostreeRepoPrefix)(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		err := server.urlSigner.Verify(r.URL.Path, query, time.Now())
+		if err != nil {
+			fmt.Printf("Denied %s %s: %v\n", r.Method, r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		group := auth.Scope(query)
+		if group == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the group might have been removed since
+		if _, ok := server.cfg.Auth.Devices.Group(group); !ok {
+			http.Error(w, fmt.Sprintf("unknown device group '%s'", group), http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), deviceGroupKey{}, group)
+		view.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type presignRequest struct {
+	Prefix string `json:"prefix"`
+	Group  string `json:"group"`
+	Expiry string `json:"expiry"`
+}
+
+// Presign hands out a pre-signed url for the ostree repo, optionally
+// limited to a path prefix and the refs of a device group, which
+// expires after the requested expiry (default: one day), at most
+// max-expiry
+func (server *Server) Presign(w http.ResponseWriter, r *http.Request) {
+	if server.urlSigner == nil {
+		http.Error(w, "pre-signed urls are not enabled", http.StatusNotFound)
+		return
+	}
+
+	req := presignRequest{
+		Prefix: ostreeRepoPrefix,
+		Expiry: "24h",
+	}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !strings.HasPrefix(req.Prefix, ostreeRepoPrefix) {
+		http.Error(w, fmt.Sprintf("prefix must be below '%s'", ostreeRepoPrefix), http.StatusBadRequest)
+		return
+	}
+
+	if req.Group != "" {
+		if _, ok := server.cfg.Auth.Devices.Group(req.Group); !ok {
+			http.Error(w, fmt.Sprintf("unknown device group '%s'", req.Group), http.StatusBadRequest)
+			return
+		}
+	}
+
+	expiry, err := time.ParseDuration(req.Expiry)
+	if err != nil || expiry <= 0 {
+		http.Error(w, fmt.Sprintf("invalid expiry '%s'", req.Expiry), http.StatusBadRequest)
+		return
+	}
+
+	if max := server.maxPresignExpiry(); expiry > max {
+		http.Error(w, fmt.Sprintf("expiry exceeds the maximum of %s", max), http.StatusBadRequest)
+		return
+	}
+
+	expires := time.Now().Add(expiry)
+	query := server.urlSigner.Sign(req.Prefix, req.Group, expires)
+
+	// ostree appends the paths to the remote url, the query is kept
+	url := fmt.Sprintf("https://%s%s?%s", r.Host, ostreeRepoPrefix, query.Encode())
+
+	scope := fmt.Sprintf("'%s'", req.Prefix)
+	if req.Group != "" {
+		scope += fmt.Sprintf(" of group '%s'", req.Group)
+	}
+
+	fmt.Printf("Pre-signed %s until %s for '%s'\n", scope, expires.UTC().Format(time.RFC3339), IdentityFromRequest(r))
+
+	server.AuditRequest(r, audit.Event{
+		Action:  "presign",
+		Message: fmt.Sprintf("%s until %s", scope, expires.UTC().Format(time.RFC3339)),
+	})
+
+	res := map[string]interface{}{
+		"url":     url,
+		"prefix":  req.Prefix,
+		"expires": expires.UTC(),
+	}
+
+	if req.Group != "" {
+		res["group"] = req.Group
+	}
+
+	WriteJSON(w, http.StatusOK, res)
+}
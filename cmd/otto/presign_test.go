@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestPresign(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := filepath.Join(tmp, "repo")
+	err = os.MkdirAll(filepath.Join(repo, "refs", "heads", "acme"), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create repo: %v", err)
+	}
+
+	for _, name := range []string{"config", "summary", "refs/heads/iot", "refs/heads/iotlab", "refs/heads/acme/iot"} {
+		err = ioutil.WriteFile(filepath.Join(repo, name), []byte(name), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	keyFile := filepath.Join(tmp, "presign.key")
+	err = ioutil.WriteFile(keyFile, bytes.Repeat([]byte("k"), 32), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	cfg.Auth.Presign.KeyFile = keyFile
+	cfg.Auth.Presign.MaxExpiry.Duration = 48 * time.Hour
+	cfg.Auth.Devices.Groups = []DeviceGroupConfig{{Name: "acme", Refs: []string{"acme/*"}}}
+	server := &Server{cfg: &cfg, root: tmp}
+
+	err = server.initPresign()
+	if err != nil {
+		t.Fatalf("Failed to setup pre-signed urls: %v", err)
+	}
+
+	// the view is normally created by updateViews, which needs ostree
+	err = os.MkdirAll(server.viewPath("acme"), 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(server.viewPath("acme"), "summary"), []byte("acme refs"), 0644)
+	}
+	if err != nil {
+		t.Fatalf("Failed to write view: %v", err)
+	}
+
+	router := chi.NewRouter()
+	router.Group(func(r chi.Router) {
+		r.Use(server.RepoAccess)
+		OstreeServer(r, "/ostree/repo", repo)
+	})
+	router.Post("/api/v1/presign", server.Presign)
+
+	presign := func(body string) (int, string) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/v1/presign", strings.NewReader(body)))
+
+		var res struct {
+			URL string `json:"url"`
+		}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		return w.Code, res.URL
+	}
+
+	fetch := func(path string, query string) (int, string) {
+		target := path
+		if query != "" {
+			target += "?" + query
+		}
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		return w.Code, w.Body.String()
+	}
+
+	get := func(path string, query string) int {
+		code, _ := fetch(path, query)
+		return code
+	}
+
+	// signatures grant access, they are not required without
+	// protect-repo
+	if code := get("/ostree/repo/config", ""); code != http.StatusOK {
+		t.Fatalf("Unsigned requests should be served, got: %d", code)
+	}
+
+	code, _ := presign(`{"prefix": "/etc/"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("Prefixes outside the repo should be rejected, got: %d", code)
+	}
+
+	code, _ = presign(`{"expiry": "72h"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("Expiry above the maximum should be rejected, got: %d", code)
+	}
+
+	code, _ = presign(`{"group": "unknown"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("Unknown device groups should be rejected, got: %d", code)
+	}
+
+	code, signed := presign(`{"prefix": "/ostree/repo/refs/", "expiry": "1h"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Failed to pre-sign: %d", code)
+	}
+
+	u, err := url.Parse(signed)
+	if err != nil || u.Path != "/ostree/repo/" {
+		t.Fatalf("Unexpected url '%s': %v", signed, err)
+	}
+
+	if code := get("/ostree/repo/refs/heads/iot", u.RawQuery); code != http.StatusOK {
+		t.Fatalf("Pre-signed request should be served, got: %d", code)
+	}
+
+	if code := get("/ostree/repo/config", u.RawQuery); code != http.StatusForbidden {
+		t.Fatalf("Paths outside the prefix should be denied, got: %d", code)
+	}
+
+	q := u.Query()
+	q.Set("prefix", "/ostree/repo/")
+	if code := get("/ostree/repo/config", q.Encode()); code != http.StatusForbidden {
+		t.Fatalf("Tampered requests should be denied, got: %d", code)
+	}
+
+	code, signed = presign(`{"prefix": "/ostree/repo/refs/heads/iot"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Failed to pre-sign: %d", code)
+	}
+
+	u, _ = url.Parse(signed)
+	if code := get("/ostree/repo/refs/heads/iotlab", u.RawQuery); code != http.StatusForbidden {
+		t.Fatalf("Prefixes should match whole path components, got: %d", code)
+	}
+
+	code, signed = presign(`{"group": "acme"}`)
+	if code != http.StatusOK {
+		t.Fatalf("Failed to pre-sign for a group: %d", code)
+	}
+
+	u, _ = url.Parse(signed)
+
+	tests := []struct {
+		path string
+		code int
+		body string
+	}{
+		{"/ostree/repo/summary", http.StatusOK, "acme refs"},
+		{"/ostree/repo/config", http.StatusOK, "config"},
+		{"/ostree/repo/refs/heads/acme/iot", http.StatusOK, "refs/heads/acme/iot"},
+		{"/ostree/repo/refs/heads/iot", http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		code, body := fetch(tt.path, u.RawQuery)
+		if code != tt.code || (tt.body != "" && body != tt.body) {
+			t.Errorf("%s: expected %d '%s', got: %d '%s'", tt.path, tt.code, tt.body, code, body)
+		}
+	}
+}
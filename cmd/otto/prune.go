@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gicmo/otto/internal/audit"
+	"github.com/gicmo/otto/internal/ostree"
+)
+
+// retainCommits splits the history of a ref, newest commit first,
+// into the commits to keep and the ones that can be dropped
+func retainCommits(history []ostree.Commit, rc RetentionConfig, now time.Time) ([]string, []string) {
+	var keep, drop []string
+
+	pinned := make(map[string]bool)
+	for _, c := range rc.Pinned {
+		pinned[c] = true
+	}
+
+	for i, c := range history {
+		young := rc.KeepYounger.Duration > 0 && now.Sub(c.Date) < rc.KeepYounger.Duration
+
+		if !rc.Enabled() || i == 0 || i < rc.KeepLast || young || pinned[c.Checksum] {
+			keep = append(keep, c.Checksum)
+		} else {
+			drop = append(drop, c.Checksum)
+		}
+	}
+
+	return keep, drop
+}
+
+// PlanPrune returns the commits that fall outside the retention
+// policies of all refs; commits that are retained via any ref, are
+// a ref head, pinned or in use by a delta generation are never
+// included.
+func (server *Server) PlanPrune() ([]string, error) {
+	refs, err := server.repo.ListRefs()
+	if err != nil {
+		return nil, fmt.Errorf("could not list refs: %w", err)
+	}
+
+	now := time.Now()
+	keep := make(map[string]bool)
+	seen := make(map[string]bool)
+	var candidates []string
+
+	for _, ref := range refs {
+		history, err := server.repo.Log(ref)
+		if err != nil {
+			return nil, fmt.Errorf("could not read history of %s: %w", ref, err)
+		}
+
+		rc := server.cfg.ConfigForRef(ref).Retention
+		retained, dropped := retainCommits(history, rc, now)
+
+		for _, c := range retained {
+			keep[c] = true
+		}
+
+		for _, c := range dropped {
+			if !seen[c] {
+				candidates = append(candidates, c)
+				seen[c] = true
+			}
+		}
+	}
+
+	var commits []string
+	for _, c := range candidates {
+		if !keep[c] && !server.deltas.Held(c) {
+			commits = append(commits, c)
+		}
+	}
+
+	return commits, nil
+}
+
+func (server *Server) Prune(dryRun bool, origin audit.Event) ([]string, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	commits, err := server.PlanPrune()
+	if err != nil || dryRun {
+		return commits, err
+	}
+
+	err = server.repo.Prune(commits)
+	if err != nil {
+		event := origin
+		event.Action = "prune"
+		event.Outcome, event.Message = audit.OutcomeFailure, err.Error()
+		server.Audit(event)
+		return nil, err
+	}
+
+	for _, c := range commits {
+		event := origin
+		event.Action = "commit-delete"
+		event.Commit = c
+		server.Audit(event)
+	}
+
+	// deltas might have been removed
+	err = server.updateSummaries()
+	if err != nil {
+		return nil, err
+	}
+
+	return commits, nil
+}
+
+func (server *Server) SchedulePrune(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		commits, err := server.Prune(false, audit.Event{Identity: "otto", Message: "scheduled prune"})
+		if err != nil {
+			fmt.Printf("Pruning failed: %v\n", err)
+			continue
+		}
+
+		fmt.Printf("Pruned %d commits\n", len(commits))
+	}
+}
+
+// AdminPrune prunes the repo, or with the "dry-run" query parameter
+// only returns what would be pruned
+func (server *Server) AdminPrune(w http.ResponseWriter, r *http.Request) {
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry-run"))
+
+	commits, err := server.Prune(dryRun, requestOrigin(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if commits == nil {
+		commits = []string{}
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"dry-run": dryRun,
+		"commits": commits,
+	})
+}
+
+func cmdPrune(server *Server, args []string) int {
+	flags := flag.NewFlagSet("prune", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only show the commits that would be deleted")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return 2
+	}
+
+	commits, err := server.Prune(*dryRun, audit.Event{Identity: "otto", Message: "prune command"})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to prune: %v\n", err)
+		return 1
+	}
+
+	for _, c := range commits {
+		fmt.Println(c)
+	}
+
+	if *dryRun {
+		fmt.Printf("Would delete %d commits\n", len(commits))
+	} else {
+		fmt.Printf("Deleted %d commits\n", len(commits))
+	}
+
+	return 0
+}
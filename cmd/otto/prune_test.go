@@ -0,0 +1,45 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gicmo/otto/internal/ostree"
+)
+
+func TestRetainCommits(t *testing.T) {
+	now := time.Now()
+
+	history := []ostree.Commit{
+		{Checksum: "e", Date: now.Add(-1 * time.Hour)},
+		{Checksum: "d", Date: now.Add(-2 * time.Hour)},
+		{Checksum: "c", Date: now.Add(-48 * time.Hour)},
+		{Checksum: "b", Date: now.Add(-72 * time.Hour)},
+		{Checksum: "a", Date: now.Add(-96 * time.Hour)},
+	}
+
+	keep, drop := retainCommits(history, RetentionConfig{}, now)
+	if len(keep) != 5 || len(drop) != 0 {
+		t.Fatalf("Without retention everything should be kept: %v %v", keep, drop)
+	}
+
+	rc := RetentionConfig{KeepLast: 2, Pinned: []string{"b"}}
+	keep, drop = retainCommits(history, rc, now)
+	if !reflect.DeepEqual(keep, []string{"e", "d", "b"}) || !reflect.DeepEqual(drop, []string{"c", "a"}) {
+		t.Fatalf("Unexpected result for keep-last: %v %v", keep, drop)
+	}
+
+	rc = RetentionConfig{KeepYounger: Duration{24 * time.Hour}}
+	keep, drop = retainCommits(history, rc, now)
+	if !reflect.DeepEqual(keep, []string{"e", "d"}) || !reflect.DeepEqual(drop, []string{"c", "b", "a"}) {
+		t.Fatalf("Unexpected result for keep-younger: %v %v", keep, drop)
+	}
+
+	// the head is always retained
+	rc = RetentionConfig{KeepYounger: Duration{time.Minute}}
+	keep, _ = retainCommits(history, rc, now)
+	if !reflect.DeepEqual(keep, []string{"e"}) {
+		t.Fatalf("Head should be kept: %v", keep)
+	}
+}
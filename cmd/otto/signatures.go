@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gicmo/otto/internal/container"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// PendingImport is an image whose import waits for its signature
+type PendingImport struct {
+	Manifest   digest.Digest `json:"manifest"`
+	Ref        string        `json:"ref"`
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag,omitempty"`
+	Identity   string        `json:"identity,omitempty"`
+	Source     string        `json:"source,omitempty"`
+	Arch       string        `json:"arch,omitempty"`
+	Created    time.Time     `json:"created"`
+
+	// why the last attempt to import the signed image failed; it is
+	// retried when another signature or the image is pushed again
+	Error  string        `json:"error,omitempty"`
+	Report *ImportReport `json:"report,omitempty"`
+}
+
+func (store *ImportStore) PutPending(p *PendingImport) error {
+	return writeJSON(filepath.Join(store.pending, p.Manifest.String()), p)
+}
+
+func (store *ImportStore) Pending(manifest digest.Digest) (*PendingImport, error) {
+	if manifest.Validate() != nil {
+		return nil, os.ErrNotExist
+	}
+
+	var p PendingImport
+	err := readJSON(filepath.Join(store.pending, manifest.String()), &p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+func (store *ImportStore) DeletePending(manifest digest.Digest) error {
+	if manifest.Validate() != nil {
+		return os.ErrNotExist
+	}
+
+	return os.Remove(filepath.Join(store.pending, manifest.String()))
+}
+
+func (sc ImageSignaturesConfig) Keys() ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for _, path := range sc.PublicKeys {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		k, err := container.ParsePublicKeys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+
+		keys = append(keys, k...)
+	}
+
+	return keys, nil
+}
+
+func (server *Server) verifyImage(ci CommitInfo, sc ImageSignaturesConfig) error {
+	keys, err := sc.Keys()
+	if err != nil {
+		return fmt.Errorf("invalid public keys: %w", err)
+	}
+
+	return server.oci.VerifyImage(ci.repository, ci.manifest, keys)
+}
+
+func checkImageSignature(server *Server, ic *importContext) error {
+	// e.g. a promoted commit that was not imported, but committed to
+	// the repo directly
+	if ic.ci.manifest == "" {
+		return fmt.Errorf("commit was not imported from an image")
+	}
+
+	return server.verifyImage(ic.ci, ic.rc.ImageSignatures)
+}
+
+// AwaitSignature records the import of an image that must be signed,
+// but is not yet, as signatures are pushed after the image itself;
+// it returns false if the import should go ahead.
+func (server *Server) AwaitSignature(ci CommitInfo) bool {
+	sc := server.cfg.ConfigForRef(ci.target).ImageSignatures
+	if !sc.Enabled() || ci.dryRun {
+		return false
+	}
+
+	err := server.verifyImage(ci, sc)
+	if err != container.ErrNoSignatures {
+		return false
+	}
+
+	p := PendingImport{
+		Manifest:   ci.manifest,
+		Ref:        ci.target,
+		Repository: ci.repository,
+		Tag:        ci.tag,
+		Identity:   ci.identity,
+		Source:     ci.source,
+		Arch:       ci.arch,
+		Created:    time.Now().UTC(),
+	}
+
+	err = server.imports.PutPending(&p)
+	if err != nil {
+		// the check will reject the import
+		fmt.Printf("Could not record pending import: %v\n", err)
+		return false
+	}
+
+	return true
+}
+
+// ResumeImport imports the image manifest once it has a valid
+// signature; the import runs in the background
+func (server *Server) ResumeImport(manifest digest.Digest) {
+	p, err := server.imports.Pending(manifest)
+	if err != nil {
+		return
+	}
+
+	m, err := server.oci.ReadManifestJSON(manifest)
+	if err != nil {
+		fmt.Printf("Could not read pending manifest %s: %v\n", manifest, err)
+		return
+	}
+
+	ci, err := parseCommitInfo(m)
+	if err != nil {
+		fmt.Printf("Invalid pending manifest %s: %v\n", manifest, err)
+		return
+	}
+
+	ci.manifest = p.Manifest
+	ci.repository = p.Repository
+	ci.tag = p.Tag
+	ci.identity = p.Identity
+	ci.source = p.Source
+	ci.arch = p.Arch
+
+	// wait for another signature if this one is not valid
+	err = server.verifyImage(ci, server.cfg.ConfigForRef(ci.target).ImageSignatures)
+	if err != nil {
+		fmt.Printf("Signature of pending %s not valid: %v\n", manifest, err)
+		return
+	}
+
+	err = server.imports.DeletePending(manifest)
+	if err != nil {
+		fmt.Printf("Could not remove pending import: %v\n", err)
+		return
+	}
+
+	go func() {
+		report, err := server.Import(ci)
+		if err == nil && report.Accepted {
+			fmt.Printf("Imported signed %s as %s\n", manifest, report.Commit)
+			return
+		}
+
+		if err != nil {
+			p.Error = err.Error()
+		} else {
+			p.Error = "rejected: " + strings.Join(report.Failures(), "; ")
+			p.Report = report
+		}
+
+		fmt.Printf("Import of %s failed: %s\n", manifest, p.Error)
+
+		// keep it pending, so that the failure can be seen and the
+		// import retried
+		err = server.imports.PutPending(p)
+		if err != nil {
+			fmt.Printf("Could not record failed import: %v\n", err)
+		}
+	}()
+}
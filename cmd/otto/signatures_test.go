@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPendingImports(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	store := NewImportStore(tmp)
+	err = store.Init()
+	if err != nil {
+		t.Fatalf("Failed to init store: %v", err)
+	}
+
+	p := PendingImport{
+		Manifest:   digest.FromString("manifest"),
+		Ref:        "fedora/x86_64/iot",
+		Repository: "iot",
+		Tag:        "latest",
+		Created:    time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC),
+	}
+
+	err = store.PutPending(&p)
+	if err != nil {
+		t.Fatalf("Failed to store pending import: %v", err)
+	}
+
+	have, err := store.Pending(p.Manifest)
+	if err != nil || *have != p {
+		t.Fatalf("Unexpected pending import: %+v, %v", have, err)
+	}
+
+	err = store.DeletePending(p.Manifest)
+	if err != nil {
+		t.Fatalf("Failed to delete pending import: %v", err)
+	}
+
+	if _, err := store.Pending(p.Manifest); !os.IsNotExist(err) {
+		t.Fatalf("Pending import should be gone: %v", err)
+	}
+
+	if _, err := store.Pending("../../etc/passwd"); !os.IsNotExist(err) {
+		t.Fatalf("Invalid digest should not exist: %v", err)
+	}
+}
+
+func TestParseCommitInfo(t *testing.T) {
+	layer := digest.FromString("layer")
+
+	m := v1.Manifest{
+		Layers: []v1.Descriptor{{Digest: layer}},
+		Annotations: map[string]string{
+			"org.osbuild.ostree.repo":  "/repo",
+			"org.osbuild.ostree.ref":   "fedora/devel:fedora/stable",
+			"org.osbuild.ostree.layer": "0",
+		},
+	}
+
+	ci, err := parseCommitInfo(&m)
+	if err != nil {
+		t.Fatalf("Failed to parse commit info: %v", err)
+	}
+
+	if ci.repo != "/repo" || ci.ref != "fedora/devel" || ci.target != "fedora/stable" || ci.layer != layer {
+		t.Fatalf("Unexpected commit info: %+v", ci)
+	}
+
+	m.Annotations["org.osbuild.ostree.layer"] = "1"
+	if _, err := parseCommitInfo(&m); err == nil {
+		t.Fatalf("Invalid layer should be rejected")
+	}
+
+	delete(m.Annotations, "org.osbuild.ostree.layer")
+	if _, err := parseCommitInfo(&m); err == nil {
+		t.Fatalf("Missing layer should be rejected")
+	}
+}
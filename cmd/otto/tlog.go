@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gicmo/otto/internal/ostree"
+	"github.com/gicmo/otto/internal/tlog"
+)
+
+type TransparencyConfig struct {
+	// ed25519 secret key tree heads are signed with, in the format
+	// of `ostree sign`; the log is disabled if not set
+	KeyFile string `toml:"key-file"`
+	// name of the log in its tree heads, defaults to the hostname
+	Origin string `toml:"origin"`
+}
+
+// maximum number of entries returned at once
+const maxLogEntries = 1000
+
+func (server *Server) initTransparency() error {
+	tc := server.cfg.Transparency
+
+	if tc.KeyFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(tc.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := tlog.ParseSecretKey(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", tc.KeyFile, err)
+	}
+
+	origin := tc.Origin
+	if origin == "" {
+		origin, err = os.Hostname()
+		if err != nil {
+			origin = "otto"
+		}
+	}
+
+	server.tlog, err = tlog.Open(filepath.Join(server.root, "tlog", "entries.jsonl"), origin, key)
+	return err
+}
+
+// setLoggedRef points ref of repo from previous to commit, or deletes
+// it if commit is empty, and appends the update to the transparency
+// log. If the update cannot be logged, the ref is reset, so that the
+// log neither misses an update nor has one that never happened.
+func (server *Server) setLoggedRef(repo *ostree.Repo, ref string, previous string, commit string, manifest string) error {
+	reset := func() error {
+		if previous == "" {
+			return repo.DeleteRef(ref)
+		}
+		return repo.SetRef(ref, previous)
+	}
+
+	var err error
+	if commit == "" {
+		err = repo.DeleteRef(ref)
+	} else {
+		err = repo.SetRef(ref, commit)
+	}
+	if err != nil {
+		return fmt.Errorf("could not update ref '%s': %w", ref, err)
+	}
+
+	err = server.logRefUpdate(ref, previous, commit, manifest)
+	if err != nil {
+		if rerr := reset(); rerr != nil {
+			fmt.Printf("Could not reset ref '%s' to %s: %v\n", ref, previous, rerr)
+		}
+		return fmt.Errorf("could not log update of '%s': %w", ref, err)
+	}
+
+	return nil
+}
+
+// logRefUpdate appends the update of ref to the transparency log,
+// if it is enabled
+func (server *Server) logRefUpdate(ref string, previous string, commit string, manifest string) error {
+	if server.tlog == nil {
+		return nil
+	}
+
+	_, err := server.tlog.Append(tlog.Entry{
+		Ref:      ref,
+		Previous: previous,
+		Commit:   commit,
+		Manifest: manifest,
+		Time:     time.Now(),
+	})
+
+	return err
+}
+
+// queryUint parses the query parameter name, which is def if missing
+func queryUint(r *http.Request, name string, def uint64) (uint64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: '%s'", name, value)
+	}
+
+	return n, nil
+}
+
+// requireLog responds with an error if the log is not enabled
+func (server *Server) requireLog(w http.ResponseWriter) bool {
+	if server.tlog == nil {
+		http.Error(w, "transparency log not enabled", http.StatusNotFound)
+		return false
+	}
+	return true
+}
+
+// logVisible returns which refs the client of r may see the entries
+// of, or false if none: with device groups, the entries would reveal
+// the refs that are hidden from devices and anonymous clients, so
+// devices only see those of their group and anonymous clients none.
+// Tree heads and consistency proofs do not reveal any refs.
+func (server *Server) logVisible(r *http.Request) (func(ref string) bool, bool) {
+	all := func(ref string) bool { return true }
+
+	if len(server.cfg.Auth.Devices.Groups) == 0 {
+		return all, true
+	}
+
+	if group, ok := server.cfg.Auth.Devices.Group(DeviceGroupFromRequest(r)); ok {
+		return func(ref string) bool { return matchAny(group.Refs, ref) }, true
+	}
+
+	if IdentityFromRequest(r) != "" || ClientSubject(r) != "" {
+		return all, true
+	}
+
+	return nil, false
+}
+
+// GetTreeHead returns the signed tree head of the log
+func (server *Server) GetTreeHead(w http.ResponseWriter, r *http.Request) {
+	if !server.requireLog(w) {
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, server.tlog.TreeHead(time.Now()))
+}
+
+// GetLogKey returns the public key of the log, base64 encoded
+func (server *Server) GetLogKey(w http.ResponseWriter, r *http.Request) {
+	if !server.requireLog(w) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := fmt.Fprintln(w, base64.StdEncoding.EncodeToString(server.tlog.PublicKey()))
+	if err != nil {
+		fmt.Printf("i/o error: %v", err)
+	}
+}
+
+// GetLogEntries returns the entries from "start" up to, but
+// excluding, "end" that the client may see
+func (server *Server) GetLogEntries(w http.ResponseWriter, r *http.Request) {
+	if !server.requireLog(w) {
+		return
+	}
+
+	visible, ok := server.logVisible(r)
+	if !ok {
+		http.Error(w, "log entries are only visible to authenticated clients and devices", http.StatusForbidden)
+		return
+	}
+
+	start, err := queryUint(r, "start", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	end, err := queryUint(r, "end", start+maxLogEntries)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if end > start+maxLogEntries {
+		end = start + maxLogEntries
+	}
+
+	entries, err := server.tlog.Entries(start, end)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// the indices of the entries reveal the gaps, but not the refs
+	res := make([]tlog.LeafEntry, 0, len(entries))
+	for _, e := range entries {
+		if visible(e.Entry.Ref) {
+			res = append(res, e)
+		}
+	}
+
+	WriteJSON(w, http.StatusOK, res)
+}
+
+// GetInclusionProof returns the proof that the entry at "index", or
+// the entry that updated "ref" to "commit", is included in the tree of
+// "size", which defaults to the current size; only for entries the
+// client may see
+func (server *Server) GetInclusionProof(w http.ResponseWriter, r *http.Request) {
+	if !server.requireLog(w) {
+		return
+	}
+
+	visible, ok := server.logVisible(r)
+	if !ok {
+		http.Error(w, "log entries are only visible to authenticated clients and devices", http.StatusForbidden)
+		return
+	}
+
+	size, err := queryUint(r, "size", server.tlog.Size())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var index uint64
+
+	q := r.URL.Query()
+	if ref, commit := q.Get("ref"), q.Get("commit"); ref != "" || commit != "" {
+		var ok bool
+
+		index, ok = server.tlog.Find(ref, commit)
+		if !ok {
+			http.Error(w, fmt.Sprintf("no entry for %s on '%s'", commit, ref), http.StatusNotFound)
+			return
+		}
+	} else {
+		index, err = queryUint(r, "index", 0)
+		if err != nil || q.Get("index") == "" {
+			http.Error(w, "index or ref and commit required", http.StatusBadRequest)
+			return
+		}
+	}
+
+	proof, err := server.tlog.InclusionProof(index, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := server.tlog.Entries(index, index+1)
+	if err != nil || len(entries) != 1 || !visible(entries[0].Entry.Ref) {
+		http.Error(w, "entry not found", http.StatusNotFound)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"index":      index,
+		"tree_size":  size,
+		"leaf_input": entries[0].Leaf,
+		"entry":      entries[0].Entry,
+		"audit_path": proof,
+	})
+}
+
+// GetConsistencyProof returns the proof that the tree of size "first"
+// is a prefix of the tree of size "second", which defaults to the
+// current size
+func (server *Server) GetConsistencyProof(w http.ResponseWriter, r *http.Request) {
+	if !server.requireLog(w) {
+		return
+	}
+
+	first, err := queryUint(r, "first", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	second, err := queryUint(r, "second", server.tlog.Size())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	proof, err := server.tlog.ConsistencyProof(first, second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]interface{}{
+		"first":       first,
+		"second":      second,
+		"consistency": proof,
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gicmo/otto/internal/tlog"
+	"github.com/go-chi/chi/v5"
+)
+
+func TestTransparencyLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	keyFile := filepath.Join(tmp, "tlog.secret")
+	err = ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(sk)+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	server := &Server{cfg: &cfg, root: tmp}
+
+	router := chi.NewRouter()
+	router.Get("/tlog/head", server.GetTreeHead)
+	router.Get("/tlog/key", server.GetLogKey)
+	router.Get("/tlog/entries", server.GetLogEntries)
+	router.Get("/tlog/proof/inclusion", server.GetInclusionProof)
+	router.Get("/tlog/proof/consistency", server.GetConsistencyProof)
+
+	get := func(path string, res interface{}) int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+
+		if res != nil && w.Code == http.StatusOK {
+			err := json.Unmarshal(w.Body.Bytes(), res)
+			if err != nil {
+				t.Fatalf("Invalid response for %s: %v", path, err)
+			}
+		}
+
+		return w.Code
+	}
+
+	// disabled
+	if code := get("/tlog/head", nil); code != http.StatusNotFound {
+		t.Fatalf("Log should be disabled: %d", code)
+	}
+
+	cfg.Transparency.KeyFile = keyFile
+	cfg.Transparency.Origin = "otto.example.com"
+
+	err = server.initTransparency()
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	commit := func(i int) string {
+		return fmt.Sprintf("%064x", i)
+	}
+
+	for i := 1; i <= 3; i++ {
+		err = server.logRefUpdate("fedora/x86_64/iot", commit(i-1), commit(i), "")
+		if err != nil {
+			t.Fatalf("Failed to log update: %v", err)
+		}
+	}
+
+	var old tlog.SignedTreeHead
+	get("/tlog/head", &old)
+
+	for i := 4; i <= 6; i++ {
+		err = server.logRefUpdate("fedora/x86_64/iot", commit(i-1), commit(i), "sha256:"+commit(i))
+		if err != nil {
+			t.Fatalf("Failed to log update: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/tlog/key", nil))
+	pk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(w.Body.String()))
+	if err != nil || len(pk) != ed25519.PublicKeySize {
+		t.Fatalf("Invalid public key: %v", err)
+	}
+
+	var sth tlog.SignedTreeHead
+	if code := get("/tlog/head", &sth); code != http.StatusOK {
+		t.Fatalf("Failed to get tree head: %d", code)
+	}
+
+	if sth.Size != 6 || sth.Origin != "otto.example.com" || sth.Verify(pk) != nil {
+		t.Fatalf("Invalid tree head: %+v", sth)
+	}
+
+	// a device checks that the commit it got was logged
+	var inclusion struct {
+		Index     uint64      `json:"index"`
+		TreeSize  uint64      `json:"tree_size"`
+		Leaf      []byte      `json:"leaf_input"`
+		Entry     tlog.Entry  `json:"entry"`
+		AuditPath []tlog.Hash `json:"audit_path"`
+	}
+
+	path := fmt.Sprintf("/tlog/proof/inclusion?ref=fedora/x86_64/iot&commit=%s&size=%d", commit(5), sth.Size)
+	if code := get(path, &inclusion); code != http.StatusOK {
+		t.Fatalf("Failed to get inclusion proof: %d", code)
+	}
+
+	if inclusion.Index != 4 || inclusion.Entry.Commit != commit(5) || inclusion.Entry.Manifest != "sha256:"+commit(5) {
+		t.Fatalf("Unexpected entry: %+v", inclusion)
+	}
+
+	err = tlog.VerifyInclusion(tlog.LeafHash(inclusion.Leaf), inclusion.Index, sth.Size, inclusion.AuditPath, sth.Root)
+	if err != nil {
+		t.Fatalf("Inclusion proof does not verify: %v", err)
+	}
+
+	// an auditor checks that the log only grew
+	var consistency struct {
+		Proof []tlog.Hash `json:"consistency"`
+	}
+
+	path = fmt.Sprintf("/tlog/proof/consistency?first=%d&second=%d", old.Size, sth.Size)
+	if code := get(path, &consistency); code != http.StatusOK {
+		t.Fatalf("Failed to get consistency proof: %d", code)
+	}
+
+	err = tlog.VerifyConsistency(old.Size, sth.Size, consistency.Proof, old.Root, sth.Root)
+	if err != nil {
+		t.Fatalf("Consistency proof does not verify: %v", err)
+	}
+
+	var entries []tlog.LeafEntry
+	if code := get("/tlog/entries?start=2&end=4", &entries); code != http.StatusOK || len(entries) != 2 {
+		t.Fatalf("Unexpected entries: %d %v", code, entries)
+	}
+
+	for _, path := range []string{
+		"/tlog/proof/inclusion",
+		"/tlog/proof/inclusion?index=x",
+		"/tlog/proof/inclusion?index=6",
+		"/tlog/proof/consistency?first=1&second=7",
+		"/tlog/entries?start=5&end=2",
+	} {
+		if code := get(path, nil); code != http.StatusBadRequest {
+			t.Errorf("%s: expected bad request, got %d", path, code)
+		}
+	}
+
+	if code := get("/tlog/proof/inclusion?ref=other&commit="+commit(1), nil); code != http.StatusNotFound {
+		t.Errorf("Unknown entries should not be found, got %d", code)
+	}
+}
+
+func TestTransparencyLogVisibility(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	keyFile := filepath.Join(tmp, "tlog.secret")
+	err = ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(sk)+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	cfg := OttoConfig{}
+	cfg.Transparency.KeyFile = keyFile
+	cfg.Auth.Devices.Groups = []DeviceGroupConfig{{Name: "acme", Refs: []string{"acme/*/*"}}}
+	server := &Server{cfg: &cfg, root: tmp}
+
+	err = server.initTransparency()
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	refs := []string{"acme/x86_64/iot", "other/x86_64/iot", StagingRef("acme/x86_64/iot")}
+	for i, ref := range refs {
+		err = server.logRefUpdate(ref, "", fmt.Sprintf("%064x", i), "")
+		if err != nil {
+			t.Fatalf("Failed to log update: %v", err)
+		}
+	}
+
+	anonymous := func(r *http.Request) *http.Request { return r }
+	device := func(r *http.Request) *http.Request {
+		ctx := context.WithValue(r.Context(), deviceGroupKey{}, "acme")
+		return WithIdentity(r.WithContext(ctx), "d1")
+	}
+	admin := func(r *http.Request) *http.Request { return WithIdentity(r, "admin") }
+
+	entries := func(as func(*http.Request) *http.Request) (int, []tlog.LeafEntry) {
+		w := httptest.NewRecorder()
+		server.GetLogEntries(w, as(httptest.NewRequest("GET", "/tlog/entries", nil)))
+
+		var res []tlog.LeafEntry
+		if w.Code == http.StatusOK {
+			_ = json.Unmarshal(w.Body.Bytes(), &res)
+		}
+		return w.Code, res
+	}
+
+	proof := func(as func(*http.Request) *http.Request, index int) int {
+		w := httptest.NewRecorder()
+		server.GetInclusionProof(w, as(httptest.NewRequest("GET", fmt.Sprintf("/tlog/proof/inclusion?index=%d", index), nil)))
+		return w.Code
+	}
+
+	if code, _ := entries(anonymous); code != http.StatusForbidden {
+		t.Fatalf("Anonymous clients should not see entries, got: %d", code)
+	}
+
+	if code := proof(anonymous, 0); code != http.StatusForbidden {
+		t.Fatalf("Anonymous clients should not get inclusion proofs, got: %d", code)
+	}
+
+	// the tree head reveals no refs
+	w := httptest.NewRecorder()
+	server.GetTreeHead(w, httptest.NewRequest("GET", "/tlog/head", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Tree head should be public, got: %d", w.Code)
+	}
+
+	code, res := entries(device)
+	if code != http.StatusOK || len(res) != 1 || res[0].Entry.Ref != refs[0] {
+		t.Fatalf("Devices should only see the entries of their group: %d %v", code, res)
+	}
+
+	if proof(device, 0) != http.StatusOK || proof(device, 1) != http.StatusNotFound || proof(device, 2) != http.StatusNotFound {
+		t.Fatalf("Devices should only get proofs for the entries of their group")
+	}
+
+	if code, res := entries(admin); code != http.StatusOK || len(res) != len(refs) {
+		t.Fatalf("Authenticated clients should see all entries: %d %v", code, res)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/gicmo/otto/internal/ostree"
+)
+
+func (vc VerifyConfig) TrustStore() (*ostree.TrustStore, error) {
+	trust := &ostree.TrustStore{
+		GPGKeyrings: vc.GPGKeyrings,
+	}
+
+	keys, err := ostree.ParseEd25519Keys([]byte(strings.Join(vc.Ed25519Keys, "\n")))
+	if err != nil {
+		return nil, err
+	}
+	trust.Ed25519Keys = keys
+
+	if vc.Ed25519KeysFile != "" {
+		data, err := ioutil.ReadFile(vc.Ed25519KeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		keys, err = ostree.ParseEd25519Keys(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", vc.Ed25519KeysFile, err)
+		}
+		trust.Ed25519Keys = append(trust.Ed25519Keys, keys...)
+	}
+
+	return trust, nil
+}
+
+// checkSignature verifies the commit in the image, before it is
+// pulled, like `pull-local --gpg-verify` would
+func checkSignature(server *Server, ic *importContext) error {
+	trust, err := ic.rc.Verify.TrustStore()
+	if err != nil {
+		return fmt.Errorf("invalid trust store: %w", err)
+	}
+
+	// promoted commits are already in the repo
+	repo := ic.source
+	if repo == nil {
+		repo = ic.repo
+	}
+
+	sigs, err := repo.VerifyCommit(ic.commit, trust)
+	if err != nil {
+		return err
+	}
+
+	if len(sigs) == 0 {
+		return fmt.Errorf("commit %s is not signed", ic.commit)
+	}
+
+	var details []string
+	for _, sig := range sigs {
+		if sig.Valid {
+			fmt.Printf("Commit %s has a valid signature: %s\n", ic.commit, sig)
+			return nil
+		}
+		details = append(details, sig.String())
+	}
+
+	return fmt.Errorf("no valid signature from a trusted key: %s", strings.Join(details, "; "))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTrustStore(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	a, _, _ := ed25519.GenerateKey(nil)
+	b, _, _ := ed25519.GenerateKey(nil)
+
+	keysFile := filepath.Join(tmp, "ed25519.pub")
+	data := "# build system\n" + base64.StdEncoding.EncodeToString(b) + "\n"
+	err = ioutil.WriteFile(keysFile, []byte(data), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write keys: %v", err)
+	}
+
+	vc := VerifyConfig{
+		GPGKeyrings:     []string{"/etc/otto/trusted.gpg"},
+		Ed25519Keys:     []string{base64.StdEncoding.EncodeToString(a)},
+		Ed25519KeysFile: keysFile,
+	}
+
+	trust, err := vc.TrustStore()
+	if err != nil {
+		t.Fatalf("Failed to create trust store: %v", err)
+	}
+
+	if len(trust.Ed25519Keys) != 2 || !trust.Ed25519Keys[0].Equal(a) || !trust.Ed25519Keys[1].Equal(b) {
+		t.Fatalf("Unexpected keys: %v", trust.Ed25519Keys)
+	}
+
+	if len(trust.GPGKeyrings) != 1 {
+		t.Fatalf("Unexpected keyrings: %v", trust.GPGKeyrings)
+	}
+
+	vc.Ed25519Keys = []string{"invalid"}
+	if _, err := vc.TrustStore(); err == nil {
+		t.Fatalf("Invalid key should be rejected")
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version schemes for comparing the ostree.version of commits
+const (
+	VersionRPM    = "rpm"
+	VersionSemver = "semver"
+)
+
+// CompareVersions compares a and b with the given scheme and returns
+// -1, 0 or 1 if a is older, equal or newer than b
+func CompareVersions(scheme string, a string, b string) (int, error) {
+	switch scheme {
+	case "", VersionRPM:
+		return rpmvercmp(a, b), nil
+	case VersionSemver:
+		return semvercmp(a, b)
+	}
+
+	return 0, fmt.Errorf("unknown version scheme '%s'", scheme)
+}
+
+func isAlnum(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func compareStrings(a string, b string) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareNumeric compares two strings of digits of any length
+func compareNumeric(a string, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+
+	return compareStrings(a, b)
+}
+
+// rpmvercmp compares versions like rpm does, see rpmvercmp(3)
+func rpmvercmp(a string, b string) int {
+	if a == b {
+		return 0
+	}
+
+	for len(a) > 0 || len(b) > 0 {
+		for len(a) > 0 && !isAlnum(a[0]) && a[0] != '~' && a[0] != '^' {
+			a = a[1:]
+		}
+		for len(b) > 0 && !isAlnum(b[0]) && b[0] != '~' && b[0] != '^' {
+			b = b[1:]
+		}
+
+		// a tilde sorts before everything, even the end of a version
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		// a caret sorts after the end of a version, but before
+		// anything else
+		if strings.HasPrefix(a, "^") || strings.HasPrefix(b, "^") {
+			if len(a) == 0 {
+				return -1
+			}
+			if len(b) == 0 {
+				return 1
+			}
+			if !strings.HasPrefix(a, "^") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "^") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if len(a) == 0 || len(b) == 0 {
+			break
+		}
+
+		numeric := isDigit(a[0])
+		segment := func(s string) (string, string) {
+			i := 0
+			for i < len(s) && isAlnum(s[i]) && isDigit(s[i]) == numeric {
+				i++
+			}
+			return s[:i], s[i:]
+		}
+
+		var sa, sb string
+		sa, a = segment(a)
+		sb, b = segment(b)
+
+		// numeric segments are newer than alphabetic ones
+		if len(sb) == 0 {
+			if numeric {
+				return 1
+			}
+			return -1
+		}
+
+		var res int
+		if numeric {
+			res = compareNumeric(sa, sb)
+		} else {
+			res = compareStrings(sa, sb)
+		}
+
+		if res != 0 {
+			return res
+		}
+	}
+
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return -1
+	}
+	return 1
+}
+
+type semver struct {
+	core       [3]string
+	prerelease []string
+}
+
+func parseSemver(v string) (semver, error) {
+	var res semver
+
+	s := strings.TrimPrefix(v, "v")
+
+	if i := strings.Index(s, "+"); i != -1 {
+		s = s[:i]
+	}
+
+	if i := strings.Index(s, "-"); i != -1 {
+		res.prerelease = strings.Split(s[i+1:], ".")
+		s = s[:i]
+	}
+
+	core := strings.Split(s, ".")
+	if len(core) != 3 {
+		return res, fmt.Errorf("invalid semantic version '%s'", v)
+	}
+
+	for i, n := range core {
+		if _, err := strconv.ParseUint(n, 10, 64); err != nil {
+			return res, fmt.Errorf("invalid semantic version '%s'", v)
+		}
+		res.core[i] = n
+	}
+
+	for _, id := range res.prerelease {
+		if id == "" {
+			return res, fmt.Errorf("invalid semantic version '%s'", v)
+		}
+	}
+
+	return res, nil
+}
+
+func isNumeric(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// semvercmp compares semantic versions, see https://semver.org
+func semvercmp(a string, b string) (int, error) {
+	va, err := parseSemver(a)
+	if err != nil {
+		return 0, err
+	}
+
+	vb, err := parseSemver(b)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range va.core {
+		if res := compareNumeric(va.core[i], vb.core[i]); res != 0 {
+			return res, nil
+		}
+	}
+
+	// a pre-release is older than the release itself
+	switch {
+	case len(va.prerelease) == 0 && len(vb.prerelease) == 0:
+		return 0, nil
+	case len(va.prerelease) == 0:
+		return 1, nil
+	case len(vb.prerelease) == 0:
+		return -1, nil
+	}
+
+	for i := 0; i < len(va.prerelease) && i < len(vb.prerelease); i++ {
+		ia, ib := va.prerelease[i], vb.prerelease[i]
+
+		var res int
+		switch {
+		case isNumeric(ia) && isNumeric(ib):
+			res = compareNumeric(ia, ib)
+		case isNumeric(ia):
+			res = -1
+		case isNumeric(ib):
+			res = 1
+		default:
+			res = compareStrings(ia, ib)
+		}
+
+		if res != 0 {
+			return res, nil
+		}
+	}
+
+	switch {
+	case len(va.prerelease) < len(vb.prerelease):
+		return -1, nil
+	case len(va.prerelease) > len(vb.prerelease):
+		return 1, nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRPMVerCmp(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "2.0", -1},
+		{"2.0.1", "2.0", 1},
+		{"36.20220618.0", "36.20220617.1", 1},
+		{"36.20220618.0", "36.20220618.1", -1},
+		{"37.20220101.0", "36.20221231.0", 1},
+		{"1.010", "1.9", 1},
+		{"1.05", "1.5", 0},
+		{"1.0a", "1.0", 1},
+		{"1a", "1.0", -1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0~rc1", "1.0~rc2", -1},
+		{"1.0^git1", "1.0", 1},
+		{"1.0^git1", "1.0.1", -1},
+		{"1.0_1", "1.0.1", 0},
+		{"a", "1", -1},
+	}
+
+	for _, tt := range tests {
+		if have := rpmvercmp(tt.a, tt.b); have != tt.want {
+			t.Errorf("rpmvercmp(%s, %s): want %d, have %d", tt.a, tt.b, tt.want, have)
+		}
+		if have := rpmvercmp(tt.b, tt.a); have != -tt.want {
+			t.Errorf("rpmvercmp(%s, %s): want %d, have %d", tt.b, tt.a, -tt.want, have)
+		}
+	}
+}
+
+func TestSemverCmp(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"v1.0.0", "1.0.0+build5", 0},
+		{"1.0.0", "1.0.1", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+	}
+
+	for _, tt := range tests {
+		have, err := semvercmp(tt.a, tt.b)
+		if err != nil || have != tt.want {
+			t.Errorf("semvercmp(%s, %s): want %d, have %d (%v)", tt.a, tt.b, tt.want, have, err)
+		}
+	}
+
+	for _, v := range []string{"1.0", "1.0.0.0", "1.x.0", "1.0.0-", "1.0.0-a..b"} {
+		if _, err := semvercmp(v, "1.0.0"); err == nil {
+			t.Errorf("semvercmp(%s): expected error", v)
+		}
+	}
+
+	if _, err := CompareVersions("calver", "1", "2"); err == nil {
+		t.Errorf("Unknown scheme should fail")
+	}
+}
@@ -8,4 +8,5 @@ require (
 	github.com/google/uuid v1.2.0
 	github.com/opencontainers/go-digest v1.0.0
 	github.com/opencontainers/image-spec v1.0.1
+	golang.org/x/crypto v0.0.0-20211117183948-ae814b36b871
 )
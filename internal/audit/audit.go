@@ -0,0 +1,327 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// An append-only log of events as JSON lines. If chaining is enabled,
+// every event includes the hash of the previous one and its own hash,
+// so that changes to, or removal of, events can be detected.
+
+type Outcome string
+
+const (
+	OutcomeSuccess Outcome = "success"
+	OutcomeFailure Outcome = "failure"
+	OutcomeDenied  Outcome = "denied"
+)
+
+type Event struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+
+	// who did it, from where
+	Identity string `json:"identity,omitempty"`
+	Source   string `json:"source,omitempty"`
+
+	Outcome Outcome `json:"outcome"`
+	Message string  `json:"message,omitempty"`
+
+	Repository string `json:"repository,omitempty"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+	Ref        string `json:"ref,omitempty"`
+	Commit     string `json:"commit,omitempty"`
+	Previous   string `json:"previous,omitempty"`
+
+	// hash of the previous event and of this one, if chained
+	Prev string `json:"prev,omitempty"`
+	Hash string `json:"hash,omitempty"`
+}
+
+// hash returns the hash of the event, without its own hash
+func (e Event) hash() (string, error) {
+	e.Hash = ""
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+type Log struct {
+	mu    sync.Mutex
+	path  string
+	chain bool
+
+	seq  uint64
+	last string
+}
+
+// Open opens the log at path, creating it if needed
+func Open(path string, chain bool) (*Log, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		path:  path,
+		chain: chain,
+	}
+
+	// continue the sequence, and the chain, of existing events
+	err = l.scan(func(e *Event) bool {
+		l.seq = e.Seq
+		l.last = e.Hash
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *Log) Path() string {
+	return l.path
+}
+
+func (l *Log) scan(fn func(e *Event) bool) error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return scan(f, fn)
+}
+
+func scan(r io.Reader, fn func(e *Event) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+
+		var e Event
+		err := json.Unmarshal(data, &e)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if !fn(&e) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+// Append adds the event to the log, the sequence number, the time,
+// if not set, and the hashes are filled in
+func (l *Log) Append(e Event) (Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Seq = l.seq + 1
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+	e.Prev, e.Hash = "", ""
+
+	if l.chain {
+		var err error
+
+		e.Prev = l.last
+		e.Hash, err = e.hash()
+		if err != nil {
+			return e, err
+		}
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return e, err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return e, err
+	}
+
+	_, err = f.Write(append(data, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return e, err
+	}
+
+	l.seq = e.Seq
+	l.last = e.Hash
+
+	return e, nil
+}
+
+type Filter struct {
+	Since time.Time
+	Until time.Time
+
+	// ref name or pattern
+	Ref      string
+	Action   string
+	Identity string
+
+	// only the last events, all if zero
+	Limit int
+}
+
+func (f *Filter) Match(e *Event) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+
+	if f.Ref != "" {
+		if ok, _ := path.Match(f.Ref, e.Ref); !ok {
+			return false
+		}
+	}
+
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+
+	if f.Identity != "" && e.Identity != f.Identity {
+		return false
+	}
+
+	return true
+}
+
+// Query returns the events that match the filter, oldest first
+func (l *Log) Query(f Filter) ([]Event, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	res := []Event{}
+
+	err := l.scan(func(e *Event) bool {
+		if f.Match(e) {
+			res = append(res, *e)
+		}
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Limit > 0 && len(res) > f.Limit {
+		res = res[len(res)-f.Limit:]
+	}
+
+	return res, nil
+}
+
+// Verify checks the sequence numbers and the hash chain of the events
+// read from r and returns the number of events
+func Verify(r io.Reader) (uint64, error) {
+	var n uint64
+	var last string
+	var err error
+
+	serr := scan(r, func(e *Event) bool {
+		n++
+
+		if e.Seq != n {
+			err = fmt.Errorf("event %d: unexpected sequence number %d", n, e.Seq)
+			return false
+		}
+
+		// chaining might have been enabled later, but not disabled,
+		// otherwise events could be changed after removing the hash
+		if e.Hash == "" {
+			if last != "" {
+				err = fmt.Errorf("event %d: not chained", e.Seq)
+				return false
+			}
+			return true
+		}
+
+		if e.Prev != last {
+			err = fmt.Errorf("event %d: chain broken", e.Seq)
+			return false
+		}
+
+		var h string
+		h, err = e.hash()
+		if err != nil {
+			return false
+		}
+
+		if h != e.Hash {
+			err = fmt.Errorf("event %d: hash mismatch", e.Seq)
+			return false
+		}
+
+		last = e.Hash
+		return true
+	})
+
+	if serr != nil {
+		return n, serr
+	}
+
+	return n, err
+}
+
+// Verify checks the sequence numbers and the hash chain of the log
+func (l *Log) Verify() (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return Verify(f)
+}
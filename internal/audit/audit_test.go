@@ -0,0 +1,151 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "audit", "audit.jsonl")
+
+	l, err := Open(path, true)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	start := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	events := []Event{
+		{Action: "manifest-push", Identity: "builder", Repository: "iot"},
+		{Action: "import", Identity: "builder", Ref: "fedora/x86_64/iot", Commit: "abc"},
+		{Action: "ref-update", Identity: "builder", Ref: "fedora/x86_64/iot", Commit: "abc"},
+		{Action: "promote", Identity: "alice", Ref: "fedora/x86_64/iot-stable", Commit: "abc"},
+	}
+
+	for i, e := range events {
+		e.Time = start.Add(time.Duration(i) * time.Hour)
+
+		have, err := l.Append(e)
+		if err != nil {
+			t.Fatalf("Failed to append event: %v", err)
+		}
+
+		if have.Seq != uint64(i+1) || have.Hash == "" {
+			t.Fatalf("Unexpected event: %+v", have)
+		}
+	}
+
+	// reopening continues the sequence and the chain
+	l, err = Open(path, true)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+
+	last, err := l.Append(Event{Action: "commit-delete", Commit: "old", Time: start.Add(5 * time.Hour)})
+	if err != nil || last.Seq != 5 {
+		t.Fatalf("Unexpected event after reopening: %+v, %v", last, err)
+	}
+
+	n, err := l.Verify()
+	if err != nil || n != 5 {
+		t.Fatalf("Verification failed: %d, %v", n, err)
+	}
+
+	tests := []struct {
+		filter Filter
+		seqs   []uint64
+	}{
+		{Filter{}, []uint64{1, 2, 3, 4, 5}},
+		{Filter{Ref: "fedora/x86_64/iot"}, []uint64{2, 3}},
+		{Filter{Ref: "fedora/*/*"}, []uint64{2, 3, 4}},
+		{Filter{Action: "promote"}, []uint64{4}},
+		{Filter{Identity: "builder", Limit: 2}, []uint64{2, 3}},
+		{Filter{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, []uint64{2, 3, 4}},
+	}
+
+	for i, tt := range tests {
+		res, err := l.Query(tt.filter)
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		var seqs []uint64
+		for _, e := range res {
+			seqs = append(seqs, e.Seq)
+		}
+
+		if len(seqs) != len(tt.seqs) {
+			t.Errorf("%d: expected %v, got %v", i, tt.seqs, seqs)
+			continue
+		}
+
+		for j := range seqs {
+			if seqs[j] != tt.seqs[j] {
+				t.Errorf("%d: expected %v, got %v", i, tt.seqs, seqs)
+				break
+			}
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "audit.jsonl")
+
+	l, err := Open(path, true)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	for _, identity := range []string{"alice", "bob", "carol"} {
+		_, err = l.Append(Event{Action: "ref-update", Identity: identity, Ref: "iot"})
+		if err != nil {
+			t.Fatalf("Failed to append event: %v", err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+
+	lines := strings.SplitAfter(strings.TrimSpace(string(data)), "\n")
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"changed", strings.Replace(string(data), `"bob"`, `"mallory"`, 1)},
+		{"removed", lines[0] + lines[2]},
+		{"reordered", lines[1] + lines[0] + lines[2]},
+		{"unchained", strings.Replace(string(data), lines[2], `{"seq":3,"time":"2021-06-01T12:00:00Z","action":"ref-update","outcome":"success"}`, 1)},
+	}
+
+	for _, tt := range tests {
+		_, err := Verify(bytes.NewReader([]byte(tt.data)))
+		if err == nil {
+			t.Errorf("%s: tampering should be detected", tt.name)
+		}
+	}
+
+	n, err := Verify(bytes.NewReader(data))
+	if err != nil || n != 3 {
+		t.Fatalf("Untampered log should verify: %d, %v", n, err)
+	}
+}
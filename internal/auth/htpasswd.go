@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd checks credentials against an htpasswd file with bcrypt
+// hashes, as created by `htpasswd -B`. The file is re-read whenever
+// it changes.
+type Htpasswd struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	users   map[string][]byte
+
+	// credentials that were verified before, to avoid running bcrypt
+	// for every request of a client
+	verified map[string][sha256.Size]byte
+}
+
+// used for unknown users, so that they take as long as known ones
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("otto"), bcrypt.DefaultCost)
+
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{
+		Path: path,
+	}
+
+	err := h.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+func parseHtpasswd(data []byte) (map[string][]byte, error) {
+	users := make(map[string][]byte)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d: invalid entry", n)
+		}
+
+		user, hash := line[:i], line[i+1:]
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: '%s' does not use bcrypt", n, user)
+		}
+
+		users[user] = []byte(hash)
+	}
+
+	return users, scanner.Err()
+}
+
+// reload re-reads the file if it changed; the caller must hold h.mu
+// or have exclusive access otherwise
+func (h *Htpasswd) reload() error {
+	st, err := os.Stat(h.Path)
+	if err != nil {
+		return err
+	}
+
+	if st.ModTime().Equal(h.modTime) && st.Size() == h.size && h.users != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(h.Path)
+	if err != nil {
+		return err
+	}
+
+	users, err := parseHtpasswd(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.Path, err)
+	}
+
+	h.users = users
+	h.verified = make(map[string][sha256.Size]byte)
+	h.modTime = st.ModTime()
+	h.size = st.Size()
+
+	return nil
+}
+
+// Verify checks the password of user
+func (h *Htpasswd) Verify(user string, password string) bool {
+	h.mu.Lock()
+
+	err := h.reload()
+	if err != nil {
+		// keep using the last good version
+		fmt.Printf("Could not reload htpasswd: %v\n", err)
+	}
+
+	hash, known := h.users[user]
+	sum := sha256.Sum256([]byte(user + ":" + password))
+
+	if known {
+		if verified, ok := h.verified[user]; ok && verified == sum {
+			h.mu.Unlock()
+			return true
+		}
+	} else {
+		hash = dummyHash
+	}
+
+	h.mu.Unlock()
+
+	err = bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if err != nil || !known {
+		return false
+	}
+
+	h.mu.Lock()
+	// the file could have been reloaded in the meantime
+	if current, ok := h.users[user]; ok && bytes.Equal(current, hash) {
+		h.verified[user] = sum
+	}
+	h.mu.Unlock()
+
+	return true
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeHtpasswd(t *testing.T, path string, users map[string]string) {
+	data := "# otto users\n"
+
+	for user, password := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+		if err != nil {
+			t.Fatalf("Failed to hash password: %v", err)
+		}
+		data += fmt.Sprintf("%s:%s\n", user, hash)
+	}
+
+	err := ioutil.WriteFile(path, []byte(data), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write htpasswd: %v", err)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "htpasswd")
+
+	_, err = NewHtpasswd(path)
+	if err == nil {
+		t.Fatalf("Missing file should be an error")
+	}
+
+	writeHtpasswd(t, path, map[string]string{"builder": "s3cret"})
+
+	h, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatalf("Failed to load htpasswd: %v", err)
+	}
+
+	if !h.Verify("builder", "s3cret") {
+		t.Fatalf("Valid credentials should verify")
+	}
+
+	// a second time, from the cache
+	if !h.Verify("builder", "s3cret") {
+		t.Fatalf("Valid credentials should verify")
+	}
+
+	if h.Verify("builder", "wrong") || h.Verify("nobody", "s3cret") || h.Verify("", "") {
+		t.Fatalf("Invalid credentials should not verify")
+	}
+
+	writeHtpasswd(t, path, map[string]string{"builder": "changed", "admin": "admin"})
+
+	// make sure the modification time changes
+	later := time.Now().Add(time.Second)
+	err = os.Chtimes(path, later, later)
+	if err != nil {
+		t.Fatalf("Failed to change time: %v", err)
+	}
+
+	if h.Verify("builder", "s3cret") {
+		t.Fatalf("Old password should not verify after reload")
+	}
+
+	if !h.Verify("builder", "changed") || !h.Verify("admin", "admin") {
+		t.Fatalf("New credentials should verify after reload")
+	}
+}
+
+func TestParseHtpasswd(t *testing.T) {
+	_, err := parseHtpasswd([]byte("user:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"))
+	if err == nil {
+		t.Fatalf("Only bcrypt should be supported")
+	}
+
+	_, err = parseHtpasswd([]byte("no-colon\n"))
+	if err == nil {
+		t.Fatalf("Invalid line should be rejected")
+	}
+}
@@ -0,0 +1,105 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pre-signed URLs: the query parameters carry a path prefix, an
+// optional scope, an expiry and an HMAC-SHA256 over all of them, which
+// grants access to every path below the prefix until the expiry. The
+// scope is not interpreted here, it further limits what the holder of
+// the url may see, e.g. to the refs of a group.
+
+var ErrInvalidSignature = errors.New("invalid url signature")
+
+const (
+	presignPrefix    = "prefix"
+	presignScope     = "scope"
+	presignExpires   = "expires"
+	presignSignature = "signature"
+)
+
+type URLSigner struct {
+	key []byte
+}
+
+// NewURLSigner returns a signer with the secret key, which must be
+// at least 32 bytes
+func NewURLSigner(key []byte) (*URLSigner, error) {
+	if len(key) < 32 {
+		return nil, fmt.Errorf("url signing key must be at least 32 bytes")
+	}
+
+	return &URLSigner{key: key}, nil
+}
+
+func (us *URLSigner) mac(prefix string, scope string, expires int64) string {
+	mac := hmac.New(sha256.New, us.key)
+	fmt.Fprintf(mac, "%s\n%s\n%d", prefix, scope, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign returns the query parameters that grant access to paths
+// below prefix, limited to scope if it is not empty, until expires
+func (us *URLSigner) Sign(prefix string, scope string, expires time.Time) url.Values {
+	q := url.Values{}
+	q.Set(presignPrefix, prefix)
+	if scope != "" {
+		q.Set(presignScope, scope)
+	}
+	q.Set(presignExpires, strconv.FormatInt(expires.Unix(), 10))
+	q.Set(presignSignature, us.mac(prefix, scope, expires.Unix()))
+	return q
+}
+
+// IsSigned checks if the query carries a signature
+func IsSigned(query url.Values) bool {
+	return query.Get(presignSignature) != ""
+}
+
+// Scope returns the scope of a signed query; it can only be trusted
+// after the query was verified
+func Scope(query url.Values) string {
+	return query.Get(presignScope)
+}
+
+// Verify checks that the query carries a valid signature, that has
+// not expired at now, for a prefix of p
+func (us *URLSigner) Verify(p string, query url.Values, now time.Time) error {
+	prefix := query.Get(presignPrefix)
+	sig := query.Get(presignSignature)
+
+	expires, err := strconv.ParseInt(query.Get(presignExpires), 10, 64)
+	if err != nil || prefix == "" || sig == "" {
+		return ErrInvalidSignature
+	}
+
+	if !hmac.Equal([]byte(sig), []byte(us.mac(prefix, query.Get(presignScope), expires))) {
+		return ErrInvalidSignature
+	}
+
+	if now.Unix() > expires {
+		return fmt.Errorf("%w: expired", ErrInvalidSignature)
+	}
+
+	// the file server cleans the path, so "prefix/../other" must
+	// not match the prefix; the prefix is matched by whole path
+	// components, so "refs/heads/foo" does not grant "refs/heads/foobar"
+	clean := path.Clean("/" + p)
+	dir := strings.TrimSuffix(prefix, "/")
+
+	if clean != dir && !strings.HasPrefix(clean, dir+"/") {
+		return fmt.Errorf("%w: path not below '%s'", ErrInvalidSignature, prefix)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	_, err := NewURLSigner([]byte("short"))
+	if err == nil {
+		t.Fatalf("Short keys should be rejected")
+	}
+
+	signer, err := NewURLSigner(bytes.Repeat([]byte("k"), 32))
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	now := time.Now()
+	query := signer.Sign("/ostree/repo/refs/heads/", "", now.Add(time.Hour))
+
+	if !IsSigned(query) {
+		t.Fatalf("Signed query should be detected")
+	}
+
+	tests := []struct {
+		path  string
+		now   time.Time
+		valid bool
+	}{
+		{"/ostree/repo/refs/heads/fedora/x86_64/iot", now, true},
+		{"/ostree/repo/refs/heads/", now, true},
+		{"/ostree/repo/refs/heads", now, true},
+		{"/ostree/repo/config", now, false},
+		{"/ostree/repo/refs/heads/../../config", now, false},
+		{"/ostree/repo/refs/heads/fedora", now.Add(2 * time.Hour), false},
+	}
+
+	for _, tt := range tests {
+		err := signer.Verify(tt.path, query, tt.now)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got: %v", tt.path, tt.valid, err)
+		}
+	}
+
+	// prefixes only match whole path components
+	query = signer.Sign("/ostree/repo/refs/heads/foo", "", now.Add(time.Hour))
+
+	tests = []struct {
+		path  string
+		now   time.Time
+		valid bool
+	}{
+		{"/ostree/repo/refs/heads/foo", now, true},
+		{"/ostree/repo/refs/heads/foo/x86_64", now, true},
+		{"/ostree/repo/refs/heads/foobar", now, false},
+	}
+
+	for _, tt := range tests {
+		err := signer.Verify(tt.path, query, tt.now)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: expected valid=%v, got: %v", tt.path, tt.valid, err)
+		}
+	}
+
+	// the prefix is covered by the signature
+	tampered := signer.Sign("/ostree/repo/refs/heads/", "", now.Add(time.Hour))
+	tampered.Set("prefix", "/ostree/repo/")
+	err = signer.Verify("/ostree/repo/config", tampered, now)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Tampered prefix should be rejected: %v", err)
+	}
+
+	// and the scope
+	tampered = signer.Sign("/ostree/repo/", "acme", now.Add(time.Hour))
+	if Scope(tampered) != "acme" {
+		t.Fatalf("Unexpected scope: '%s'", Scope(tampered))
+	}
+	tampered.Del("scope")
+	err = signer.Verify("/ostree/repo/config", tampered, now)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Removed scope should be rejected: %v", err)
+	}
+
+	// as is the expiry
+	tampered = signer.Sign("/ostree/repo/", "", now.Add(time.Hour))
+	tampered.Set("expires", "99999999999")
+	err = signer.Verify("/ostree/repo/config", tampered, now)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Tampered expiry should be rejected: %v", err)
+	}
+
+	other, _ := NewURLSigner(bytes.Repeat([]byte("o"), 32))
+	err = other.Verify("/ostree/repo/config", signer.Sign("/ostree/repo/", "", now.Add(time.Hour)), now)
+	if !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("Signature with a different key should be rejected: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package auth
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+type Role string
+
+const (
+	RoleReader   Role = "reader"
+	RolePusher   Role = "pusher"
+	RolePromoter Role = "promoter"
+	RoleAdmin    Role = "admin"
+)
+
+type Action string
+
+const (
+	// pull from a registry repository
+	ActionPull Action = "pull"
+	// push to a registry repository
+	ActionPush Action = "push"
+	// read the state of otto, like imports or approvals
+	ActionRead Action = "read"
+	// move an ostree ref to a new commit, e.g. by promoting it
+	ActionPromote Action = "promote"
+	// maintenance operations
+	ActionAdmin Action = "admin"
+)
+
+// Kinds of resources actions apply to
+const (
+	KindRepository = "repository"
+	KindRef        = "ref"
+)
+
+var rolePermissions = map[Role][]Action{
+	RoleReader:   {ActionPull, ActionRead},
+	RolePusher:   {ActionPull, ActionRead, ActionPush},
+	RolePromoter: {ActionPull, ActionRead, ActionPromote},
+	RoleAdmin:    {ActionPull, ActionRead, ActionPush, ActionPromote, ActionAdmin},
+}
+
+// Binding grants a role to principals, optionally limited to some
+// registry repositories and ostree refs
+type Binding struct {
+	Role Role `toml:"role"`
+
+	Users  []string `toml:"users"`
+	Groups []string `toml:"groups"`
+	// subjects of client certificates
+	Subjects []string `toml:"subjects"`
+	// clients that are not authenticated
+	Anonymous bool `toml:"anonymous"`
+
+	// patterns (see path.Match), empty means all
+	Repos []string `toml:"repos"`
+	Refs  []string `toml:"refs"`
+}
+
+type Policy struct {
+	// members of groups, as patterns
+	Groups   map[string][]string `toml:"groups"`
+	Bindings []Binding           `toml:"bindings"`
+}
+
+// Principal is an authenticated client
+type Principal struct {
+	Identity string
+	// subject of the client certificate, if any
+	Subject string
+}
+
+func (p Principal) String() string {
+	switch {
+	case p.Identity != "":
+		return p.Identity
+	case p.Subject != "":
+		return p.Subject
+	}
+	return "anonymous"
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func ParsePolicy(data string) (*Policy, error) {
+	var p Policy
+
+	_, err := toml.Decode(data, &p)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, b := range p.Bindings {
+		if _, ok := rolePermissions[b.Role]; !ok {
+			return nil, fmt.Errorf("binding %d: unknown role '%s'", i+1, b.Role)
+		}
+
+		for _, g := range b.Groups {
+			if _, ok := p.Groups[g]; !ok {
+				return nil, fmt.Errorf("binding %d: unknown group '%s'", i+1, g)
+			}
+		}
+	}
+
+	return &p, nil
+}
+
+func (p *Policy) binds(b *Binding, principal Principal) bool {
+	if principal.Identity == "" && principal.Subject == "" {
+		return b.Anonymous
+	}
+
+	if principal.Identity != "" && matchAny(b.Users, principal.Identity) {
+		return true
+	}
+
+	if principal.Subject != "" && matchAny(b.Subjects, principal.Subject) {
+		return true
+	}
+
+	for _, g := range b.Groups {
+		if principal.Identity != "" && matchAny(p.Groups[g], principal.Identity) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (b *Binding) covers(kind string, name string) bool {
+	var patterns []string
+
+	switch kind {
+	case KindRepository:
+		patterns = b.Repos
+	case KindRef:
+		patterns = b.Refs
+	}
+
+	return len(patterns) == 0 || matchAny(patterns, name)
+}
+
+// Check returns nil if a binding grants action on the resource of
+// kind and name to the principal, otherwise the reason it is denied
+func (p *Policy) Check(principal Principal, action Action, kind string, name string) error {
+	for i := range p.Bindings {
+		b := &p.Bindings[i]
+
+		if !p.binds(b, principal) || !b.covers(kind, name) {
+			continue
+		}
+
+		for _, a := range rolePermissions[b.Role] {
+			if a == action {
+				return nil
+			}
+		}
+	}
+
+	if kind == "" {
+		return fmt.Errorf("no role grants '%s' to %s", action, principal)
+	}
+
+	return fmt.Errorf("no role grants '%s' on %s '%s' to %s", action, kind, name, principal)
+}
+
+// PolicyFile is a policy that is re-read whenever the file changes
+type PolicyFile struct {
+	Path string
+
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+	policy  *Policy
+}
+
+func NewPolicyFile(path string) (*PolicyFile, error) {
+	pf := &PolicyFile{
+		Path: path,
+	}
+
+	_, err := pf.Policy()
+	if err != nil {
+		return nil, err
+	}
+
+	return pf, nil
+}
+
+// Policy returns the current policy; if the file changed but cannot
+// be loaded, the last good version is returned along with the error
+func (pf *PolicyFile) Policy() (*Policy, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	st, err := os.Stat(pf.Path)
+	if err != nil {
+		return pf.policy, err
+	}
+
+	if pf.policy != nil && st.ModTime().Equal(pf.modTime) && st.Size() == pf.size {
+		return pf.policy, nil
+	}
+
+	data, err := ioutil.ReadFile(pf.Path)
+	if err != nil {
+		return pf.policy, err
+	}
+
+	policy, err := ParsePolicy(string(data))
+	if err != nil {
+		return pf.policy, fmt.Errorf("%s: %w", pf.Path, err)
+	}
+
+	pf.policy = policy
+	pf.modTime = st.ModTime()
+	pf.size = st.Size()
+
+	return policy, nil
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicy = `
+[groups]
+ci = ["builder", "jenkins-*"]
+release = ["alice"]
+
+[[bindings]]
+role = "reader"
+anonymous = true
+repos = ["public"]
+
+[[bindings]]
+role = "pusher"
+groups = ["ci"]
+repos = ["iot", "iot-*"]
+
+[[bindings]]
+role = "pusher"
+subjects = ["CN=build-*,O=Acme"]
+repos = ["iot"]
+
+[[bindings]]
+role = "promoter"
+groups = ["release"]
+refs = ["fedora/*/iot"]
+
+[[bindings]]
+role = "admin"
+users = ["root"]
+`
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy(testPolicy)
+	if err != nil {
+		t.Fatalf("Failed to parse policy: %v", err)
+	}
+
+	anonymous := Principal{}
+	builder := Principal{Identity: "builder"}
+	jenkins := Principal{Identity: "jenkins-2"}
+	device := Principal{Identity: "CN=build-7,O=Acme", Subject: "CN=build-7,O=Acme"}
+	alice := Principal{Identity: "alice"}
+	root := Principal{Identity: "root"}
+
+	tests := []struct {
+		principal Principal
+		action    Action
+		kind      string
+		name      string
+		allowed   bool
+	}{
+		{anonymous, ActionPull, KindRepository, "public", true},
+		{anonymous, ActionPull, KindRepository, "iot", false},
+		{anonymous, ActionPush, KindRepository, "public", false},
+		{builder, ActionPush, KindRepository, "iot", true},
+		{builder, ActionPull, KindRepository, "iot-devel", true},
+		{builder, ActionPush, KindRepository, "public", false},
+		{builder, ActionRead, "", "", true},
+		{builder, ActionPromote, KindRef, "fedora/x86_64/iot", false},
+		{jenkins, ActionPush, KindRepository, "iot-stable", true},
+		{device, ActionPush, KindRepository, "iot", true},
+		{device, ActionPush, KindRepository, "iot-devel", false},
+		{alice, ActionPromote, KindRef, "fedora/x86_64/iot", true},
+		{alice, ActionPromote, KindRef, "fedora/x86_64/coreos", false},
+		{alice, ActionPush, KindRepository, "iot", false},
+		{alice, ActionAdmin, "", "", false},
+		{root, ActionAdmin, "", "", true},
+		{root, ActionPush, KindRepository, "anything", true},
+	}
+
+	for _, tt := range tests {
+		err := p.Check(tt.principal, tt.action, tt.kind, tt.name)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%s %s %s '%s': expected allowed=%v, got: %v", tt.principal, tt.action, tt.kind, tt.name, tt.allowed, err)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	_, err := ParsePolicy(`[[bindings]]
+role = "superuser"
+users = ["root"]
+`)
+	if err == nil {
+		t.Fatalf("Unknown role should be rejected")
+	}
+
+	_, err = ParsePolicy(`[[bindings]]
+role = "admin"
+groups = ["wheel"]
+`)
+	if err == nil {
+		t.Fatalf("Unknown group should be rejected")
+	}
+}
+
+func TestPolicyFile(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	path := filepath.Join(tmp, "policy.toml")
+	err = ioutil.WriteFile(path, []byte(testPolicy), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write policy: %v", err)
+	}
+
+	pf, err := NewPolicyFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load policy: %v", err)
+	}
+
+	bob := Principal{Identity: "bob"}
+
+	p, _ := pf.Policy()
+	if p.Check(bob, ActionAdmin, "", "") == nil {
+		t.Fatalf("bob should not be admin")
+	}
+
+	touch := func(data string) {
+		err = ioutil.WriteFile(path, []byte(data), 0644)
+		if err != nil {
+			t.Fatalf("Failed to write policy: %v", err)
+		}
+
+		later := time.Now().Add(time.Second)
+		err = os.Chtimes(path, later, later)
+		if err != nil {
+			t.Fatalf("Failed to change time: %v", err)
+		}
+	}
+
+	touch(testPolicy + "\n[[bindings]]\nrole = \"admin\"\nusers = [\"bob\"]\n")
+
+	p, err = pf.Policy()
+	if err != nil || p.Check(bob, ActionAdmin, "", "") != nil {
+		t.Fatalf("Reloaded policy should make bob admin: %v", err)
+	}
+
+	// a broken policy keeps the last good one
+	touch("[[bindings]\n")
+
+	p, err = pf.Policy()
+	if err == nil {
+		t.Fatalf("Broken policy should be reported")
+	}
+
+	if p == nil || p.Check(bob, ActionAdmin, "", "") != nil {
+		t.Fatalf("Last good policy should still be used")
+	}
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Tokens for the token authentication of the distribution spec, see
+// https://docs.docker.com/registry/spec/auth/token/, as JWTs signed
+// with HMAC-SHA256.
+
+// Access is a resource and the actions the token grants on it
+type Access struct {
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Actions []string `json:"actions"`
+}
+
+// ParseScope parses a scope like "repository:foo:pull,push"; the
+// name may contain colons, e.g. for a registry with a port
+func ParseScope(scope string) (Access, error) {
+	first := strings.Index(scope, ":")
+	last := strings.LastIndex(scope, ":")
+
+	if first < 1 || last == first || last == len(scope)-1 {
+		return Access{}, fmt.Errorf("invalid scope: '%s'", scope)
+	}
+
+	return Access{
+		Type:    scope[:first],
+		Name:    scope[first+1 : last],
+		Actions: strings.Split(scope[last+1:], ","),
+	}, nil
+}
+
+func (a Access) String() string {
+	return fmt.Sprintf("%s:%s:%s", a.Type, a.Name, strings.Join(a.Actions, ","))
+}
+
+type Claims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  string   `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	IssuedAt  int64    `json:"iat"`
+	ID        string   `json:"jti"`
+	Access    []Access `json:"access"`
+}
+
+// Allows checks if the claims grant action on the resource
+func (c *Claims) Allows(typ string, name string, action string) bool {
+	for _, a := range c.Access {
+		if a.Type != typ || a.Name != name {
+			continue
+		}
+
+		for _, have := range a.Actions {
+			if have == action || have == "*" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// TokenIssuer issues and verifies tokens
+type TokenIssuer struct {
+	Issuer  string
+	Service string
+	Expiry  time.Duration
+
+	key []byte
+}
+
+var ErrInvalidToken = errors.New("invalid token")
+
+// tokens may be used slightly before they were issued, to account
+// for clock differences
+const clockSkew = 30 * time.Second
+
+func NewTokenIssuer(key []byte, issuer string, service string, expiry time.Duration) (*TokenIssuer, error) {
+	if len(key) < 32 {
+		return nil, fmt.Errorf("token key must be at least 32 bytes")
+	}
+
+	return &TokenIssuer{
+		Issuer:  issuer,
+		Service: service,
+		Expiry:  expiry,
+		key:     key,
+	}, nil
+}
+
+var jwtHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+func (ti *TokenIssuer) sign(data string) string {
+	mac := hmac.New(sha256.New, ti.key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates a token for subject that grants access
+func (ti *TokenIssuer) Issue(subject string, access []Access, now time.Time) (string, *Claims, error) {
+	var id [16]byte
+	_, err := rand.Read(id[:])
+	if err != nil {
+		return "", nil, err
+	}
+
+	if access == nil {
+		access = []Access{}
+	}
+
+	claims := &Claims{
+		Issuer:    ti.Issuer,
+		Subject:   subject,
+		Audience:  ti.Service,
+		ExpiresAt: now.Add(ti.Expiry).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        hex.EncodeToString(id[:]),
+		Access:    access,
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", nil, err
+	}
+
+	data := jwtHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return data + "." + ti.sign(data), claims, nil
+}
+
+// Verify checks the signature and validity of token
+func (ti *TokenIssuer) Verify(token string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != jwtHeader {
+		return nil, ErrInvalidToken
+	}
+
+	sig := ti.sign(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(sig), []byte(parts[2])) {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var claims Claims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	if claims.Issuer != ti.Issuer || claims.Audience != ti.Service {
+		return nil, fmt.Errorf("%w: wrong issuer or audience", ErrInvalidToken)
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	if now.Add(clockSkew).Unix() < claims.NotBefore {
+		return nil, fmt.Errorf("%w: not yet valid", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
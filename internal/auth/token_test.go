@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseScope(t *testing.T) {
+	a, err := ParseScope("repository:iot:pull,push")
+	if err != nil {
+		t.Fatalf("Failed to parse scope: %v", err)
+	}
+
+	if a.Type != "repository" || a.Name != "iot" || len(a.Actions) != 2 || a.Actions[1] != "push" {
+		t.Fatalf("Unexpected access: %+v", a)
+	}
+
+	a, err = ParseScope("repository:localhost:3000/iot:pull")
+	if err != nil || a.Name != "localhost:3000/iot" || a.String() != "repository:localhost:3000/iot:pull" {
+		t.Fatalf("Unexpected access: %+v (%v)", a, err)
+	}
+
+	for _, scope := range []string{"", "repository", "repository:iot", ":iot:pull", "repository:iot:"} {
+		if _, err := ParseScope(scope); err == nil {
+			t.Errorf("Scope '%s' should be invalid", scope)
+		}
+	}
+}
+
+func TestToken(t *testing.T) {
+	key := []byte(strings.Repeat("k", 32))
+
+	_, err := NewTokenIssuer(key[:16], "otto", "otto", time.Minute)
+	if err == nil {
+		t.Fatalf("Short key should be rejected")
+	}
+
+	ti, err := NewTokenIssuer(key, "otto", "registry", 5*time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create issuer: %v", err)
+	}
+
+	now := time.Now()
+	access := []Access{{Type: "repository", Name: "iot", Actions: []string{"pull"}}}
+
+	token, issued, err := ti.Issue("builder", access, now)
+	if err != nil {
+		t.Fatalf("Failed to issue token: %v", err)
+	}
+
+	claims, err := ti.Verify(token, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to verify token: %v", err)
+	}
+
+	if claims.Subject != "builder" || claims.ID != issued.ID {
+		t.Fatalf("Unexpected claims: %+v", claims)
+	}
+
+	if !claims.Allows("repository", "iot", "pull") || claims.Allows("repository", "iot", "push") ||
+		claims.Allows("repository", "other", "pull") {
+		t.Fatalf("Unexpected access: %+v", claims.Access)
+	}
+
+	if _, err := ti.Verify(token, now.Add(5*time.Minute)); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Expired token should be invalid: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	forged := parts[0] + "." + parts[1] + "x." + parts[2]
+	if _, err := ti.Verify(forged, now); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Modified token should be invalid: %v", err)
+	}
+
+	other, _ := NewTokenIssuer([]byte(strings.Repeat("o", 32)), "otto", "registry", time.Minute)
+	if _, err := other.Verify(token, now); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("Token signed with other key should be invalid: %v", err)
+	}
+}
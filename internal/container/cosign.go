@@ -0,0 +1,212 @@
+package container
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// Support for image signatures as created by cosign: a signature is
+// an image manifest whose layers are "simple signing" payloads that
+// name the digest of the signed manifest; the signature itself is in
+// an annotation of the layer. It is found via a tag derived from the
+// digest of the signed manifest.
+
+const (
+	CosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+	CosignPayloadType         = "cosign container image signature"
+)
+
+var ErrNoSignatures = errors.New("image is not signed")
+
+// SimpleSigning is the payload of a cosign signature
+type SimpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]interface{} `json:"optional"`
+}
+
+// SignatureTag returns the tag of the signature of the manifest d,
+// e.g. "sha256-<hex>.sig"
+func SignatureTag(d digest.Digest) string {
+	return fmt.Sprintf("%s-%s.sig", d.Algorithm(), d.Hex())
+}
+
+// SignedManifest returns the digest of the manifest that tag is the
+// signature tag of
+func SignedManifest(tag string) (digest.Digest, bool) {
+	if !strings.HasSuffix(tag, ".sig") {
+		return "", false
+	}
+
+	i := strings.Index(tag, "-")
+	if i == -1 {
+		return "", false
+	}
+
+	d := digest.NewDigestFromEncoded(digest.Algorithm(tag[:i]), strings.TrimSuffix(tag[i+1:], ".sig"))
+	if d.Validate() != nil {
+		return "", false
+	}
+
+	return d, true
+}
+
+// ParsePublicKeys parses PEM encoded public keys; ECDSA, RSA and
+// ed25519 keys are supported
+func ParsePublicKeys(data []byte) ([]crypto.PublicKey, error) {
+	var keys []crypto.PublicKey
+
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+			keys = append(keys, key)
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T", key)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys found")
+	}
+
+	return keys, nil
+}
+
+func verifySignature(key crypto.PublicKey, payload []byte, sig []byte) bool {
+	hash := sha256.Sum256(payload)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, hash[:], sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, sig)
+	}
+
+	return false
+}
+
+// Signatures returns the manifests that may hold signatures of the
+// manifest d in the repository, i.e. the one of its signature tag
+func (reg *Registry) Signatures(repo string, d digest.Digest) ([]digest.Digest, error) {
+	tagged, err := reg.ResolveTag(repo, SignatureTag(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return []digest.Digest{tagged}, nil
+}
+
+// verifyLayers checks if any layer of the signature manifest sig is a
+// valid signature of the manifest d
+func (reg *Registry) verifyLayers(sig digest.Digest, d digest.Digest, keys []crypto.PublicKey) (bool, error) {
+	manifest, err := reg.ReadManifestJSON(sig)
+	if err != nil {
+		return false, err
+	}
+
+	for _, layer := range manifest.Layers {
+		encoded, ok := layer.Annotations[CosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+
+		raw, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+
+		payload, err := ioutil.ReadFile(reg.PathForBlob(layer.Digest))
+		if err != nil {
+			return false, err
+		}
+
+		valid := false
+		for _, key := range keys {
+			valid = valid || verifySignature(key, payload, raw)
+		}
+
+		if !valid {
+			continue
+		}
+
+		// the signature is valid, but is it for this manifest?
+		var ss SimpleSigning
+		err = json.Unmarshal(payload, &ss)
+		if err != nil {
+			continue
+		}
+
+		if ss.Critical.Type == CosignPayloadType && ss.Critical.Image.DockerManifestDigest == d.String() {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// VerifyImage checks that the manifest d in the repository has a
+// valid signature from one of keys; ErrNoSignatures is returned if
+// there are no signatures at all
+func (reg *Registry) VerifyImage(repo string, d digest.Digest, keys []crypto.PublicKey) error {
+	sigs, err := reg.Signatures(repo, d)
+	if err != nil {
+		return err
+	}
+
+	if len(sigs) == 0 {
+		return ErrNoSignatures
+	}
+
+	for _, sig := range sigs {
+		valid, err := reg.verifyLayers(sig, d, keys)
+		if err != nil {
+			return err
+		}
+
+		if valid {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("none of the %d signature(s) is valid for a trusted key", len(sigs))
+}
@@ -0,0 +1,233 @@
+package container
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func makeRegistry(t *testing.T) (*Registry, func()) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+
+	reg := NewRegistry(tmp)
+	err = reg.Init()
+	if err != nil {
+		os.RemoveAll(tmp)
+		t.Fatalf("failed to initialize registry: %v", err)
+	}
+
+	return reg, func() { os.RemoveAll(tmp) }
+}
+
+// putManifest stores a manifest with the given layers and returns its
+// digest
+func putManifest(t *testing.T, reg *Registry, layers []v1.Descriptor) digest.Digest {
+	config, err := reg.PutBlobJSON(map[string]string{})
+	if err != nil {
+		t.Fatalf("Failed to store config: %v", err)
+	}
+
+	m := v1.Manifest{
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    config.Digest,
+			Size:      config.Size,
+		},
+		Layers: layers,
+	}
+	m.SchemaVersion = 2
+
+	raw, err := json.Marshal(m)
+	if err != nil {
+		t.Fatalf("Failed to marshal manifest: %v", err)
+	}
+
+	d, err := reg.PutManifestRaw(raw)
+	if err != nil {
+		t.Fatalf("Failed to store manifest: %v", err)
+	}
+
+	if d != digest.FromBytes(raw) {
+		t.Fatalf("Digest of raw manifest changed: %s", d)
+	}
+
+	return d
+}
+
+// signatureLayer creates a cosign signature of the manifest d
+func signatureLayer(t *testing.T, reg *Registry, d digest.Digest, sign func([]byte) []byte) v1.Descriptor {
+	payload := fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"localhost/test"},`+
+		`"image":{"docker-manifest-digest":"%s"},"type":"%s"},"optional":null}`, d, CosignPayloadType)
+
+	info, err := reg.PutBlob(bytesReader(payload))
+	if err != nil {
+		t.Fatalf("Failed to store payload: %v", err)
+	}
+
+	return v1.Descriptor{
+		MediaType: "application/vnd.dev.cosign.simplesigning.v1+json",
+		Digest:    info.Digest,
+		Size:      info.Size,
+		Annotations: map[string]string{
+			CosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sign([]byte(payload))),
+		},
+	}
+}
+
+func TestSignatureTag(t *testing.T) {
+	d := digest.FromString("otto")
+
+	tag := SignatureTag(d)
+	if tag != "sha256-"+d.Hex()+".sig" {
+		t.Fatalf("Unexpected tag: %s", tag)
+	}
+
+	signed, ok := SignedManifest(tag)
+	if !ok || signed != d {
+		t.Fatalf("Failed to parse signature tag: %s", signed)
+	}
+
+	for _, tag := range []string{"latest", "sha256-abc.sig", "sha256-" + d.Hex()} {
+		if _, ok := SignedManifest(tag); ok {
+			t.Errorf("'%s' is not a signature tag", tag)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	reg, cleanup := makeRegistry(t)
+	defer cleanup()
+
+	d := putManifest(t, reg, nil)
+
+	err := reg.TagManifest("iot", "latest", d)
+	if err != nil {
+		t.Fatalf("Failed to tag manifest: %v", err)
+	}
+
+	resolved, err := reg.ResolveTag("iot", "latest")
+	if err != nil || resolved != d {
+		t.Fatalf("Failed to resolve tag: %s, %v", resolved, err)
+	}
+
+	if _, err := reg.ResolveTag("other", "latest"); !os.IsNotExist(err) {
+		t.Fatalf("Tags should be per repository: %v", err)
+	}
+
+	for _, tag := range []string{"", "../escape", ".hidden"} {
+		if err := reg.TagManifest("iot", tag, d); err == nil {
+			t.Errorf("Tag '%s' should be invalid", tag)
+		}
+	}
+}
+
+func TestVerifyImage(t *testing.T) {
+	reg, cleanup := makeRegistry(t)
+	defer cleanup()
+
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	keys, err := ParsePublicKeys(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("Failed to parse public key: %v", err)
+	}
+
+	signECDSA := func(payload []byte) []byte {
+		hash := sha256.Sum256(payload)
+		sig, err := ecdsa.SignASN1(rand.Reader, sk, hash[:])
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		return sig
+	}
+
+	image := putManifest(t, reg, nil)
+
+	err = reg.VerifyImage("iot", image, keys)
+	if err != ErrNoSignatures {
+		t.Fatalf("Expected ErrNoSignatures, got: %v", err)
+	}
+
+	// a valid signature, but for another image
+	other := digest.FromString("other")
+	sig := putManifest(t, reg, []v1.Descriptor{signatureLayer(t, reg, other, signECDSA)})
+
+	err = reg.TagManifest("iot", SignatureTag(image), sig)
+	if err != nil {
+		t.Fatalf("Failed to tag signature: %v", err)
+	}
+
+	if err := reg.VerifyImage("iot", image, keys); err == nil || err == ErrNoSignatures {
+		t.Fatalf("Signature for other image should not verify: %v", err)
+	}
+
+	sig = putManifest(t, reg, []v1.Descriptor{signatureLayer(t, reg, image, signECDSA)})
+
+	err = reg.TagManifest("iot", SignatureTag(image), sig)
+	if err != nil {
+		t.Fatalf("Failed to tag signature: %v", err)
+	}
+
+	if err := reg.VerifyImage("iot", image, keys); err != nil {
+		t.Fatalf("Failed to verify image: %v", err)
+	}
+
+	// signature with an untrusted key
+	layer, err := reg.PutBlob(bytesReader("layer"))
+	if err != nil {
+		t.Fatalf("Failed to store layer: %v", err)
+	}
+
+	image = putManifest(t, reg, []v1.Descriptor{{Digest: layer.Digest, Size: layer.Size}})
+
+	_, edsk, _ := ed25519.GenerateKey(nil)
+	signEd25519 := func(payload []byte) []byte {
+		return ed25519.Sign(edsk, payload)
+	}
+
+	sig = putManifest(t, reg, []v1.Descriptor{signatureLayer(t, reg, image, signEd25519)})
+
+	err = reg.TagManifest("iot", SignatureTag(image), sig)
+	if err != nil {
+		t.Fatalf("Failed to tag signature: %v", err)
+	}
+
+	if err := reg.VerifyImage("iot", image, keys); err == nil || err == ErrNoSignatures {
+		t.Fatalf("Untrusted signature should not verify: %v", err)
+	}
+
+	trusted := append(keys, crypto.PublicKey(edsk.Public()))
+	if err := reg.VerifyImage("iot", image, trusted); err != nil {
+		t.Fatalf("Failed to verify image with a trusted key: %v", err)
+	}
+}
+
+func bytesReader(s string) *bytes.Reader {
+	return bytes.NewReader([]byte(s))
+}
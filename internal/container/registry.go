@@ -8,12 +8,17 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/google/uuid"
 	digest "github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// see the distribution spec
+var tagRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+
 type Registry struct {
 	Path string
 
@@ -24,6 +29,7 @@ type Registry struct {
 	blobs     string
 	incoming  string
 	manifests string
+	tags      string
 }
 
 type BlobInfo struct {
@@ -59,7 +65,13 @@ func (reg *Registry) Init() error {
 	}
 
 	reg.manifests = filepath.Join(reg.Path, "manifests")
-	err = os.MkdirAll(reg.incoming, 0700)
+	err = os.MkdirAll(reg.manifests, 0700)
+	if err != nil {
+		return err
+	}
+
+	reg.tags = filepath.Join(reg.Path, "tags")
+	err = os.MkdirAll(reg.tags, 0700)
 	if err != nil {
 		return err
 	}
@@ -246,6 +258,23 @@ func (reg *Registry) PutBlobJSON(data interface{}) (*BlobInfo, error) {
 }
 
 func (reg *Registry) PutManifest(manifest v1.Manifest) (digest.Digest, error) {
+	raw, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return "", err
+	}
+
+	return reg.PutManifestRaw(raw)
+}
+
+// PutManifestRaw stores the manifest as it was pushed, so that its
+// digest matches the one computed by the client
+func (reg *Registry) PutManifestRaw(raw []byte) (digest.Digest, error) {
+	var manifest v1.Manifest
+
+	err := json.Unmarshal(raw, &manifest)
+	if err != nil {
+		return "", fmt.Errorf("invalid manifest: %w", err)
+	}
 
 	for _, layer := range manifest.Layers {
 		if !reg.HasBlob(layer.Digest) {
@@ -257,7 +286,7 @@ func (reg *Registry) PutManifest(manifest v1.Manifest) (digest.Digest, error) {
 		return "", fmt.Errorf("layer missing: %v", manifest.Config.Digest)
 	}
 
-	info, err := reg.PutBlobJSON(manifest)
+	info, err := reg.PutBlob(bytes.NewReader(raw))
 	if err != nil {
 		return "", err
 	}
@@ -303,3 +332,71 @@ func (reg *Registry) ReadManifest(d digest.Digest, info *os.FileInfo) (io.ReadCl
 
 	return fd, nil
 }
+
+func (reg *Registry) ReadManifestJSON(d digest.Digest) (*v1.Manifest, error) {
+	fd, err := reg.ReadManifest(d, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var manifest v1.Manifest
+	err = json.NewDecoder(fd).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest %s: %w", d, err)
+	}
+
+	return &manifest, nil
+}
+
+// ValidTag checks if tag is a valid tag name
+func ValidTag(tag string) bool {
+	return tagRegexp.MatchString(tag)
+}
+
+func validRepository(repo string) bool {
+	return repo != "" && repo != "." && repo != ".." && !strings.ContainsAny(repo, "/\\")
+}
+
+// TagManifest points tag of the repository to the manifest d
+func (reg *Registry) TagManifest(repo string, tag string, d digest.Digest) error {
+	if !validRepository(repo) || !ValidTag(tag) {
+		return fmt.Errorf("invalid tag '%s:%s'", repo, tag)
+	}
+
+	dir := filepath.Join(reg.tags, repo)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".tag-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.WriteString(d.String())
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, tag))
+}
+
+// ResolveTag returns the manifest tag of the repository points to
+func (reg *Registry) ResolveTag(repo string, tag string) (digest.Digest, error) {
+	if !validRepository(repo) || !ValidTag(tag) {
+		return "", os.ErrNotExist
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(reg.tags, repo, tag))
+	if err != nil {
+		return "", err
+	}
+
+	return digest.Parse(strings.TrimSpace(string(data)))
+}
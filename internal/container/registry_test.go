@@ -7,6 +7,8 @@ import (
 	"os"
 	"testing"
 
+	_ "crypto/sha512"
+
 	"github.com/opencontainers/go-digest"
 )
 
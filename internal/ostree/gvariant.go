@@ -0,0 +1,234 @@
+package ostree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// Minimal support for the GVariant serialization format, enough to
+// read and write the detached metadata of commits, which is of type
+// a{sv}. Values are kept in their serialized form, so that entries
+// of any type, like signatures, can be preserved.
+// See https://developer.gnome.org/glib/stable/gvariant-format-strings.html
+// and "GVariant Serialisation" by Allison Lortie.
+
+// Variant is a serialized GVariant value together with its type
+type Variant struct {
+	Type string
+	Data []byte
+}
+
+func StringVariant(s string) Variant {
+	data := make([]byte, 0, len(s)+1)
+	data = append(data, s...)
+	return Variant{"s", append(data, 0)}
+}
+
+func (v Variant) String() (string, error) {
+	if v.Type != "s" {
+		return "", fmt.Errorf("variant is of type '%s', not 's'", v.Type)
+	}
+
+	if len(v.Data) == 0 || v.Data[len(v.Data)-1] != 0 {
+		return "", fmt.Errorf("invalid string")
+	}
+
+	return string(v.Data[:len(v.Data)-1]), nil
+}
+
+// ByteArrays decodes a variant of type "aay"
+func (v Variant) ByteArrays() ([][]byte, error) {
+	if v.Type != "aay" {
+		return nil, fmt.Errorf("variant is of type '%s', not 'aay'", v.Type)
+	}
+
+	return splitArray(v.Data, 1)
+}
+
+func alignTo(n int, alignment int) int {
+	return (n + alignment - 1) &^ (alignment - 1)
+}
+
+func offsetSize(size int) int {
+	switch {
+	case size <= 0xff:
+		return 1
+	case size <= 0xffff:
+		return 2
+	case size <= 0xffffffff:
+		return 4
+	}
+	return 8
+}
+
+func readOffset(data []byte) int {
+	switch len(data) {
+	case 1:
+		return int(data[0])
+	case 2:
+		return int(binary.LittleEndian.Uint16(data))
+	case 4:
+		return int(binary.LittleEndian.Uint32(data))
+	}
+	return int(binary.LittleEndian.Uint64(data))
+}
+
+func appendOffset(buf []byte, offset int, size int) []byte {
+	var tmp [8]byte
+	binary.LittleEndian.PutUint64(tmp[:], uint64(offset))
+	return append(buf, tmp[:size]...)
+}
+
+// frameOffsets appends the framing offsets to body, choosing the
+// smallest offset size that can address the whole container
+func frameOffsets(body []byte, offsets []int) []byte {
+	size := 1
+	for size < 8 && len(body)+len(offsets)*size > 1<<(8*uint(size))-1 {
+		size *= 2
+	}
+
+	for _, o := range offsets {
+		body = appendOffset(body, o, size)
+	}
+
+	return body
+}
+
+// splitArray splits an array of variable sized elements
+func splitArray(data []byte, alignment int) ([][]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	osz := offsetSize(len(data))
+	if len(data) < osz {
+		return nil, fmt.Errorf("invalid array")
+	}
+
+	end := readOffset(data[len(data)-osz:])
+	if end > len(data) || (len(data)-end)%osz != 0 {
+		return nil, fmt.Errorf("invalid array framing")
+	}
+
+	n := (len(data) - end) / osz
+	elements := make([][]byte, 0, n)
+
+	start := 0
+	for i := 0; i < n; i++ {
+		o := end + i*osz
+		stop := readOffset(data[o : o+osz])
+
+		start = alignTo(start, alignment)
+		if start > stop || stop > end {
+			return nil, fmt.Errorf("invalid array element framing")
+		}
+
+		elements = append(elements, data[start:stop])
+		start = stop
+	}
+
+	return elements, nil
+}
+
+func decodeVariant(data []byte) (Variant, error) {
+	i := bytes.LastIndexByte(data, 0)
+	if i == -1 {
+		return Variant{}, fmt.Errorf("invalid variant")
+	}
+
+	return Variant{string(data[i+1:]), data[:i]}, nil
+}
+
+func encodeVariant(v Variant) []byte {
+	data := make([]byte, 0, len(v.Data)+len(v.Type)+1)
+	data = append(data, v.Data...)
+	data = append(data, 0)
+	return append(data, v.Type...)
+}
+
+// decodeVardict decodes a serialized a{sv}
+func decodeVardict(data []byte) (map[string]Variant, error) {
+	entries, err := splitArray(data, 8)
+	if err != nil {
+		return nil, err
+	}
+
+	dict := make(map[string]Variant, len(entries))
+
+	for _, entry := range entries {
+		osz := offsetSize(len(entry))
+		if len(entry) < osz {
+			return nil, fmt.Errorf("invalid dict entry")
+		}
+
+		keyEnd := readOffset(entry[len(entry)-osz:])
+		valStart := alignTo(keyEnd, 8)
+
+		if keyEnd < 1 || valStart > len(entry)-osz || entry[keyEnd-1] != 0 {
+			return nil, fmt.Errorf("invalid dict entry framing")
+		}
+
+		key := string(entry[:keyEnd-1])
+
+		v, err := decodeVariant(entry[valStart : len(entry)-osz])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for '%s': %v", key, err)
+		}
+
+		dict[key] = v
+	}
+
+	return dict, nil
+}
+
+// encodeVardict serializes dict as a{sv}, sorted by key
+func encodeVardict(dict map[string]Variant) ([]byte, error) {
+	keys := make([]string, 0, len(dict))
+	for k := range dict {
+		if !utf8.ValidString(k) || bytes.IndexByte([]byte(k), 0) != -1 {
+			return nil, fmt.Errorf("invalid key: '%s'", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var body []byte
+	var offsets []int
+
+	for _, k := range keys {
+		entry := append([]byte(k), 0)
+		keyEnd := len(entry)
+
+		for len(entry) < alignTo(keyEnd, 8) {
+			entry = append(entry, 0)
+		}
+
+		entry = append(entry, encodeVariant(dict[k])...)
+		entry = frameOffsets(entry, []int{keyEnd})
+
+		for len(body) < alignTo(len(body), 8) {
+			body = append(body, 0)
+		}
+
+		body = append(body, entry...)
+		offsets = append(offsets, len(body))
+	}
+
+	return frameOffsets(body, offsets), nil
+}
+
+// ByteArraysVariant encodes arrays as variant of type "aay"
+func ByteArraysVariant(arrays [][]byte) Variant {
+	var body []byte
+	offsets := make([]int, 0, len(arrays))
+
+	for _, a := range arrays {
+		body = append(body, a...)
+		offsets = append(offsets, len(body))
+	}
+
+	return Variant{"aay", frameOffsets(body, offsets)}
+}
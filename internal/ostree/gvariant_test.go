@@ -0,0 +1,107 @@
+package ostree
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestVardict(t *testing.T) {
+	// {'a': <'b'>} as serialized by GLib
+	known := []byte("a\x00\x00\x00\x00\x00\x00\x00b\x00\x00s\x02\x0d")
+
+	data, err := encodeVardict(map[string]Variant{"a": StringVariant("b")})
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if !bytes.Equal(data, known) {
+		t.Fatalf("Unexpected serialization: %q", data)
+	}
+
+	dict, err := decodeVardict(known)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	s, err := dict["a"].String()
+	if err != nil || s != "b" {
+		t.Fatalf("Unexpected value: '%s' (%v)", s, err)
+	}
+
+	empty, err := decodeVardict(nil)
+	if err != nil || len(empty) != 0 {
+		t.Fatalf("Empty dicts should decode: %v (%v)", empty, err)
+	}
+
+	_, err = decodeVardict([]byte("garbage"))
+	if err == nil {
+		t.Fatalf("Decoding garbage should fail")
+	}
+}
+
+func TestVardictRoundtrip(t *testing.T) {
+	// [[1, 2], [3]] as aay
+	sigs := Variant{"aay", []byte{1, 2, 3, 2, 3}}
+
+	arrays, err := sigs.ByteArrays()
+	if err != nil || !reflect.DeepEqual(arrays, [][]byte{{1, 2}, {3}}) {
+		t.Fatalf("Unexpected arrays: %v (%v)", arrays, err)
+	}
+
+	dict := map[string]Variant{
+		"ostree.sign.ed25519": sigs,
+	}
+
+	// enough entries to need wider framing offsets
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("otto.source.test-%d", i)
+		dict[key] = StringVariant(strings.Repeat("v", i))
+	}
+
+	data, err := encodeVardict(dict)
+	if err != nil {
+		t.Fatalf("Failed to encode: %v", err)
+	}
+
+	if len(data) <= 0xffff {
+		t.Fatalf("Expected data larger than 64k, got %d", len(data))
+	}
+
+	have, err := decodeVardict(data)
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if !reflect.DeepEqual(have, dict) {
+		t.Fatalf("Roundtrip failed")
+	}
+}
+
+func TestByteArrays(t *testing.T) {
+	arrays := [][]byte{[]byte("abc"), {}, make([]byte, 300)}
+
+	v := ByteArraysVariant(arrays)
+
+	res, err := v.ByteArrays()
+	if err != nil {
+		t.Fatalf("Failed to decode: %v", err)
+	}
+
+	if len(res) != len(arrays) {
+		t.Fatalf("Expected %d arrays, got %d", len(arrays), len(res))
+	}
+
+	for i := range arrays {
+		if !bytes.Equal(res[i], arrays[i]) {
+			t.Fatalf("Array %d differs: %v", i, res[i])
+		}
+	}
+
+	empty := ByteArraysVariant(nil)
+	if len(empty.Data) != 0 {
+		t.Fatalf("Empty array should have no data: %v", empty.Data)
+	}
+}
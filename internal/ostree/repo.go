@@ -1,15 +1,47 @@
 package ostree
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"time"
 )
 
+var checksumRegexp = regexp.MustCompile("^[0-9a-f]{64}$")
+
 type Repo struct {
 	path string
+
+	signers []Signer
+}
+
+type Commit struct {
+	Checksum string
+	Parent   string
+	Date     time.Time
+	Version  string
+}
+
+// FileInfo describes a file in the tree of a commit
+type FileInfo struct {
+	// '-' for regular files, 'd' for directories and 'l' for symlinks
+	Type byte
+	// permission bits, including setuid, setgid and sticky
+	Mode     uint32
+	UID      uint32
+	GID      uint32
+	Size     int64
+	Checksum string
+	Path     string
+	// target of symlinks
+	Target string
 }
 
 type RepoMode string
@@ -35,6 +67,25 @@ func (repo *Repo) Path() string {
 	return repo.path
 }
 
+func (repo *Repo) AddSigner(signer Signer) {
+	repo.signers = append(repo.signers, signer)
+}
+
+func (repo *Repo) Signers() []Signer {
+	return repo.signers
+}
+
+func (repo *Repo) SignCommit(commit string) error {
+	for _, signer := range repo.signers {
+		err := signer.SignCommit(repo, commit)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (repo *Repo) Init(mode RepoMode) error {
 	err := os.MkdirAll(repo.path, 0700)
 	if err != nil {
@@ -47,14 +98,143 @@ func (repo *Repo) Init(mode RepoMode) error {
 	return err
 }
 
+// SetConfig sets the option key, e.g. "core.parent", in the config
+// of the repository
+func (repo *Repo) SetConfig(key string, value string) error {
+	cmd := exec.Command("ostree", "config", "--repo", repo.path, "set", key, value)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
 func (repo *Repo) GetParentCommit(commit string) (string, error) {
 	ref := fmt.Sprintf("%s^", commit)
 	return repo.RevParse(ref)
 }
 
-func (repo *Repo) PullLocal(source string, ref string) error {
+// HasCommit checks if the commit object itself is present in the
+// repository; commits outside of the pulled history are not.
+func (repo *Repo) HasCommit(commit string) bool {
+	path, err := repo.objectPath(commit, "commit")
+	if err != nil {
+		return false
+	}
+
+	_, err = os.Stat(path)
+
+	return err == nil
+}
+
+func (repo *Repo) objectPath(checksum string, objtype string) (string, error) {
+	if !checksumRegexp.MatchString(checksum) {
+		return "", fmt.Errorf("invalid checksum: '%s'", checksum)
+	}
+
+	return filepath.Join(repo.path, "objects", checksum[:2], checksum[2:]+"."+objtype), nil
+}
+
+// DetachedMetadata reads the detached metadata of commit, which
+// is empty if the commit has none
+func (repo *Repo) DetachedMetadata(commit string) (map[string]Variant, error) {
+	path, err := repo.objectPath(commit, "commitmeta")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return make(map[string]Variant), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return decodeVardict(data)
+}
+
+// SetDetachedMetadata replaces the detached metadata of commit; use
+// DetachedMetadata to preserve existing entries, e.g. signatures
+func (repo *Repo) SetDetachedMetadata(commit string, meta map[string]Variant) error {
+	if !repo.HasCommit(commit) {
+		return fmt.Errorf("commit %s not found", commit)
+	}
+
+	path, err := repo.objectPath(commit, "commitmeta")
+	if err != nil {
+		return err
+	}
+
+	data, err := encodeVardict(meta)
+	if err != nil {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(filepath.Dir(path), ".commitmeta-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(data)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Chmod(0644)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fd.Name(), path)
+}
+
+// PullLocal pulls ref from the repo at source; for untrusted sources
+// the checksums of all objects are verified while pulling
+func (repo *Repo) PullLocal(source string, ref string, untrusted bool) error {
+	target := repo.path
+	args := []string{"pull-local", source, "--repo", target}
+	if untrusted {
+		args = append(args, "--untrusted")
+	}
+
+	cmd := exec.Command("ostree", append(args, ref)...)
+	err := cmd.Run()
+
+	return err
+}
+
+// SetRef points ref to commit, creating or overwriting it
+func (repo *Repo) SetRef(ref string, commit string) error {
+	target := repo.path
+	cmd := exec.Command("ostree", "refs", "--repo", target, "--force", "--create", ref, commit)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func (repo *Repo) DeleteRef(ref string) error {
 	target := repo.path
-	cmd := exec.Command("ostree", "pull-local", source, "--repo", target, ref)
+	cmd := exec.Command("ostree", "refs", "--repo", target, "--delete", ref)
 	err := cmd.Run()
 
 	return err
@@ -78,8 +258,413 @@ func (repo *Repo) RevParse(ref string) (string, error) {
 
 func (repo *Repo) UpdateSummary() error {
 	target := repo.path
-	cmd := exec.Command("ostree", "summary", "-u", "--repo", target)
+	args := []string{"summary", "-u", "--repo", target}
+
+	for _, signer := range repo.signers {
+		args = append(args, signer.summaryArgs()...)
+	}
+
+	cmd := exec.Command("ostree", args...)
+	err := cmd.Run()
+
+	return err
+}
+
+// GenerateDelta creates a static delta between the two commits; if
+// from is empty, a delta from scratch is generated.
+func (repo *Repo) GenerateDelta(from string, to string) error {
+	target := repo.path
+	args := []string{"static-delta", "generate", "--repo", target}
+
+	if from == "" {
+		args = append(args, "--empty")
+	} else {
+		args = append(args, "--from", from)
+	}
+
+	args = append(args, "--to", to)
+
+	cmd := exec.Command("ostree", args...)
 	err := cmd.Run()
 
 	return err
 }
+
+func (repo *Repo) ListRefs() ([]string, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "refs", "--repo", target)
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(res.String()), nil
+}
+
+// Log returns the history of ref, newest commit first, as far as it
+// is present in the repository
+func (repo *Repo) Log(ref string) ([]Commit, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "log", "--repo", target, ref)
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return parseLog(&res)
+}
+
+// ShowCommit returns the commit without walking its history
+func (repo *Repo) ShowCommit(commit string) (Commit, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "show", "--repo", target, commit)
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err := cmd.Run()
+	if err != nil {
+		return Commit{}, err
+	}
+
+	commits, err := parseLog(&res)
+	if err != nil {
+		return Commit{}, err
+	}
+
+	if len(commits) != 1 {
+		return Commit{}, fmt.Errorf("unexpected output for %s", commit)
+	}
+
+	return commits[0], nil
+}
+
+// MetadataString returns the string value of key in the metadata of
+// commit, or an empty string if it does not exist
+func (repo *Repo) MetadataString(commit string, key string) (string, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "show", "--repo", target, "--print-metadata-key", key, commit)
+
+	var res, stderr bytes.Buffer
+	cmd.Stdout = &res
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such metadata key") {
+			return "", nil
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return parseVariantString(strings.TrimSpace(res.String()))
+}
+
+// parseVariantString parses the text form of a string variant, as
+// printed by ostree, i.e. 'value' or "value" with escapes
+func parseVariantString(text string) (string, error) {
+	if len(text) < 2 || (text[0] != '\'' && text[0] != '"') || text[len(text)-1] != text[0] {
+		return "", fmt.Errorf("not a string: %s", text)
+	}
+
+	var sb strings.Builder
+	escaped := false
+	for _, c := range text[1 : len(text)-1] {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		sb.WriteRune(c)
+	}
+
+	return sb.String(), nil
+}
+
+func parseLog(r io.Reader) ([]Commit, error) {
+	var commits []Commit
+	var cur *Commit
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if strings.HasPrefix(line, "commit ") {
+			commits = append(commits, Commit{
+				Checksum: strings.TrimSpace(strings.TrimPrefix(line, "commit ")),
+			})
+			cur = &commits[len(commits)-1]
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+
+		key, value, found := cutField(line)
+		if !found {
+			continue
+		}
+
+		switch key {
+		case "Parent":
+			cur.Parent = value
+		case "Version":
+			cur.Version = value
+		case "Date":
+			date, err := time.Parse("2006-01-02 15:04:05 -0700", value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid date for %s: %v", cur.Checksum, err)
+			}
+			cur.Date = date
+		}
+	}
+
+	return commits, scanner.Err()
+}
+
+func cutField(line string) (string, string, bool) {
+	i := strings.Index(line, ":")
+	if i < 1 || strings.HasPrefix(line, " ") {
+		return "", "", false
+	}
+
+	return line[:i], strings.TrimSpace(line[i+1:]), true
+}
+
+// ListDeltas returns the names of all static deltas, either in the
+// form of "FROM-TO" or "TO" for deltas from scratch
+func (repo *Repo) ListDeltas() ([]string, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "static-delta", "list", "--repo", target)
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	var deltas []string
+	for _, name := range strings.Split(res.String(), "\n") {
+		name = strings.TrimSpace(name)
+
+		// "(No static deltas)"
+		if name == "" || strings.HasPrefix(name, "(") {
+			continue
+		}
+		deltas = append(deltas, name)
+	}
+
+	return deltas, nil
+}
+
+func (repo *Repo) DeleteDelta(name string) error {
+	target := repo.path
+	cmd := exec.Command("ostree", "static-delta", "delete", "--repo", target, name)
+	err := cmd.Run()
+
+	return err
+}
+
+// Prune deletes the given commits, all objects that are not reachable
+// from any of the remaining commits and static deltas that refer to
+// commits that are no longer present. Commits that are still pointed
+// to by a ref are refused by ostree.
+func (repo *Repo) Prune(commits []string) error {
+	target := repo.path
+
+	for _, commit := range commits {
+		cmd := exec.Command("ostree", "prune", "--repo", target, "--delete-commit", commit)
+
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("could not delete %s: %v: %s", commit, err, strings.TrimSpace(stderr.String()))
+		}
+	}
+
+	deltas, err := repo.ListDeltas()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range deltas {
+		stale := false
+		for _, commit := range strings.Split(name, "-") {
+			stale = stale || !repo.HasCommit(commit)
+		}
+
+		if !stale {
+			continue
+		}
+
+		err = repo.DeleteDelta(name)
+		if err != nil {
+			return fmt.Errorf("could not delete delta %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// ListFiles returns all files in the tree of commit. The paths are
+// taken from the NUL separated `ostree ls --nul-filenames-only`, so
+// that names with spaces or newlines cannot be misread; the details of
+// each file come from the `-C` output of the same walk of the tree.
+func (repo *Repo) ListFiles(commit string) ([]FileInfo, error) {
+	names, err := repo.ls(commit, "--nul-filenames-only")
+	if err != nil {
+		return nil, err
+	}
+
+	details, err := repo.ls(commit, "-C")
+	if err != nil {
+		return nil, err
+	}
+
+	paths := strings.Split(strings.TrimSuffix(string(names), "\x00"), "\x00")
+	if len(names) == 0 {
+		paths = nil
+	}
+
+	return parseLs(string(details), paths)
+}
+
+func (repo *Repo) ls(commit string, format string) ([]byte, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "ls", "--repo", target, "-R", format, commit, "/")
+
+	var res, stderr bytes.Buffer
+	cmd.Stdout = &res
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("could not list files: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return res.Bytes(), nil
+}
+
+// lsCursor reads the `ostree ls -C` output
+type lsCursor struct {
+	data string
+}
+
+// field returns the next field, which may be padded with spaces
+func (c *lsCursor) field() string {
+	c.data = strings.TrimLeft(c.data, " ")
+	i := strings.IndexAny(c.data, " \n")
+	if i == -1 {
+		i = len(c.data)
+	}
+
+	f := c.data[:i]
+	c.data = c.data[i:]
+	return f
+}
+
+// expect consumes s, if the output continues with it
+func (c *lsCursor) expect(s string) bool {
+	if !strings.HasPrefix(c.data, s) {
+		return false
+	}
+
+	c.data = c.data[len(s):]
+	return true
+}
+
+// parseLs parses the output of `ostree ls -R -C`, which has an entry
+// like "-00644 0 0   1234 <checksum> /usr/bin/foo" for each of paths,
+// in the same order; directories have two checksums and symlinks are
+// followed by " -> target". Since the paths are known, they are
+// matched as a whole instead of being split on whitespace.
+func parseLs(data string, paths []string) ([]FileInfo, error) {
+	var files []FileInfo
+
+	c := lsCursor{data}
+	for _, path := range paths {
+		var f FileInfo
+
+		mode := c.field()
+		uid, gid := c.field(), c.field()
+
+		_, err := fmt.Sscanf(uid+" "+gid, "%d %d", &f.UID, &f.GID)
+		if err != nil || len(mode) < 2 {
+			return nil, fmt.Errorf("invalid entry for '%s'", path)
+		}
+
+		f.Type = mode[0]
+		_, err = fmt.Sscanf(mode[1:], "%o", &f.Mode)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode for '%s': '%s'", path, mode)
+		}
+
+		size := c.field()
+		_, err = fmt.Sscanf(size, "%d", &f.Size)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size for '%s': '%s'", path, size)
+		}
+
+		f.Checksum = c.field()
+		if f.Type == 'd' {
+			// skip the metadata checksum
+			c.field()
+		}
+
+		if !c.expect(" " + path) {
+			return nil, fmt.Errorf("entry for '%s' not found", path)
+		}
+		f.Path = path
+
+		// the target is the rest of the line, it cannot be delimited
+		// any better
+		if f.Type == 'l' && c.expect(" -> ") {
+			i := strings.IndexByte(c.data, '\n')
+			if i == -1 {
+				i = len(c.data)
+			}
+			f.Target, c.data = c.data[:i], c.data[i:]
+		}
+
+		if !c.expect("\n") && c.data != "" {
+			return nil, fmt.Errorf("trailing data after '%s'", path)
+		}
+
+		files = append(files, f)
+	}
+
+	if strings.TrimSpace(c.data) != "" {
+		return nil, fmt.Errorf("more entries than files")
+	}
+
+	return files, nil
+}
+
+// Cat returns the content of the file at path in the tree of commit
+func (repo *Repo) Cat(commit string, path string) ([]byte, error) {
+	target := repo.path
+	cmd := exec.Command("ostree", "cat", "--repo", target, commit, path)
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Bytes(), nil
+}
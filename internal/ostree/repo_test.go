@@ -3,11 +3,22 @@ package ostree
 import (
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+func requireOstree(t *testing.T) {
+	_, err := exec.LookPath("ostree")
+	if err != nil {
+		t.Skip("ostree binary not available")
+	}
+}
+
 func TestInit(t *testing.T) {
+	requireOstree(t)
 
 	tmp, err := ioutil.TempDir("", t.Name())
 	if err != nil {
@@ -22,12 +33,322 @@ func TestInit(t *testing.T) {
 	err = repo.Init(ARCHIVE)
 
 	if err != nil {
-		t.Errorf("repo init failed: %w", err)
+		t.Errorf("repo init failed: %v", err)
+	}
+
+	err = repo.Init(ARCHIVE)
+
+	if err != nil {
+		t.Errorf("repo init failed: %v", err)
+	}
+}
+
+func makeCommit(t *testing.T, repo *Repo, ref string, content string) string {
+	tree, err := ioutil.TempDir("", "tree")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tree)
+
+	err = ioutil.WriteFile(filepath.Join(tree, "content"), []byte(content), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	cmd := exec.Command("ostree", "commit", "--repo", repo.Path(),
+		"--branch", ref, "--tree=dir="+tree)
+
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("Failed to commit: %v", err)
+	}
+
+	cid, err := repo.RevParse(ref)
+	if err != nil {
+		t.Fatalf("Failed to resolve ref: %v", err)
+	}
+
+	return cid
+}
+
+func TestStaticDelta(t *testing.T) {
+	requireOstree(t)
+
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := NewRepo(filepath.Join(tmp, "repo"))
+	err = repo.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
+
+	first := makeCommit(t, repo, "otto/test", "first")
+	second := makeCommit(t, repo, "otto/test", "second")
+
+	if !repo.HasCommit(first) || !repo.HasCommit(second) {
+		t.Fatalf("commits should be present")
+	}
+
+	if repo.HasCommit("../../config") {
+		t.Fatalf("invalid checksums should never be present")
+	}
+
+	err = repo.GenerateDelta(first, second)
+	if err != nil {
+		t.Fatalf("delta generation failed: %v", err)
+	}
+
+	err = repo.GenerateDelta("", second)
+	if err != nil {
+		t.Fatalf("delta generation from scratch failed: %v", err)
+	}
+}
+
+func TestParseLog(t *testing.T) {
+	data := `commit 0f3c1d2d8f4f9b0b5a3e4c34f50b4c54ad4f0b1ac1a2b3c4d5e6f708192a3b4c
+Parent:  9a8b7c6d5e4f30211203f4e5d6c7b8a9f0e1d2c3b4a5968778695a4b3c2d1e0f
+ContentChecksum:  1111111111111111111111111111111111111111111111111111111111111111
+Date:  2021-06-01 12:30:00 +0000
+Version: 34.20210601.0
+
+    Fedora IoT 34.20210601.0
+
+commit 9a8b7c6d5e4f30211203f4e5d6c7b8a9f0e1d2c3b4a5968778695a4b3c2d1e0f
+ContentChecksum:  2222222222222222222222222222222222222222222222222222222222222222
+Date:  2021-05-01 08:00:00 +0000
+
+    Date: not a header
+
+<< History beyond this commit not fetched >>
+`
+
+	commits, err := parseLog(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse log: %v", err)
+	}
+
+	if len(commits) != 2 {
+		t.Fatalf("Expected 2 commits, got %d", len(commits))
+	}
+
+	head := commits[0]
+	if head.Parent != commits[1].Checksum || head.Version != "34.20210601.0" {
+		t.Fatalf("Unexpected head: %+v", head)
+	}
+
+	if !head.Date.Equal(time.Date(2021, 6, 1, 12, 30, 0, 0, time.UTC)) {
+		t.Fatalf("Unexpected date: %v", head.Date)
+	}
+
+	if commits[1].Parent != "" || commits[1].Version != "" {
+		t.Fatalf("Unexpected commit: %+v", commits[1])
+	}
+}
+
+func TestPrune(t *testing.T) {
+	requireOstree(t)
+
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
 	}
+	defer os.RemoveAll(tmp)
 
+	repo := NewRepo(filepath.Join(tmp, "repo"))
 	err = repo.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
 
+	first := makeCommit(t, repo, "otto/test", "first")
+	second := makeCommit(t, repo, "otto/test", "second")
+
+	err = repo.GenerateDelta(first, second)
 	if err != nil {
-		t.Errorf("repo init failed: %w", err)
+		t.Fatalf("delta generation failed: %v", err)
+	}
+
+	history, err := repo.Log("otto/test")
+	if err != nil || len(history) != 2 {
+		t.Fatalf("Unexpected history: %v, %v", history, err)
+	}
+
+	err = repo.Prune([]string{second})
+	if err == nil {
+		t.Fatalf("Pruning a ref head must fail")
+	}
+
+	err = repo.Prune([]string{first})
+	if err != nil {
+		t.Fatalf("Pruning failed: %v", err)
+	}
+
+	if repo.HasCommit(first) || !repo.HasCommit(second) {
+		t.Fatalf("Wrong commit got pruned")
+	}
+
+	deltas, err := repo.ListDeltas()
+	if err != nil || len(deltas) != 0 {
+		t.Fatalf("Stale delta should have been removed: %v, %v", deltas, err)
+	}
+}
+
+func TestSetRef(t *testing.T) {
+	requireOstree(t)
+
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	source := NewRepo(filepath.Join(tmp, "source"))
+	err = source.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
+
+	repo := NewRepo(filepath.Join(tmp, "repo"))
+	err = repo.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
+
+	first := makeCommit(t, source, "fedora/x86_64/iot", "first")
+	second := makeCommit(t, source, "fedora/x86_64/iot", "second")
+
+	for _, cid := range []string{first, second} {
+		err = repo.PullLocal(source.Path(), cid, true)
+		if err != nil {
+			t.Fatalf("Failed to pull commit: %v", err)
+		}
+
+		err = repo.SetRef("acme/prod/x86_64", cid)
+		if err != nil {
+			t.Fatalf("Failed to set ref: %v", err)
+		}
+
+		head, err := repo.RevParse("acme/prod/x86_64")
+		if err != nil || head != cid {
+			t.Fatalf("Ref should point to %s, is: %s (%v)", cid, head, err)
+		}
+	}
+
+	_, err = repo.RevParse("fedora/x86_64/iot")
+	if err == nil {
+		t.Fatalf("Source ref should not have been created")
+	}
+}
+
+func TestDetachedMetadata(t *testing.T) {
+	requireOstree(t)
+
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := NewRepo(filepath.Join(tmp, "repo"))
+	err = repo.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
+
+	cid := makeCommit(t, repo, "otto/test", "meta")
+
+	meta, err := repo.DetachedMetadata(cid)
+	if err != nil || len(meta) != 0 {
+		t.Fatalf("Expected no detached metadata: %v (%v)", meta, err)
+	}
+
+	meta["otto.source.repository"] = StringVariant("iot")
+
+	err = repo.SetDetachedMetadata(cid, meta)
+	if err != nil {
+		t.Fatalf("Failed to set detached metadata: %v", err)
+	}
+
+	cmd := exec.Command("ostree", "show", "--repo", repo.Path(),
+		"--print-detached-metadata-key=otto.source.repository", cid)
+
+	out, err := cmd.Output()
+	if err != nil || strings.TrimSpace(string(out)) != "'iot'" {
+		t.Fatalf("ostree does not see the metadata: %s (%v)", string(out), err)
+	}
+}
+
+func TestParseLs(t *testing.T) {
+	dirsum := strings.Repeat("a", 64)
+	metasum := strings.Repeat("b", 64)
+	filesum := strings.Repeat("c", 64)
+
+	data := "d00755 0 0      0 " + dirsum + " " + metasum + " /\n" +
+		"-04755 0 0  51232 " + filesum + " /usr/bin/su do\n" +
+		"-00644 0 0      7 " + filesum + " /etc/two\nlines\n" +
+		"l00777 0 0      0 " + filesum + " /bin -> usr/bin\n"
+
+	paths := []string{"/", "/usr/bin/su do", "/etc/two\nlines", "/bin"}
+
+	files, err := parseLs(data, paths)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+
+	if len(files) != 4 {
+		t.Fatalf("Expected 4 files, got %d", len(files))
+	}
+
+	if files[0].Type != 'd' || files[0].Path != "/" || files[0].Checksum != dirsum {
+		t.Fatalf("Unexpected directory: %+v", files[0])
+	}
+
+	su := files[1]
+	if su.Type != '-' || su.Mode != 04755 || su.Size != 51232 || su.Path != "/usr/bin/su do" {
+		t.Fatalf("Unexpected file: %+v", su)
+	}
+
+	if files[2].Path != "/etc/two\nlines" || files[2].Size != 7 {
+		t.Fatalf("Unexpected file with a newline: %+v", files[2])
+	}
+
+	if files[3].Path != "/bin" || files[3].Target != "usr/bin" {
+		t.Fatalf("Unexpected symlink: %+v", files[3])
+	}
+
+	_, err = parseLs("garbage\n", []string{"/"})
+	if err == nil {
+		t.Fatalf("Parsing garbage should fail")
+	}
+
+	_, err = parseLs(data, paths[:2])
+	if err == nil {
+		t.Fatalf("Entries without a path should fail")
+	}
+}
+
+func TestParseVariantString(t *testing.T) {
+	tests := map[string]string{
+		`'x86_64'`:  "x86_64",
+		`"it's"`:    "it's",
+		`'a\'b\\c'`: `a'b\c`,
+		`''`:        "",
+	}
+
+	for text, want := range tests {
+		have, err := parseVariantString(text)
+		if err != nil || have != want {
+			t.Errorf("parseVariantString(%s): want %q, have %q (%v)", text, want, have, err)
+		}
+	}
+
+	for _, text := range []string{"", "'", "uint32 5", "'abc\""} {
+		if _, err := parseVariantString(text); err == nil {
+			t.Errorf("parseVariantString(%s): expected error", text)
+		}
 	}
 }
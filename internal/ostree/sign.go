@@ -0,0 +1,214 @@
+package ostree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// Signer signs commits and the summary of a repository
+type Signer interface {
+	SignCommit(repo *Repo, commit string) error
+
+	// Name under which the public keys are published
+	PublicKeyName() string
+	PublicKeys() ([]byte, error)
+
+	summaryArgs() []string
+}
+
+type GPGSigner struct {
+	Homedir string
+	KeyID   string
+}
+
+func NewGPGSigner(homedir string, keyID string) *GPGSigner {
+	return &GPGSigner{
+		Homedir: homedir,
+		KeyID:   keyID,
+	}
+}
+
+func (s *GPGSigner) SignCommit(repo *Repo, commit string) error {
+	cmd := exec.Command("ostree", "gpg-sign",
+		"--repo", repo.path,
+		"--gpg-homedir", s.Homedir,
+		commit, s.KeyID)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+
+	// signing is done for every import, re-imports included
+	if err != nil && strings.Contains(stderr.String(), "already signed") {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("gpg-sign failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func (s *GPGSigner) PublicKeyName() string {
+	return "otto.gpg"
+}
+
+func (s *GPGSigner) PublicKeys() ([]byte, error) {
+	cmd := exec.Command("gpg", "--homedir", s.Homedir, "--batch", "--armor", "--export", s.KeyID)
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err := cmd.Run()
+	if err != nil {
+		return nil, err
+	}
+
+	if res.Len() == 0 {
+		return nil, fmt.Errorf("key '%s' not found", s.KeyID)
+	}
+
+	return res.Bytes(), nil
+}
+
+func (s *GPGSigner) summaryArgs() []string {
+	return []string{"--gpg-sign", s.KeyID, "--gpg-homedir", s.Homedir}
+}
+
+// Ed25519Signer signs via `ostree sign` with the secret key stored,
+// base64 encoded, in KeyFile. Additional public keys, e.g. of keys
+// that are being rotated out, are published alongside the active one.
+type Ed25519Signer struct {
+	KeyFile string
+
+	// the active public key, first of publicKeys
+	key        ed25519.PublicKey
+	publicKeys []string
+}
+
+func NewEd25519Signer(keyFile string, extraKeys []string) (*Ed25519Signer, error) {
+	signer := &Ed25519Signer{
+		KeyFile: keyFile,
+	}
+
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		sk, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(sk) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid ed25519 secret key in '%s'", keyFile)
+		}
+
+		pk := ed25519.PrivateKey(sk).Public().(ed25519.PublicKey)
+		signer.key = pk
+		signer.publicKeys = append(signer.publicKeys, base64.StdEncoding.EncodeToString(pk))
+	}
+
+	if len(signer.publicKeys) != 1 {
+		return nil, fmt.Errorf("need exactly one ed25519 secret key in '%s'", keyFile)
+	}
+
+	for _, key := range extraKeys {
+		pk, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(pk) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key: '%s'", key)
+		}
+
+		signer.publicKeys = append(signer.publicKeys, key)
+	}
+
+	return signer, nil
+}
+
+// isSigned checks if commit already has a valid signature of the
+// active key
+func (s *Ed25519Signer) isSigned(repo *Repo, commit string) (bool, error) {
+	path, err := repo.objectPath(commit, "commit")
+	if err != nil {
+		return false, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+
+	meta, err := repo.DetachedMetadata(commit)
+	if err != nil {
+		return false, err
+	}
+
+	v, ok := meta["ostree.sign.ed25519"]
+	if !ok {
+		return false, nil
+	}
+
+	sigs, err := v.ByteArrays()
+	if err != nil {
+		return false, err
+	}
+
+	for _, sig := range sigs {
+		if len(sig) == ed25519.SignatureSize && ed25519.Verify(s.key, data, sig) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (s *Ed25519Signer) SignCommit(repo *Repo, commit string) error {
+	// signing is done for every import, re-imports included, and
+	// unlike gpg-sign, ostree sign happily adds the same signature
+	signed, err := s.isSigned(repo, commit)
+	if err != nil {
+		return fmt.Errorf("could not read signatures: %w", err)
+	} else if signed {
+		return nil
+	}
+
+	cmd := exec.Command("ostree", "sign",
+		"--repo", repo.path,
+		"--sign-type", "ed25519",
+		"--keys-file", s.KeyFile,
+		commit)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("sign failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+func (s *Ed25519Signer) PublicKeyName() string {
+	return "ed25519"
+}
+
+// PublicKeys returns all valid public keys, one per line, in the
+// format expected by ostree's `verification-ed25519-file`
+func (s *Ed25519Signer) PublicKeys() ([]byte, error) {
+	return []byte(strings.Join(s.publicKeys, "\n") + "\n"), nil
+}
+
+func (s *Ed25519Signer) summaryArgs() []string {
+	return []string{"--sign-type", "ed25519", "--keys-file", s.KeyFile}
+}
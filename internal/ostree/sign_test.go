@@ -0,0 +1,277 @@
+package ostree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeGPGKey(t *testing.T, homedir string) string {
+	_, err := exec.LookPath("gpg")
+	if err != nil {
+		t.Skip("gpg binary not available")
+	}
+
+	cmd := exec.Command("gpg", "--homedir", homedir, "--batch",
+		"--pinentry-mode", "loopback", "--passphrase", "",
+		"--quick-gen-key", "Otto Test <otto@example.com>", "default", "default", "never")
+
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("Failed to generate gpg key: %v", err)
+	}
+
+	cmd = exec.Command("gpg", "--homedir", homedir, "--batch", "--with-colons", "--list-keys")
+
+	var res bytes.Buffer
+	cmd.Stdout = &res
+
+	err = cmd.Run()
+	if err != nil {
+		t.Fatalf("Failed to list gpg keys: %v", err)
+	}
+
+	scanner := bufio.NewScanner(&res)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if fields[0] == "fpr" {
+			return fields[9]
+		}
+	}
+
+	t.Fatalf("Generated key not found")
+	return ""
+}
+
+func TestGPGSigner(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "otto")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	homedir := filepath.Join(tmp, "gpg")
+	err = os.Mkdir(homedir, 0700)
+	if err != nil {
+		t.Fatalf("Failed to create gpg homedir: %v", err)
+	}
+
+	keyID := makeGPGKey(t, homedir)
+	signer := NewGPGSigner(homedir, keyID)
+
+	data, err := signer.PublicKeys()
+	if err != nil {
+		t.Fatalf("Failed to export public key: %v", err)
+	}
+
+	if !bytes.HasPrefix(data, []byte("-----BEGIN PGP PUBLIC KEY BLOCK-----")) {
+		t.Fatalf("Exported key is not armored: %s", string(data))
+	}
+
+	missing := NewGPGSigner(homedir, "0000000000000000")
+	_, err = missing.PublicKeys()
+	if err == nil {
+		t.Fatalf("Exporting a missing key should fail")
+	}
+
+	requireOstree(t)
+
+	repo := NewRepo(filepath.Join(tmp, "repo"))
+	err = repo.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
+
+	repo.AddSigner(signer)
+
+	cid := makeCommit(t, repo, "otto/test", "signed")
+
+	err = repo.SignCommit(cid)
+	if err != nil {
+		t.Fatalf("Failed to sign commit: %v", err)
+	}
+
+	// signing again must not fail
+	err = repo.SignCommit(cid)
+	if err != nil {
+		t.Fatalf("Failed to sign commit again: %v", err)
+	}
+
+	err = repo.UpdateSummary()
+	if err != nil {
+		t.Fatalf("Failed to update signed summary: %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(repo.Path(), "summary.sig"))
+	if err != nil {
+		t.Fatalf("summary signature is missing: %v", err)
+	}
+}
+
+func TestEd25519Signer(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	pk, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	old, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	keyFile := filepath.Join(tmp, "ed25519.secret")
+	err = ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(sk)+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	_, err = NewEd25519Signer(keyFile, []string{"invalid"})
+	if err == nil {
+		t.Fatalf("Invalid public keys should be rejected")
+	}
+
+	signer, err := NewEd25519Signer(keyFile, []string{base64.StdEncoding.EncodeToString(old)})
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	data, err := signer.PublicKeys()
+	if err != nil {
+		t.Fatalf("Failed to get public keys: %v", err)
+	}
+
+	keys := strings.Fields(string(data))
+	if len(keys) != 2 {
+		t.Fatalf("Expected two public keys, got: %v", keys)
+	}
+
+	if keys[0] != base64.StdEncoding.EncodeToString(pk) {
+		t.Fatalf("Active public key should come first, got: %s", keys[0])
+	}
+
+	requireOstree(t)
+
+	repo := NewRepo(filepath.Join(tmp, "repo"))
+	err = repo.Init(ARCHIVE)
+	if err != nil {
+		t.Fatalf("repo init failed: %v", err)
+	}
+
+	repo.AddSigner(signer)
+
+	cid := makeCommit(t, repo, "otto/test", "signed")
+
+	err = repo.SignCommit(cid)
+	if err != nil {
+		t.Fatalf("Failed to sign commit: %v", err)
+	}
+
+	// signing again must not add a duplicate signature
+	err = repo.SignCommit(cid)
+	if err != nil {
+		t.Fatalf("Failed to sign commit again: %v", err)
+	}
+
+	meta, err := repo.DetachedMetadata(cid)
+	if err != nil {
+		t.Fatalf("Failed to read detached metadata: %v", err)
+	}
+
+	sigs, err := meta["ostree.sign.ed25519"].ByteArrays()
+	if err != nil || len(sigs) != 1 {
+		t.Fatalf("Expected a single signature, got %d (%v)", len(sigs), err)
+	}
+
+	err = repo.UpdateSummary()
+	if err != nil {
+		t.Fatalf("Failed to update signed summary: %v", err)
+	}
+}
+
+func TestEd25519SignerIsSigned(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	_, other, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	keyFile := filepath.Join(tmp, "ed25519.secret")
+	err = ioutil.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(sk)+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	signer, err := NewEd25519Signer(keyFile, nil)
+	if err != nil {
+		t.Fatalf("Failed to create signer: %v", err)
+	}
+
+	repo := NewRepo(tmp)
+	commit := strings.Repeat("ab", 32)
+	data := []byte("commit")
+
+	path, _ := repo.objectPath(commit, "commit")
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err == nil {
+		err = ioutil.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		t.Fatalf("Failed to write commit: %v", err)
+	}
+
+	sign := func(keys ...ed25519.PrivateKey) {
+		var sigs [][]byte
+		for _, k := range keys {
+			sigs = append(sigs, ed25519.Sign(k, data))
+		}
+
+		meta := map[string]Variant{"ostree.sign.ed25519": ByteArraysVariant(sigs)}
+		err := repo.SetDetachedMetadata(commit, meta)
+		if err != nil {
+			t.Fatalf("Failed to write signatures: %v", err)
+		}
+	}
+
+	for _, tc := range []struct {
+		keys   []ed25519.PrivateKey
+		signed bool
+	}{
+		{nil, false},
+		{[]ed25519.PrivateKey{other}, false},
+		{[]ed25519.PrivateKey{other, sk}, true},
+	} {
+		sign(tc.keys...)
+
+		signed, err := signer.isSigned(repo, commit)
+		if err != nil {
+			t.Fatalf("Failed to check signatures: %v", err)
+		}
+
+		if signed != tc.signed {
+			t.Fatalf("Expected signed to be %v with %d signatures", tc.signed, len(tc.keys))
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package ostree
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// TrustStore holds the keys commit signatures are verified against
+type TrustStore struct {
+	// keyrings with trusted GPG keys, as used by gpgv
+	GPGKeyrings []string
+	Ed25519Keys []ed25519.PublicKey
+}
+
+// ParseEd25519Keys parses base64 encoded public keys, one per line,
+// like in ostree's `verification-ed25519-file`
+func ParseEd25519Keys(data []byte) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		pk, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(pk) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key: '%s'", line)
+		}
+
+		keys = append(keys, ed25519.PublicKey(pk))
+	}
+
+	return keys, scanner.Err()
+}
+
+// Signature is the result of verifying a single signature
+type Signature struct {
+	// "gpg" or "ed25519"
+	Type string `json:"type"`
+	// fingerprint or key id of the GPG key, the public key for
+	// valid ed25519 signatures
+	KeyID string `json:"key-id,omitempty"`
+	// user id of the GPG key
+	Signer string `json:"signer,omitempty"`
+	// valid signature from a trusted key
+	Valid   bool   `json:"valid"`
+	Message string `json:"message,omitempty"`
+}
+
+func (sig Signature) String() string {
+	s := sig.Type
+	if sig.KeyID != "" {
+		s += " " + sig.KeyID
+	}
+	if sig.Signer != "" {
+		s += " (" + sig.Signer + ")"
+	}
+	if sig.Message != "" {
+		s += ": " + sig.Message
+	}
+	return s
+}
+
+// VerifyCommit verifies all signatures of commit against the keys in
+// trust, after checking that the commit object matches its checksum;
+// like ostree, signatures of unsupported types are ignored
+func (repo *Repo) VerifyCommit(commit string, trust *TrustStore) ([]Signature, error) {
+	path, err := repo.objectPath(commit, "commit")
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read commit: %w", err)
+	}
+
+	// the signatures are over the commit object, which must be the
+	// one its checksum claims
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != commit {
+		return nil, fmt.Errorf("checksum of commit %s does not match", commit)
+	}
+
+	meta, err := repo.DetachedMetadata(commit)
+	if err != nil {
+		return nil, fmt.Errorf("could not read detached metadata: %w", err)
+	}
+
+	var res []Signature
+
+	if v, ok := meta["ostree.sign.ed25519"]; ok {
+		sigs, err := v.ByteArrays()
+		if err != nil {
+			return nil, fmt.Errorf("invalid ed25519 signatures: %w", err)
+		}
+
+		for _, sig := range sigs {
+			res = append(res, verifyEd25519(data, sig, trust.Ed25519Keys))
+		}
+	}
+
+	if v, ok := meta["ostree.gpgsigs"]; ok {
+		sigs, err := v.ByteArrays()
+		if err != nil {
+			return nil, fmt.Errorf("invalid gpg signatures: %w", err)
+		}
+
+		for _, sig := range sigs {
+			s, err := verifyGPG(data, sig, trust.GPGKeyrings)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, s...)
+		}
+	}
+
+	return res, nil
+}
+
+func verifyEd25519(data []byte, sig []byte, keys []ed25519.PublicKey) Signature {
+	res := Signature{Type: "ed25519"}
+
+	if len(sig) != ed25519.SignatureSize {
+		res.Message = "invalid signature"
+		return res
+	}
+
+	for _, pk := range keys {
+		if ed25519.Verify(pk, data, sig) {
+			res.KeyID = base64.StdEncoding.EncodeToString(pk)
+			res.Valid = true
+			return res
+		}
+	}
+
+	res.Message = "not signed by a trusted key"
+	return res
+}
+
+func verifyGPG(data []byte, sig []byte, keyrings []string) ([]Signature, error) {
+	tmp, err := ioutil.TempDir("", "otto-gpgv-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	dataFile := filepath.Join(tmp, "commit")
+	sigFile := filepath.Join(tmp, "commit.sig")
+
+	err = ioutil.WriteFile(dataFile, data, 0600)
+	if err == nil {
+		err = ioutil.WriteFile(sigFile, sig, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{"--homedir", tmp, "--status-fd", "1"}
+
+	// gpgv falls back to a default keyring, which must not be trusted
+	if len(keyrings) == 0 {
+		empty := filepath.Join(tmp, "empty.gpg")
+		err = ioutil.WriteFile(empty, nil, 0600)
+		if err != nil {
+			return nil, err
+		}
+		keyrings = []string{empty}
+	}
+
+	for _, keyring := range keyrings {
+		abs, err := filepath.Abs(keyring)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--keyring", abs)
+	}
+
+	args = append(args, sigFile, dataFile)
+
+	cmd := exec.Command("gpgv", args...)
+
+	var status bytes.Buffer
+	cmd.Stdout = &status
+
+	// gpgv fails for invalid signatures, which is reported via
+	// the status output; anything else is an error
+	err = cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, fmt.Errorf("could not run gpgv: %w", err)
+	}
+
+	return parseGPGStatus(&status)
+}
+
+// parseGPGStatus parses the machine readable output of gpgv, see
+// doc/DETAILS in the GnuPG sources
+func parseGPGStatus(r io.Reader) ([]Signature, error) {
+	var res []Signature
+	var cur *Signature
+
+	newSig := func(keyID string, signer string) *Signature {
+		res = append(res, Signature{Type: "gpg", KeyID: keyID, Signer: signer})
+		return &res[len(res)-1]
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] != "[GNUPG:]" {
+			continue
+		}
+
+		keyword, keyID := fields[1], fields[2]
+		signer := strings.Join(fields[3:], " ")
+
+		switch keyword {
+		case "GOODSIG":
+			cur = newSig(keyID, signer)
+		case "EXPKEYSIG":
+			cur = newSig(keyID, signer)
+			cur.Message = "key expired"
+		case "REVKEYSIG":
+			cur = newSig(keyID, signer)
+			cur.Message = "key revoked"
+		case "EXPSIG":
+			cur = newSig(keyID, signer)
+			cur.Message = "signature expired"
+		case "BADSIG":
+			cur = newSig(keyID, signer)
+			cur.Message = "bad signature"
+		case "ERRSIG":
+			cur = newSig(keyID, "")
+			cur.Message = "could not verify signature"
+		case "NO_PUBKEY":
+			if cur != nil && cur.KeyID == keyID {
+				cur.Message = "unknown key"
+			}
+		case "VALIDSIG":
+			if cur != nil && cur.Message == "" {
+				cur.KeyID = keyID
+				cur.Valid = true
+			}
+		}
+	}
+
+	return res, scanner.Err()
+}
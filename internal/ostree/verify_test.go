@@ -0,0 +1,205 @@
+package ostree
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeCommitObject writes a fake commit object, which is enough
+// for verifying signatures
+func writeCommitObject(t *testing.T, repo *Repo, checksum string, data []byte) {
+	path, err := repo.objectPath(checksum, "commit")
+	if err != nil {
+		t.Fatalf("Invalid checksum: %v", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		t.Fatalf("Failed to create object dir: %v", err)
+	}
+
+	err = ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatalf("Failed to write commit object: %v", err)
+	}
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	repo := NewRepo(tmp)
+	data := []byte("not really a commit")
+	cid := checksum(data)
+
+	writeCommitObject(t, repo, cid, data)
+
+	pk, sk, _ := ed25519.GenerateKey(nil)
+	other, _, _ := ed25519.GenerateKey(nil)
+
+	trust := &TrustStore{Ed25519Keys: []ed25519.PublicKey{other, pk}}
+
+	sigs, err := repo.VerifyCommit(cid, trust)
+	if err != nil || len(sigs) != 0 {
+		t.Fatalf("Unsigned commit should have no signatures: %v, %v", sigs, err)
+	}
+
+	err = repo.SetDetachedMetadata(cid, map[string]Variant{
+		"ostree.sign.ed25519": ByteArraysVariant([][]byte{
+			ed25519.Sign(sk, []byte("something else")),
+			ed25519.Sign(sk, data),
+		}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to write detached metadata: %v", err)
+	}
+
+	sigs, err = repo.VerifyCommit(cid, trust)
+	if err != nil {
+		t.Fatalf("Failed to verify commit: %v", err)
+	}
+
+	if len(sigs) != 2 || sigs[0].Valid || !sigs[1].Valid {
+		t.Fatalf("Unexpected signatures: %+v", sigs)
+	}
+
+	sigs, err = repo.VerifyCommit(cid, &TrustStore{Ed25519Keys: []ed25519.PublicKey{other}})
+	if err != nil || len(sigs) != 2 || sigs[0].Valid || sigs[1].Valid {
+		t.Fatalf("Untrusted key should not verify: %+v (%v)", sigs, err)
+	}
+
+	// a commit object that does not match its checksum
+	forged := strings.Repeat("ab", 32)
+	writeCommitObject(t, repo, forged, data)
+
+	_, err = repo.VerifyCommit(forged, trust)
+	if err == nil {
+		t.Fatalf("Commit with a wrong checksum should not verify")
+	}
+}
+
+func TestVerifyGPG(t *testing.T) {
+	if _, err := exec.LookPath("gpgv"); err != nil {
+		t.Skip("gpgv binary not available")
+	}
+
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	homedir := filepath.Join(tmp, "gnupg")
+	err = os.Mkdir(homedir, 0700)
+	if err != nil {
+		t.Fatalf("Failed to create gpg homedir: %v", err)
+	}
+
+	fpr := makeGPGKey(t, homedir)
+
+	keyring := filepath.Join(tmp, "trusted.gpg")
+	err = exec.Command("gpg", "--homedir", homedir, "--batch", "--output", keyring, "--export", fpr).Run()
+	if err != nil {
+		t.Fatalf("Failed to export key: %v", err)
+	}
+
+	repo := NewRepo(filepath.Join(tmp, "repo"))
+	data := []byte("not really a commit either")
+	cid := checksum(data)
+
+	writeCommitObject(t, repo, cid, data)
+
+	dataFile := filepath.Join(tmp, "data")
+	err = ioutil.WriteFile(dataFile, data, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write data: %v", err)
+	}
+
+	sig, err := exec.Command("gpg", "--homedir", homedir, "--batch", "--detach-sign", "--output", "-", dataFile).Output()
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	err = repo.SetDetachedMetadata(cid, map[string]Variant{
+		"ostree.gpgsigs": ByteArraysVariant([][]byte{sig}),
+	})
+	if err != nil {
+		t.Fatalf("Failed to write detached metadata: %v", err)
+	}
+
+	sigs, err := repo.VerifyCommit(cid, &TrustStore{GPGKeyrings: []string{keyring}})
+	if err != nil {
+		t.Fatalf("Failed to verify commit: %v", err)
+	}
+
+	if len(sigs) != 1 || !sigs[0].Valid || sigs[0].KeyID != fpr {
+		t.Fatalf("Unexpected signatures: %+v", sigs)
+	}
+
+	if !strings.Contains(sigs[0].Signer, "otto@example.com") {
+		t.Fatalf("Signer missing: %+v", sigs[0])
+	}
+
+	sigs, err = repo.VerifyCommit(cid, &TrustStore{})
+	if err != nil {
+		t.Fatalf("Failed to verify commit: %v", err)
+	}
+
+	if len(sigs) != 1 || sigs[0].Valid || sigs[0].Message != "unknown key" {
+		t.Fatalf("Unknown key should not verify: %+v", sigs)
+	}
+}
+
+func TestParseGPGStatus(t *testing.T) {
+	data := `[GNUPG:] NEWSIG
+[GNUPG:] KEY_CONSIDERED 0123456789ABCDEF0123456789ABCDEF01234567 0
+[GNUPG:] EXPKEYSIG 89ABCDEF01234567 Old Key <old@example.com>
+[GNUPG:] VALIDSIG 0123456789ABCDEF0123456789ABCDEF01234567 2021-06-01 1622548800 0 4 0 22 10 00 0123456789ABCDEF0123456789ABCDEF01234567
+[GNUPG:] NEWSIG
+[GNUPG:] ERRSIG 1111222233334444 22 10 00 1622548800 9 -
+[GNUPG:] NO_PUBKEY 1111222233334444
+[GNUPG:] NEWSIG
+[GNUPG:] BADSIG 5555666677778888 Evil <evil@example.com>
+`
+	sigs, err := parseGPGStatus(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Failed to parse status: %v", err)
+	}
+
+	if len(sigs) != 3 {
+		t.Fatalf("Expected 3 signatures, got: %+v", sigs)
+	}
+
+	for _, sig := range sigs {
+		if sig.Valid {
+			t.Errorf("Signature should be invalid: %+v", sig)
+		}
+	}
+
+	if sigs[0].Message != "key expired" || sigs[0].Signer != "Old Key <old@example.com>" {
+		t.Errorf("Unexpected signature: %+v", sigs[0])
+	}
+
+	if sigs[1].Message != "unknown key" || sigs[1].KeyID != "1111222233334444" {
+		t.Errorf("Unexpected signature: %+v", sigs[1])
+	}
+
+	if sigs[2].Message != "bad signature" {
+		t.Errorf("Unexpected signature: %+v", sigs[2])
+	}
+}
@@ -0,0 +1,352 @@
+package tlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A transparency log of ref updates: the entries are the leaves of a
+// Merkle tree, whose head is signed, and stored as JSON lines. The
+// leaf data of an entry is its line, without the newline.
+
+func (h Hash) String() string {
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	data, err := base64.StdEncoding.DecodeString(string(text))
+	if err != nil || len(data) != len(h) {
+		return fmt.Errorf("invalid hash: '%s'", text)
+	}
+
+	copy(h[:], data)
+	return nil
+}
+
+// Entry is an update of a ref from the previous commit, if any, to
+// commit, which was imported from the image with the manifest
+type Entry struct {
+	Ref      string    `json:"ref"`
+	Previous string    `json:"previous,omitempty"`
+	Commit   string    `json:"commit"`
+	Manifest string    `json:"manifest,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// LeafEntry is an entry with its index and leaf data
+type LeafEntry struct {
+	Index uint64 `json:"index"`
+	Leaf  []byte `json:"leaf_input"`
+	Entry Entry  `json:"entry"`
+}
+
+// SignedTreeHead is the signed size and root hash of the log; the
+// signature is over the text returned by Message
+type SignedTreeHead struct {
+	Origin    string `json:"origin"`
+	Size      uint64 `json:"tree_size"`
+	Root      Hash   `json:"root_hash"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+// Message returns the signed text, which has the lines "otto-tlog-v1",
+// the origin, the size, the timestamp in milliseconds and the root
+// hash, base64 encoded
+func (sth *SignedTreeHead) Message() []byte {
+	return []byte(fmt.Sprintf("otto-tlog-v1\n%s\n%d\n%d\n%s\n", sth.Origin, sth.Size, sth.Timestamp, sth.Root))
+}
+
+// Verify checks the signature of the tree head
+func (sth *SignedTreeHead) Verify(key ed25519.PublicKey) error {
+	if !ed25519.Verify(key, sth.Message(), sth.Signature) {
+		return errors.New("invalid tree head signature")
+	}
+	return nil
+}
+
+// ParseSecretKey parses a base64 encoded ed25519 secret key, in the
+// format of the secret key files of `ostree sign`
+func ParseSecretKey(data []byte) (ed25519.PrivateKey, error) {
+	sk, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(sk) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 secret key")
+	}
+
+	return ed25519.PrivateKey(sk), nil
+}
+
+type Log struct {
+	mu     sync.Mutex
+	path   string
+	origin string
+	key    ed25519.PrivateKey
+
+	leaves  [][]byte
+	hashes  []Hash
+	commits map[string]uint64
+}
+
+// Open opens the log at path, creating it if needed; the tree heads
+// are signed with key and carry origin, the name of the log
+func Open(path string, origin string, key ed25519.PrivateKey) (*Log, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{
+		path:    path,
+		origin:  origin,
+		key:     key,
+		commits: make(map[string]uint64),
+	}
+
+	err = trimPartial(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not trim partial entry: %w", err)
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for scanner.Scan() {
+		leaf := bytes.TrimSpace(scanner.Bytes())
+		if len(leaf) == 0 {
+			continue
+		}
+
+		var e Entry
+		err = json.Unmarshal(leaf, &e)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", len(l.leaves), err)
+		}
+
+		l.add(append([]byte(nil), leaf...), &e)
+	}
+
+	return l, scanner.Err()
+}
+
+// trimPartial removes a partial entry at the end of the log at path,
+// which a crash during Append can leave; it was never acknowledged
+func trimPartial(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := fi.Size()
+	buf := make([]byte, 4096)
+
+	// search the last newline, backwards from the end
+	for end := size; end > 0; {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+
+		_, err = f.ReadAt(buf[:n], end-n)
+		if err != nil {
+			return err
+		}
+
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			if keep := end - n + int64(i) + 1; keep < size {
+				return f.Truncate(keep)
+			}
+			return nil
+		}
+
+		end -= n
+	}
+
+	return f.Truncate(0)
+}
+
+func commitKey(ref string, commit string) string {
+	return ref + "\x00" + commit
+}
+
+func (l *Log) add(leaf []byte, e *Entry) uint64 {
+	index := uint64(len(l.leaves))
+
+	l.leaves = append(l.leaves, leaf)
+	l.hashes = append(l.hashes, LeafHash(leaf))
+	l.commits[commitKey(e.Ref, e.Commit)] = index
+
+	return index
+}
+
+// PublicKey returns the key tree heads can be verified with
+func (l *Log) PublicKey() ed25519.PublicKey {
+	return l.key.Public().(ed25519.PublicKey)
+}
+
+// Append adds the entry to the log and returns its index
+func (l *Log) Append(e Entry) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	e.Time = e.Time.UTC()
+
+	leaf, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, err
+	}
+
+	_, err = f.Write(append(leaf, '\n'))
+	if err == nil {
+		err = f.Sync()
+	}
+
+	// a partial entry would make the log unreadable
+	if err != nil {
+		if terr := f.Truncate(fi.Size()); terr != nil {
+			fmt.Printf("Could not remove partial log entry: %v\n", terr)
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return l.add(leaf, &e), nil
+}
+
+func (l *Log) Size() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return uint64(len(l.leaves))
+}
+
+// Find returns the index of the latest entry that updated ref to commit
+func (l *Log) Find(ref string, commit string) (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	index, ok := l.commits[commitKey(ref, commit)]
+	return index, ok
+}
+
+// Entries returns the entries from start up to, but excluding, end
+func (l *Log) Entries(start uint64, end uint64) ([]LeafEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if end > uint64(len(l.leaves)) {
+		end = uint64(len(l.leaves))
+	}
+
+	if start > end {
+		return nil, fmt.Errorf("invalid range %d-%d", start, end)
+	}
+
+	res := make([]LeafEntry, 0, end-start)
+
+	for i := start; i < end; i++ {
+		le := LeafEntry{Index: i, Leaf: l.leaves[i]}
+
+		err := json.Unmarshal(l.leaves[i], &le.Entry)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, le)
+	}
+
+	return res, nil
+}
+
+// TreeHead returns the signed head of the current tree
+func (l *Log) TreeHead(now time.Time) *SignedTreeHead {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sth := &SignedTreeHead{
+		Origin:    l.origin,
+		Size:      uint64(len(l.hashes)),
+		Root:      RootHash(l.hashes),
+		Timestamp: now.UnixNano() / int64(time.Millisecond),
+	}
+
+	sth.Signature = ed25519.Sign(l.key, sth.Message())
+	return sth
+}
+
+// InclusionProof returns the proof that the entry at index is part
+// of the tree of the size
+func (l *Log) InclusionProof(index uint64, size uint64) ([]Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if size > uint64(len(l.hashes)) {
+		return nil, fmt.Errorf("tree of size %d does not exist", size)
+	}
+
+	proof, err := InclusionProof(index, l.hashes[:size])
+	if proof == nil && err == nil {
+		proof = []Hash{}
+	}
+
+	return proof, err
+}
+
+// ConsistencyProof returns the proof that the tree of the first size
+// is a prefix of the tree of the second size
+func (l *Log) ConsistencyProof(first uint64, second uint64) ([]Hash, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if second > uint64(len(l.hashes)) {
+		return nil, fmt.Errorf("tree of size %d does not exist", second)
+	}
+
+	return ConsistencyProof(first, l.hashes[:second])
+}
@@ -0,0 +1,183 @@
+package tlog
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	key, err := ParseSecretKey([]byte(base64.StdEncoding.EncodeToString(sk) + "\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+
+	path := filepath.Join(tmp, "tlog", "entries.jsonl")
+
+	l, err := Open(path, "otto.example.com", key)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	previous := ""
+
+	for i := 0; i < 5; i++ {
+		commit := fmt.Sprintf("%064x", i)
+
+		index, err := l.Append(Entry{
+			Ref:      "fedora/x86_64/iot",
+			Previous: previous,
+			Commit:   commit,
+			Manifest: fmt.Sprintf("sha256:%064x", i+100),
+			Time:     now.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil || index != uint64(i) {
+			t.Fatalf("Failed to append entry: %d, %v", index, err)
+		}
+
+		previous = commit
+	}
+
+	old := l.TreeHead(now)
+
+	_, err = l.Append(Entry{Ref: "fedora/x86_64/coreos", Commit: fmt.Sprintf("%064x", 99), Time: now})
+	if err != nil {
+		t.Fatalf("Failed to append entry: %v", err)
+	}
+
+	// reopening restores the tree
+	l, err = Open(path, "otto.example.com", key)
+	if err != nil {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+
+	sth := l.TreeHead(now.Add(time.Hour))
+	if sth.Size != 6 || sth.Verify(l.PublicKey()) != nil {
+		t.Fatalf("Unexpected tree head: %+v", sth)
+	}
+
+	tampered := *sth
+	tampered.Size = 5
+	if tampered.Verify(l.PublicKey()) == nil {
+		t.Fatalf("Tampered tree head should not verify")
+	}
+
+	index, ok := l.Find("fedora/x86_64/iot", fmt.Sprintf("%064x", 3))
+	if !ok || index != 3 {
+		t.Fatalf("Entry not found: %d, %v", index, ok)
+	}
+
+	entries, err := l.Entries(3, 10)
+	if err != nil || len(entries) != 3 || entries[0].Entry.Previous != fmt.Sprintf("%064x", 2) {
+		t.Fatalf("Unexpected entries: %+v, %v", entries, err)
+	}
+
+	proof, err := l.InclusionProof(index, sth.Size)
+	if err != nil {
+		t.Fatalf("Failed to create inclusion proof: %v", err)
+	}
+
+	err = VerifyInclusion(LeafHash(entries[0].Leaf), index, sth.Size, proof, sth.Root)
+	if err != nil {
+		t.Fatalf("Inclusion proof does not verify: %v", err)
+	}
+
+	proof, err = l.ConsistencyProof(old.Size, sth.Size)
+	if err != nil {
+		t.Fatalf("Failed to create consistency proof: %v", err)
+	}
+
+	err = VerifyConsistency(old.Size, sth.Size, proof, old.Root, sth.Root)
+	if err != nil {
+		t.Fatalf("Consistency proof does not verify: %v", err)
+	}
+
+	_, err = l.InclusionProof(0, 7)
+	if err == nil {
+		t.Fatalf("Proofs for trees that do not exist should fail")
+	}
+}
+
+func TestLogPartialEntry(t *testing.T) {
+	tmp, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	key, err := ParseSecretKey([]byte(base64.StdEncoding.EncodeToString(sk) + "\n"))
+	if err != nil {
+		t.Fatalf("Failed to parse key: %v", err)
+	}
+
+	path := filepath.Join(tmp, "entries.jsonl")
+
+	l, err := Open(path, "otto.example.com", key)
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		_, err = l.Append(Entry{Ref: "fedora/x86_64/iot", Commit: fmt.Sprintf("%064x", i), Time: now})
+		if err != nil {
+			t.Fatalf("Failed to append entry: %v", err)
+		}
+	}
+
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read log: %v", err)
+	}
+
+	// what an interrupted append leaves behind
+	partial := append(append([]byte{}, before...), []byte(`{"ref":"fedora/x86_64/iot","com`)...)
+	err = ioutil.WriteFile(path, partial, 0600)
+	if err != nil {
+		t.Fatalf("Failed to write log: %v", err)
+	}
+
+	l, err = Open(path, "otto.example.com", key)
+	if err != nil {
+		t.Fatalf("Failed to open log with a partial entry: %v", err)
+	}
+
+	after, err := ioutil.ReadFile(path)
+	if err != nil || string(after) != string(before) {
+		t.Fatalf("Partial entry was not removed: %q, %v", after, err)
+	}
+
+	index, err := l.Append(Entry{Ref: "fedora/x86_64/iot", Commit: fmt.Sprintf("%064x", 2), Time: now})
+	if err != nil || index != 2 {
+		t.Fatalf("Failed to append entry: %d, %v", index, err)
+	}
+
+	l, err = Open(path, "otto.example.com", key)
+	if err != nil || l.TreeHead(now).Size != 3 {
+		t.Fatalf("Failed to reopen log: %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package tlog
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Merkle tree hashes and proofs as defined by RFC 6962, section 2.1;
+// the verification follows RFC 9162, sections 2.1.3.2 and 2.1.4.2.
+
+type Hash [sha256.Size]byte
+
+var ErrInvalidProof = errors.New("invalid proof")
+
+// LeafHash returns the hash of the leaf with the data
+func LeafHash(data []byte) Hash {
+	return sha256.Sum256(append([]byte{0x00}, data...))
+}
+
+func nodeHash(left Hash, right Hash) Hash {
+	data := make([]byte, 0, 1+2*sha256.Size)
+	data = append(data, 0x01)
+	data = append(data, left[:]...)
+	data = append(data, right[:]...)
+	return sha256.Sum256(data)
+}
+
+// split returns the largest power of two smaller than n
+func split(n uint64) uint64 {
+	k := uint64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// RootHash returns the Merkle tree hash of the leaves
+func RootHash(leaves []Hash) Hash {
+	switch n := uint64(len(leaves)); n {
+	case 0:
+		return sha256.Sum256(nil)
+	case 1:
+		return leaves[0]
+	default:
+		k := split(n)
+		return nodeHash(RootHash(leaves[:k]), RootHash(leaves[k:]))
+	}
+}
+
+// InclusionProof returns the audit path of leaf m in the tree of
+// the leaves
+func InclusionProof(m uint64, leaves []Hash) ([]Hash, error) {
+	n := uint64(len(leaves))
+	if m >= n {
+		return nil, fmt.Errorf("leaf %d not in tree of size %d", m, n)
+	}
+
+	return path(m, leaves), nil
+}
+
+func path(m uint64, leaves []Hash) []Hash {
+	n := uint64(len(leaves))
+	if n <= 1 {
+		return nil
+	}
+
+	k := split(n)
+	if m < k {
+		return append(path(m, leaves[:k]), RootHash(leaves[k:]))
+	}
+
+	return append(path(m-k, leaves[k:]), RootHash(leaves[:k]))
+}
+
+// ConsistencyProof returns the proof that the tree of the first m
+// leaves is a prefix of the tree of the leaves
+func ConsistencyProof(m uint64, leaves []Hash) ([]Hash, error) {
+	n := uint64(len(leaves))
+	if m > n {
+		return nil, fmt.Errorf("tree of size %d is larger than %d", m, n)
+	}
+
+	if m == 0 || m == n {
+		return []Hash{}, nil
+	}
+
+	return subproof(m, leaves, true), nil
+}
+
+func subproof(m uint64, leaves []Hash, complete bool) []Hash {
+	n := uint64(len(leaves))
+	if m == n {
+		if complete {
+			return nil
+		}
+		return []Hash{RootHash(leaves)}
+	}
+
+	k := split(n)
+	if m <= k {
+		return append(subproof(m, leaves[:k], complete), RootHash(leaves[k:]))
+	}
+
+	return append(subproof(m-k, leaves[k:], false), RootHash(leaves[:k]))
+}
+
+// VerifyInclusion checks that the leaf with the hash is at index in
+// the tree of the size with the root
+func VerifyInclusion(leaf Hash, index uint64, size uint64, proof []Hash, root Hash) error {
+	if index >= size {
+		return fmt.Errorf("%w: index %d not in tree of size %d", ErrInvalidProof, index, size)
+	}
+
+	fn, sn := index, size-1
+	r := leaf
+
+	for _, p := range proof {
+		if sn == 0 {
+			return fmt.Errorf("%w: proof too long", ErrInvalidProof)
+		}
+
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || r != root {
+		return ErrInvalidProof
+	}
+
+	return nil
+}
+
+// VerifyConsistency checks that the tree of the first size with the
+// first root is a prefix of the tree of the second size and root
+func VerifyConsistency(first uint64, second uint64, proof []Hash, firstRoot Hash, secondRoot Hash) error {
+	switch {
+	case first > second:
+		return fmt.Errorf("%w: tree of size %d is larger than %d", ErrInvalidProof, first, second)
+
+	case first == second:
+		if len(proof) != 0 || firstRoot != secondRoot {
+			return ErrInvalidProof
+		}
+		return nil
+
+	case first == 0:
+		if len(proof) != 0 {
+			return ErrInvalidProof
+		}
+		return nil
+
+	case len(proof) == 0:
+		return ErrInvalidProof
+	}
+
+	// the first tree is a complete subtree of the second
+	if first&(first-1) == 0 {
+		proof = append([]Hash{firstRoot}, proof...)
+	}
+
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+
+	fr, sr := proof[0], proof[0]
+
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return fmt.Errorf("%w: proof too long", ErrInvalidProof)
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 || fr != firstRoot || sr != secondRoot {
+		return ErrInvalidProof
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package tlog
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// the leaves and root hashes of the Certificate Transparency reference
+// implementation's test vectors
+var testLeaves = []string{
+	"",
+	"00",
+	"10",
+	"2021",
+	"3031",
+	"40414243",
+	"5051525354555657",
+	"606162636465666768696a6b6c6d6e6f",
+}
+
+var testRoots = []string{
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+func testHashes(t *testing.T, n int) []Hash {
+	var hashes []Hash
+
+	for i := 0; i < n; i++ {
+		leaf := testLeaves[i%len(testLeaves)]
+		data, err := hex.DecodeString(leaf)
+		if err != nil {
+			t.Fatalf("Invalid test leaf: %v", err)
+		}
+
+		// make the leaves beyond the test vectors unique
+		if i >= len(testLeaves) {
+			data = append(data, byte(i))
+		}
+
+		hashes = append(hashes, LeafHash(data))
+	}
+
+	return hashes
+}
+
+func TestRootHash(t *testing.T) {
+	empty := RootHash(nil)
+	if hex.EncodeToString(empty[:]) != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("Unexpected root of the empty tree: %x", empty)
+	}
+
+	hashes := testHashes(t, len(testLeaves))
+
+	for i, want := range testRoots {
+		root := RootHash(hashes[:i+1])
+		if hex.EncodeToString(root[:]) != want {
+			t.Errorf("Root of %d leaves: expected %s, got %x", i+1, want, root)
+		}
+	}
+}
+
+func TestProofs(t *testing.T) {
+	hashes := testHashes(t, 20)
+
+	for n := uint64(1); n <= uint64(len(hashes)); n++ {
+		tree := hashes[:n]
+		root := RootHash(tree)
+
+		for m := uint64(0); m < n; m++ {
+			proof, err := InclusionProof(m, tree)
+			if err != nil {
+				t.Fatalf("Failed to create inclusion proof: %v", err)
+			}
+
+			err = VerifyInclusion(tree[m], m, n, proof, root)
+			if err != nil {
+				t.Errorf("Inclusion of %d in %d: %v", m, n, err)
+			}
+
+			// the proof is only valid for the leaf and the index
+			if VerifyInclusion(tree[(m+1)%n], m, n, proof, root) == nil && n > 1 {
+				t.Errorf("Inclusion of %d in %d: wrong leaf accepted", m, n)
+			}
+		}
+
+		for m := uint64(1); m <= n; m++ {
+			proof, err := ConsistencyProof(m, tree)
+			if err != nil {
+				t.Fatalf("Failed to create consistency proof: %v", err)
+			}
+
+			first := RootHash(tree[:m])
+
+			err = VerifyConsistency(m, n, proof, first, root)
+			if err != nil {
+				t.Errorf("Consistency of %d and %d: %v", m, n, err)
+			}
+
+			if m < n && VerifyConsistency(m, n, proof, hashes[0], root) == nil && m > 1 {
+				t.Errorf("Consistency of %d and %d: wrong root accepted", m, n)
+			}
+		}
+	}
+
+	_, err := InclusionProof(3, hashes[:3])
+	if err == nil {
+		t.Fatalf("Proof for leaf outside of the tree should fail")
+	}
+}